@@ -0,0 +1,224 @@
+// Package audit records who did what to which document, in a tamper-evident trail.
+//
+// Events are stored in partitions, one per user. Each event contains the hash of the previous event in its partition,
+// and its own hash covers every field, so changing, removing or reordering an event breaks the chain from that point
+// on. Hashes are HMACs with a key that is kept outside the store, so that someone who can change the store can't
+// rewrite the chain to match. Removing events from the end of a partition can only be detected by comparing its head
+// hash with a copy kept elsewhere, which is why Verify returns it.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Action is an operation that is audited.
+type Action string
+
+const (
+	ListDocuments  Action = "list_documents"
+	ReadDocument   Action = "read_document"
+	UploadDocument Action = "upload_document"
+	DeleteDocument Action = "delete_document"
+	DeleteAccount  Action = "delete_account"
+	ReadDeletion   Action = "read_deletion"
+	ReadAudit      Action = "read_audit"
+	ReadActivity   Action = "read_activity"
+)
+
+// Outcome is the result of an audited operation.
+type Outcome string
+
+const (
+	Success  Outcome = "success"
+	Denied   Outcome = "denied"    // The actor wasn't allowed to perform the action.
+	NotFound Outcome = "not_found" // The document doesn't exist, or doesn't belong to the actor.
+	Rejected Outcome = "rejected"  // The request was invalid.
+	Failed   Outcome = "failed"    // The operation failed because of a server error.
+)
+
+// OutcomeOf returns the outcome of an operation that returned an HTTP status code.
+func OutcomeOf(code int) Outcome {
+	switch {
+	case code < 400:
+		return Success
+	case code == 401 || code == 403:
+		return Denied
+	case code == 404:
+		return NotFound
+	case code < 500:
+		return Rejected
+	default:
+		return Failed
+	}
+}
+
+// Event is a single entry in the audit trail.
+type Event struct {
+	// Partition is the user whose documents or account the event concerns.
+	Partition string    `json:"-"`
+	Sequence  int64     `json:"sequence"`
+	Timestamp time.Time `json:"timestamp"`
+	// Actor is the user who performed the action, which is only different from the partition for administrators.
+	Actor      string  `json:"actor"`
+	Action     Action  `json:"action"`
+	DocumentID string  `json:"document_id,omitempty"`
+	Outcome    Outcome `json:"outcome"`
+	RequestID  string  `json:"request_id,omitempty"`
+	// PrevHash is the hash of the previous event in the partition, empty for the first event.
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+}
+
+// keyedHashPrefix starts the hash of an event that was hashed with a key. Other hashes are a plain SHA-256, from before
+// events were keyed or when there is no key.
+const keyedHashPrefix = "hmac-sha256:"
+
+// computeHash returns the hash of every field of the event other than Hash, keyed with key if it isn't empty.
+func (e *Event) computeHash(key []byte) string {
+	// Encoding the fields as a JSON array keeps them unambiguous whatever they contain.
+	b, _ := json.Marshal([]interface{}{
+		e.Partition, e.Sequence, e.Timestamp.UTC().Format(time.RFC3339Nano), e.Actor, e.Action, e.DocumentID,
+		e.Outcome, e.RequestID, e.PrevHash,
+	})
+	if len(key) == 0 {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return keyedHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// link makes e the event following last in its partition, or the first event if last is nil, and hashes it with key.
+func (e *Event) link(last *Event, key []byte) {
+	e.Sequence, e.PrevHash = 1, ""
+	if last != nil {
+		e.Sequence, e.PrevHash = last.Sequence+1, last.Hash
+	}
+	e.Hash = e.computeHash(key)
+}
+
+// Store keeps the audit trail.
+type Store interface {
+	// Append adds an event to the end of its partition, setting its Sequence, PrevHash and Hash. The timestamp is set
+	// if it is zero.
+	Append(ctx context.Context, e *Event) error
+	// Events returns up to limit events from a partition with sequence numbers greater than after, in order.
+	Events(ctx context.Context, partition string, after int64, limit int) ([]*Event, error)
+	// Partitions returns every partition that contains events.
+	Partitions(ctx context.Context) ([]string, error)
+}
+
+// prepare sets the timestamp of an event that is about to be appended. Timestamps are stored with microsecond
+// precision, so they are truncated before being hashed.
+func prepare(e *Event) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	e.Timestamp = e.Timestamp.UTC().Truncate(time.Microsecond)
+}
+
+// Problem is a break in the chain of a partition.
+type Problem struct {
+	Sequence int64  `json:"sequence"`
+	Problem  string `json:"problem"`
+}
+
+// Report is the result of verifying a partition.
+type Report struct {
+	Partition string    `json:"partition"`
+	Events    int64     `json:"events"`
+	Head      string    `json:"head"` // Hash of the last event.
+	Problems  []Problem `json:"problems,omitempty"`
+	// Unkeyed is the number of events that were hashed without a key. Anyone who could change the store could have
+	// rewritten them.
+	Unkeyed int64 `json:"unkeyed,omitempty"`
+}
+
+// verifyPageSize is the number of events read at once by Verify.
+const verifyPageSize = 1000
+
+// Verify checks the chain of a partition: that the sequence numbers start at 1 with no gaps, that every event has the
+// hash of its contents, and that every event links to the one before it. Keyed hashes are checked with key. Unkeyed
+// hashes are accepted until the first keyed one, as events appended before the trail was keyed, but not after it.
+func Verify(ctx context.Context, store Store, key []byte, partition string) (*Report, error) {
+	report := &Report{Partition: partition}
+	var last *Event
+	keyed := false
+	var after int64
+	for {
+		events, err := store.Events(ctx, partition, after, verifyPageSize)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range events {
+			problem := func(format string, args ...interface{}) {
+				report.Problems = append(report.Problems, Problem{Sequence: e.Sequence, Problem: fmt.Sprintf(format, args...)})
+			}
+			want := int64(1)
+			prevHash := ""
+			if last != nil {
+				want, prevHash = last.Sequence+1, last.Hash
+			}
+			if e.Sequence != want {
+				problem("expected sequence %d", want)
+			}
+			if e.Partition != partition {
+				problem("event belongs to partition %q", e.Partition)
+			}
+			if e.PrevHash != prevHash {
+				problem("previous hash is %q, expected %q", e.PrevHash, prevHash)
+			}
+			switch {
+			case strings.HasPrefix(e.Hash, keyedHashPrefix):
+				keyed = true
+				if len(key) == 0 {
+					problem("hash is keyed, but there is no key to check it")
+				} else if hash := e.computeHash(key); !hmac.Equal([]byte(e.Hash), []byte(hash)) {
+					problem("hash is %q, expected %q", e.Hash, hash)
+				}
+			case keyed:
+				report.Unkeyed++
+				problem("hash isn't keyed, but an earlier event's is")
+			default:
+				report.Unkeyed++
+				if hash := e.computeHash(nil); e.Hash != hash {
+					problem("hash is %q, expected %q", e.Hash, hash)
+				}
+			}
+			last = e
+		}
+		report.Events += int64(len(events))
+		if last != nil {
+			after = last.Sequence
+			report.Head = last.Hash
+		}
+		if len(events) < verifyPageSize {
+			return report, nil
+		}
+	}
+}
+
+// VerifyAll verifies every partition in the store.
+func VerifyAll(ctx context.Context, store Store, key []byte) ([]*Report, error) {
+	partitions, err := store.Partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var reports []*Report
+	for _, p := range partitions {
+		report, err := Verify(ctx, store, key, p)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't verify audit partition %q: %v", p, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
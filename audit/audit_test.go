@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func appendEvents(t *testing.T, s Store, partition string, n int) {
+	for i := 0; i < n; i++ {
+		e := &Event{Partition: partition, Actor: partition, Action: ReadDocument, DocumentID: fmt.Sprintf("doc-%d", i), Outcome: Success}
+		if err := s.Append(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	s := NewMemoryStore(testKey)
+	appendEvents(t, s, "user-1", 3)
+	appendEvents(t, s, "user-2", 1)
+
+	events, err := s.Events(context.Background(), "user-1", 0, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 3) {
+		assert.Equal(t, int64(1), events[0].Sequence)
+		assert.Equal(t, "", events[0].PrevHash)
+		assert.Equal(t, events[0].Hash, events[1].PrevHash)
+		assert.Equal(t, events[1].Hash, events[2].PrevHash)
+		assert.Equal(t, time.UTC, events[0].Timestamp.Location())
+	}
+	events, err = s.Events(context.Background(), "user-1", 1, 1)
+	assert.Nil(t, err)
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, int64(2), events[0].Sequence)
+	}
+
+	partitions, err := s.Partitions(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"user-1", "user-2"}, partitions)
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	s := NewMemoryStore(testKey)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			appendEvents(t, s, "user-1", 10)
+		}()
+	}
+	wg.Wait()
+	report, err := Verify(context.Background(), s, testKey, "user-1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), report.Events)
+	assert.Empty(t, report.Problems)
+}
+
+func TestVerify(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		tamper func(events []*Event) []*Event
+		want   []int64 // Sequence numbers of the events with problems.
+	}{
+		{"intact", func(events []*Event) []*Event { return events }, nil},
+		{"changed", func(events []*Event) []*Event {
+			events[1].Actor = "someone-else"
+			return events
+		}, []int64{2}},
+		{"changed and rehashed", func(events []*Event) []*Event {
+			events[1].Outcome = Denied
+			events[1].Hash = events[1].computeHash(testKey)
+			return events
+		}, []int64{3}},
+		{"rehashed without the key", func(events []*Event) []*Event {
+			events[1].Outcome = Denied
+			events[1].Hash = events[1].computeHash([]byte("guessed"))
+			return events
+		}, []int64{2, 3}},
+		{"rehashed unkeyed", func(events []*Event) []*Event {
+			events[1].Outcome = Denied
+			events[1].Hash = events[1].computeHash(nil)
+			return events
+		}, []int64{2, 3}},
+		{"removed", func(events []*Event) []*Event {
+			return append(events[:1], events[2:]...)
+		}, []int64{3, 3}},
+		{"reordered", func(events []*Event) []*Event {
+			events[1], events[2] = events[2], events[1]
+			return events
+		}, []int64{3, 3, 2, 2, 4, 4}},
+	} {
+		s := NewMemoryStore(testKey)
+		appendEvents(t, s, "user-1", 4)
+		s.partitions["user-1"] = test.tamper(s.partitions["user-1"])
+
+		report, err := Verify(context.Background(), s, testKey, "user-1")
+		assert.Nil(t, err)
+		var got []int64
+		for _, p := range report.Problems {
+			got = append(got, p.Sequence)
+		}
+		assert.Equal(t, test.want, got, test.name)
+	}
+}
+
+func TestVerifyUnkeyed(t *testing.T) {
+	// Events appended before the trail was keyed.
+	s := NewMemoryStore(nil)
+	appendEvents(t, s, "user-1", 2)
+	s.key = testKey
+	appendEvents(t, s, "user-1", 2)
+
+	report, err := Verify(context.Background(), s, testKey, "user-1")
+	assert.Nil(t, err)
+	assert.Empty(t, report.Problems)
+	assert.Equal(t, int64(2), report.Unkeyed)
+
+	// Keyed events can't be checked without the key.
+	report, err = Verify(context.Background(), s, nil, "user-1")
+	assert.Nil(t, err)
+	assert.Len(t, report.Problems, 2)
+}
+
+func TestVerifyPages(t *testing.T) {
+	s := NewMemoryStore(testKey)
+	appendEvents(t, s, "user-1", verifyPageSize+1)
+	appendEvents(t, s, "user-2", 1)
+	reports, err := VerifyAll(context.Background(), s, testKey)
+	assert.Nil(t, err)
+	if assert.Len(t, reports, 2) {
+		assert.Equal(t, int64(verifyPageSize+1), reports[0].Events)
+		assert.Empty(t, reports[0].Problems)
+		last, _ := s.Events(context.Background(), "user-1", verifyPageSize, 1)
+		assert.Equal(t, last[0].Hash, reports[0].Head)
+	}
+}
+
+func TestOutcomeOf(t *testing.T) {
+	for code, want := range map[int]Outcome{
+		200: Success,
+		202: Success,
+		304: Success,
+		400: Rejected,
+		401: Denied,
+		403: Denied,
+		404: NotFound,
+		503: Failed,
+	} {
+		assert.Equal(t, want, OutcomeOf(code), "%d", code)
+	}
+}
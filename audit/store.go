@@ -0,0 +1,216 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+)
+
+// MemoryStore keeps the audit trail in memory, for tests and local development.
+type MemoryStore struct {
+	key        []byte
+	mu         sync.Mutex
+	partitions map[string][]*Event
+}
+
+// NewMemoryStore returns an empty MemoryStore that hashes events with key, or with plain SHA-256 if key is empty.
+func NewMemoryStore(key []byte) *MemoryStore {
+	return &MemoryStore{key: key, partitions: make(map[string][]*Event)}
+}
+
+func (s *MemoryStore) Append(ctx context.Context, e *Event) error {
+	prepare(e)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last *Event
+	if events := s.partitions[e.Partition]; len(events) > 0 {
+		last = events[len(events)-1]
+	}
+	e.link(last, s.key)
+	stored := *e
+	s.partitions[e.Partition] = append(s.partitions[e.Partition], &stored)
+	return nil
+}
+
+func (s *MemoryStore) Events(ctx context.Context, partition string, after int64, limit int) ([]*Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var response []*Event
+	for _, e := range s.partitions[partition] {
+		if e.Sequence <= after {
+			continue
+		}
+		if len(response) == limit {
+			break
+		}
+		event := *e
+		response = append(response, &event)
+	}
+	return response, nil
+}
+
+func (s *MemoryStore) Partitions(ctx context.Context) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var partitions []string
+	for p := range s.partitions {
+		partitions = append(partitions, p)
+	}
+	sort.Strings(partitions)
+	return partitions, nil
+}
+
+// SpannerStore keeps the audit trail in the AuditEvents table.
+type SpannerStore struct {
+	Client  *spanner.Client
+	Timeout time.Duration // Applied to each query, 10 seconds if unset.
+	// Key is the HMAC key used to hash events. It must not be stored in Spanner. Events are hashed with plain SHA-256
+	// if it is empty.
+	Key []byte
+}
+
+// maxAppendAttempts limits the number of times Append retries when other events are appended to the same partition
+// at the same time.
+const maxAppendAttempts = 10
+
+// errSequenceTaken is returned by insert when another event already has the sequence number.
+var errSequenceTaken = errors.New("sequence number already used")
+
+// Append reads the last event in the partition and inserts the new event after it. Because the primary key is the
+// partition and sequence number, only one of any concurrent appends can take the next sequence number, and the others
+// try again.
+func (s *SpannerStore) Append(ctx context.Context, e *Event) error {
+	prepare(e)
+	for attempt := 0; attempt < maxAppendAttempts; attempt++ {
+		last, err := s.last(ctx, e.Partition)
+		if err != nil {
+			return err
+		}
+		e.link(last, s.Key)
+		if err := s.insert(ctx, e); err != errSequenceTaken {
+			return err
+		}
+	}
+	return fmt.Errorf("couldn't append audit event to partition %q: too many concurrent appends", e.Partition)
+}
+
+func (s *SpannerStore) insert(ctx context.Context, e *Event) error {
+	mut := spanner.Insert("AuditEvents", eventColumnList, []interface{}{
+		e.Partition, e.Sequence, e.Timestamp, e.Actor, string(e.Action), e.DocumentID, string(e.Outcome), e.RequestID,
+		e.PrevHash, e.Hash,
+	})
+	if _, err := s.Client.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		if spanner.ErrCode(err) == codes.AlreadyExists {
+			return errSequenceTaken
+		}
+		return fmt.Errorf("error inserting audit event: %v", err)
+	}
+	return nil
+}
+
+// eventColumns is the list of columns written by insert and read by scanEvent.
+const eventColumns = `UserId, Sequence, Timestamp, Actor, Action, DocumentId, Outcome, RequestId, PrevHash, Hash`
+
+var eventColumnList = strings.Split(eventColumns, ", ")
+
+// scanEvent reads an AuditEvents row selected with eventColumns.
+func scanEvent(row *spanner.Row) (*Event, error) {
+	var e Event
+	var action, outcome string
+	var documentID, requestID spanner.NullString
+	if err := row.Columns(&e.Partition, &e.Sequence, &e.Timestamp, &e.Actor, &action, &documentID, &outcome,
+		&requestID, &e.PrevHash, &e.Hash); err != nil {
+		return nil, fmt.Errorf("error fetching audit event row: %v", err)
+	}
+	e.Action = Action(action)
+	e.Outcome = Outcome(outcome)
+	e.DocumentID = documentID.StringVal
+	e.RequestID = requestID.StringVal
+	return &e, nil
+}
+
+// last returns the last event in a partition, or nil if it is empty.
+func (s *SpannerStore) last(ctx context.Context, partition string) (*Event, error) {
+	stmt := spanner.NewStatement(`SELECT ` + eventColumns + ` FROM AuditEvents WHERE UserId = @partition
+	                              ORDER BY Sequence DESC LIMIT 1`)
+	stmt.Params["partition"] = partition
+	events, err := s.query(ctx, stmt)
+	if err != nil || len(events) == 0 {
+		return nil, err
+	}
+	return events[0], nil
+}
+
+func (s *SpannerStore) Events(ctx context.Context, partition string, after int64, limit int) ([]*Event, error) {
+	stmt := spanner.NewStatement(`SELECT ` + eventColumns + ` FROM AuditEvents WHERE UserId = @partition
+	                              AND Sequence > @after ORDER BY Sequence LIMIT @limit`)
+	stmt.Params["partition"] = partition
+	stmt.Params["after"] = after
+	stmt.Params["limit"] = int64(limit)
+	return s.query(ctx, stmt)
+}
+
+func (s *SpannerStore) Partitions(ctx context.Context) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+
+	var partitions []string
+	iter := s.Client.Single().Query(ctx, spanner.NewStatement(`SELECT DISTINCT UserId FROM AuditEvents ORDER BY UserId`))
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching audit partitions: %v", err)
+		}
+		var p string
+		if err := row.Columns(&p); err != nil {
+			return nil, fmt.Errorf("error fetching audit partition row: %v", err)
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions, nil
+}
+
+func (s *SpannerStore) timeout() time.Duration {
+	if s.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return s.Timeout
+}
+
+func (s *SpannerStore) query(ctx context.Context, stmt spanner.Statement) ([]*Event, error) {
+	var response []*Event
+
+	// Set a timeout for the audit query.
+	ctx, cancel := context.WithTimeout(ctx, s.timeout())
+	defer cancel()
+
+	iter := s.Client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching audit events: %v", err)
+		}
+		e, err := scanEvent(row)
+		if err != nil {
+			return nil, err
+		}
+		response = append(response, e)
+	}
+	return response, nil
+}
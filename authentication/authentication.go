@@ -2,13 +2,17 @@ package authentication
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/logging"
 	"github.com/dparrish/build-web-application-demo/swagger"
 	"go.opencensus.io/trace"
 
@@ -20,7 +24,7 @@ import (
 
 func Handler(config *autoconfig.Config) http.HandlerFunc {
 	if config.Get("auth0.domain") == "" || config.Get("auth0.audience") == "" || config.Get("auth0.client_id") == "" || config.Get("auth0.client_secret") == "" {
-		log.Fatalf("Unable to create authentication handler, auth0 is not configured")
+		logger.Fatalf(context.Background(), "Unable to create authentication handler, auth0 is not configured")
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Parse the login request from the client.
@@ -66,16 +70,61 @@ func Handler(config *autoconfig.Config) http.HandlerFunc {
 	}
 }
 
-func Middleware(config *autoconfig.Config, next http.HandlerFunc) http.HandlerFunc {
+type contextKey int
+
+const userIDKey contextKey = 0
+
+// WithUserID returns a copy of ctx carrying the ID of the authenticated user.
+func WithUserID(ctx context.Context, userid string) context.Context {
+	return context.WithValue(ctx, userIDKey, userid)
+}
+
+// UserID returns the ID of the authenticated user from a request context, or an empty string if the request was not
+// authenticated.
+func UserID(ctx context.Context) string {
+	userid, _ := ctx.Value(userIDKey).(string)
+	return userid
+}
+
+// validators holds the JWT validator for each configuration, shared by every route.
+var (
+	validatorsMu sync.Mutex
+	validators   = make(map[*autoconfig.Config]*atomic.Value)
+)
+
+func newValidator(config *autoconfig.Config) *auth0.JWTValidator {
 	uri := fmt.Sprintf("https://%s/.well-known/jwks.json", config.Get("auth0.domain"))
 	audience := []string{config.Get("auth0.client_id")}
 	issuer := fmt.Sprintf("https://%s/", config.Get("auth0.domain"))
 	client := auth0.NewJWKClient(auth0.JWKClientOptions{URI: uri}, nil)
-	validator := auth0.NewValidator(auth0.NewConfiguration(client, audience, issuer, jose.RS256), nil)
+	return auth0.NewValidator(auth0.NewConfiguration(client, audience, issuer, jose.RS256), nil)
+}
+
+// getValidator returns the validator for a configuration. The validator is replaced whenever the auth0 configuration
+// changes; requests already being validated keep using the old one.
+func getValidator(config *autoconfig.Config) *auth0.JWTValidator {
+	validatorsMu.Lock()
+	defer validatorsMu.Unlock()
+	v, ok := validators[config]
+	if !ok {
+		v = &atomic.Value{}
+		v.Store(newValidator(config))
+		config.OnChange("auth0", func(old, new *autoconfig.Config, changed []string) {
+			logger.Infof(context.Background(), "Auth0 configuration changed (%v), rebuilding token validator", changed)
+			v.Store(newValidator(new))
+		})
+		validators[config] = v
+	}
+	return v.Load().(*auth0.JWTValidator)
+}
+
+func Middleware(config *autoconfig.Config, next http.HandlerFunc) http.HandlerFunc {
+	getValidator(config)
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		_, span := trace.StartSpan(r.Context(), "github.com/dparrish/build-web-application-demo/authentication.Middleware")
 
+		validator := getValidator(config)
 		token, err := validator.ValidateRequest(r)
 		if err != nil {
 			swagger.Errorf(w, http.StatusUnauthorized, "Missing or invalid token")
@@ -94,9 +143,25 @@ func Middleware(config *autoconfig.Config, next http.HandlerFunc) http.HandlerFu
 		}
 
 		// Save the logged-in user ID to the context for the next handler.
+		r = r.WithContext(logger.With(WithUserID(r.Context(), claims.Subject), "user_id", claims.Subject))
 		gctx.Set(r, "userid", claims.Subject)
+		logging.SetUserID(r.Context(), claims.Subject)
 
 		span.End()
 		next.ServeHTTP(w, r)
 	}
 }
+
+// Admin wraps Middleware and additionally requires the logged-in user to be listed in the "admin.users" configuration.
+func Admin(config *autoconfig.Config, next http.HandlerFunc) http.HandlerFunc {
+	return Middleware(config, func(w http.ResponseWriter, r *http.Request) {
+		userid, _ := gctx.Get(r, "userid").(string)
+		for _, admin := range config.GetAll("admin.users") {
+			if userid != "" && userid == admin {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		swagger.Errorf(w, http.StatusForbidden, "Administrator access required")
+	})
+}
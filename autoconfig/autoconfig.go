@@ -1,18 +1,24 @@
 // Package autoconfig wraps a JSON configuration stored on disk that is queryable using the Get* functions.
 //
-// The configuration file will be watched for changes after the initial load. Whenever the file has changed, each
+// The configuration may be built from several layers, such as a base file, an overlay file for each environment and
+// overrides from environment variables or flags. See Source.
+//
+// The configuration files will be watched for changes after the initial load. Whenever a file has changed, each
 // validation function will be called in the order they were added.
 package autoconfig
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/dparrish/build-web-application-demo/logger"
+
 	"github.com/clbanning/mxj"
-	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/afero"
 )
 
@@ -20,30 +26,62 @@ var Fs = afero.NewOsFs()
 
 // Config wraps a JSON configuration stored on disk and provides functions to query it.
 type Config struct {
+	reloads int64 // Accessed atomically, first to keep it 64-bit aligned.
+
 	sync.RWMutex
-	filename   string
-	mv         mxj.Map
-	validators []func(old *Config, new *Config) error
+	sources     []Source
+	mv          mxj.Map
+	origins     map[string]string      // dotted path -> source name
+	raw         map[string]interface{} // Values as read from the sources, before secrets were resolved.
+	secrets     map[string]bool        // Paths containing resolved secrets.
+	secretFiles []string
+	unresolved  bool // Secret references are left as they are, see CheckWithSchema.
+	validators  []func(old *Config, new *Config) error
+	bindings    []*Binding
+
+	subscriptions []subscription
+	lastError     error
+
+	// applyMu serializes reloads and rollbacks.
+	applyMu     sync.Mutex
+	history     []*Version
+	historySize int
+	nextVersion int
+	errors      []ReloadError
+}
+
+// Load merges the configuration from each source in order, so that later sources override earlier ones.
+// Example: Load(ctx, File("config.json"), File("config-prod.json"), Env("WAS_"))
+func Load(ctx context.Context, sources ...Source) (*Config, error) {
+	return load(ctx, nil, sources, false)
 }
 
-func Load(ctx context.Context, filename string) (*Config, error) {
-	c := &Config{filename: filename}
+func load(ctx context.Context, validators []func(old, new *Config) error, sources []Source, unresolved bool) (*Config, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no config sources")
+	}
+	c := &Config{sources: sources, validators: validators, unresolved: unresolved}
 	if err := c.read(); err != nil {
+		if verr, ok := err.(*ValidationError); ok {
+			// Keep the list of problems available to the caller.
+			return nil, verr
+		}
 		return nil, fmt.Errorf("unable to read initial config: %v", err)
 	}
 	return c, nil
 }
 
-func (c *Config) Watch(ctx context.Context) error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return fmt.Errorf("couldn't create config watcher: %v", err)
-	}
-	if err := watcher.Add(c.filename); err != nil {
-		return fmt.Errorf("couldn't create config watcher: %v", err)
+// files returns every file that the configuration is read from, including secret files.
+func (c *Config) files() []string {
+	var files []string
+	for _, s := range c.sources {
+		if w, ok := s.(watchedSource); ok {
+			files = append(files, w.files()...)
+		}
 	}
-	go c.background(ctx, watcher)
-	return nil
+	c.RLock()
+	defer c.RUnlock()
+	return append(files, c.secretFiles...)
 }
 
 // AddValidator adds a function that will be called whenever the config file changes.
@@ -57,83 +95,316 @@ func (c *Config) AddValidator(f func(old *Config, new *Config) error) {
 }
 
 // Get looks up a configuration item in dotted path notation and returns the first (or only) value.
+// Non-string values are formatted as strings.
 // Example: c.Get("spanner.database.path")
 func (c *Config) Get(path string) string {
-	c.RLock()
-	defer c.RUnlock()
-	values, err := c.mv.ValuesForPath(path)
-	if err != nil {
-		log.Printf("Error in ValuesForPath(%q): %v", path, err)
-	}
-	if len(values) == 0 {
+	v, ok := c.value(path)
+	if !ok {
 		return ""
 	}
-	return values[0].(string)
+	return toString(v)
 }
 
 // Get looks up a configuration item in dotted path notation and returns a list of values.
 func (c *Config) GetAll(path string) []string {
+	values := c.values(path)
+	r := make([]string, 0, len(values))
+	for _, v := range values {
+		r = append(r, toString(v))
+	}
+	return r
+}
+
+// GetInt looks up an integer configuration item. Strings containing integers are accepted.
+func (c *Config) GetInt(path string) (int, error) {
+	v, ok := c.value(path)
+	if !ok {
+		return 0, &MissingError{path}
+	}
+	switch t := v.(type) {
+	case float64:
+		if t != float64(int(t)) {
+			return 0, fmt.Errorf("config %q: %v is not an integer", path, t)
+		}
+		return int(t), nil
+	case string:
+		i, err := strconv.Atoi(t)
+		if err != nil {
+			return 0, fmt.Errorf("config %q: %s is not an integer", path, c.quote(path, t))
+		}
+		return i, nil
+	}
+	return 0, typeError(path, "an integer", v)
+}
+
+// GetIntOr is the same as GetInt, but returns def if the item is not set.
+func (c *Config) GetIntOr(path string, def int) (int, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetInt(path)
+}
+
+// GetFloat looks up a numeric configuration item. Strings containing numbers are accepted.
+func (c *Config) GetFloat(path string) (float64, error) {
+	v, ok := c.value(path)
+	if !ok {
+		return 0, &MissingError{path}
+	}
+	switch t := v.(type) {
+	case float64:
+		return t, nil
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		if err != nil {
+			return 0, fmt.Errorf("config %q: %s is not a number", path, c.quote(path, t))
+		}
+		return f, nil
+	}
+	return 0, typeError(path, "a number", v)
+}
+
+// GetFloatOr is the same as GetFloat, but returns def if the item is not set.
+func (c *Config) GetFloatOr(path string, def float64) (float64, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetFloat(path)
+}
+
+// GetBool looks up a boolean configuration item. Strings accepted by strconv.ParseBool are accepted.
+func (c *Config) GetBool(path string) (bool, error) {
+	v, ok := c.value(path)
+	if !ok {
+		return false, &MissingError{path}
+	}
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		b, err := strconv.ParseBool(t)
+		if err != nil {
+			return false, fmt.Errorf("config %q: %s is not a boolean", path, c.quote(path, t))
+		}
+		return b, nil
+	}
+	return false, typeError(path, "a boolean", v)
+}
+
+// GetBoolOr is the same as GetBool, but returns def if the item is not set.
+func (c *Config) GetBoolOr(path string, def bool) (bool, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetBool(path)
+}
+
+// GetDuration looks up a duration configuration item. Strings are parsed with time.ParseDuration (e.g. "10s"), and
+// numbers are treated as a number of seconds.
+func (c *Config) GetDuration(path string) (time.Duration, error) {
+	v, ok := c.value(path)
+	if !ok {
+		return 0, &MissingError{path}
+	}
+	switch t := v.(type) {
+	case float64:
+		return time.Duration(t * float64(time.Second)), nil
+	case string:
+		d, err := time.ParseDuration(t)
+		if err != nil {
+			return 0, fmt.Errorf("config %q: %s is not a duration", path, c.quote(path, t))
+		}
+		return d, nil
+	}
+	return 0, typeError(path, "a duration", v)
+}
+
+// GetDurationOr is the same as GetDuration, but returns def if the item is not set.
+func (c *Config) GetDurationOr(path string, def time.Duration) (time.Duration, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetDuration(path)
+}
+
+// GetStringSlice looks up a list of strings. A single string is returned as a list of one.
+func (c *Config) GetStringSlice(path string) ([]string, error) {
+	if !c.Has(path) {
+		return nil, &MissingError{path}
+	}
+	values := c.values(path)
+	r := make([]string, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			return nil, typeError(path, "a list of strings", v)
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
+
+// GetStringSliceOr is the same as GetStringSlice, but returns def if the item is not set.
+func (c *Config) GetStringSliceOr(path string, def []string) ([]string, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetStringSlice(path)
+}
+
+// GetMap looks up an object. The returned map is a copy and may be modified.
+func (c *Config) GetMap(path string) (map[string]interface{}, error) {
+	v, ok := c.value(path)
+	if !ok {
+		return nil, &MissingError{path}
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, typeError(path, "an object", v)
+	}
+	return mxj.Map(m).Copy()
+}
+
+// GetMapOr is the same as GetMap, but returns def if the item is not set.
+func (c *Config) GetMapOr(path string, def map[string]interface{}) (map[string]interface{}, error) {
+	if !c.Has(path) {
+		return def, nil
+	}
+	return c.GetMap(path)
+}
+
+// Has returns true if the configuration item is set.
+func (c *Config) Has(path string) bool {
+	_, ok := c.value(path)
+	return ok
+}
+
+// MissingError is returned by the typed Get functions when a configuration item is not set.
+type MissingError struct {
+	Path string
+}
+
+func (e *MissingError) Error() string {
+	return fmt.Sprintf("config %q is not set", e.Path)
+}
+
+func typeError(path, want string, v interface{}) error {
+	return fmt.Errorf("config %q: expected %s, got %T", path, want, v)
+}
+
+// values returns all the values at a path. Lists are flattened.
+func (c *Config) values(path string) []interface{} {
 	c.RLock()
 	defer c.RUnlock()
 	values, err := c.mv.ValuesForPath(path)
 	if err != nil {
-		log.Printf("Error in ValuesForPath(%q): %v", path, err)
+		logger.Errorf(context.Background(), "Error in ValuesForPath(%q): %v", path, err)
 	}
-	r := make([]string, 0, len(values))
-	for _, v := range values {
-		r = append(r, v.(string))
+	return values
+}
+
+// value returns the first value at a path.
+func (c *Config) value(path string) (interface{}, bool) {
+	values := c.values(path)
+	if len(values) == 0 || values[0] == nil {
+		return nil, false
 	}
-	return r
+	return values[0], true
+}
+
+func toString(v interface{}) string {
+	switch t := v.(type) {
+	case string:
+		return t
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+	return fmt.Sprint(v)
 }
 
 func (c *Config) read() error {
-	body, err := afero.ReadFile(Fs, c.filename)
+	values, origins, err := loadSources(c.sources)
 	if err != nil {
-		return fmt.Errorf("couldn't read config file %q: %v", c.filename, err)
+		return err
 	}
-	mv, err := mxj.NewMapJson(body)
-	if err != nil {
-		return fmt.Errorf("couldn't parse config: %v", err)
+	// The hash is taken before secrets are resolved, so that it identifies the configuration as written without
+	// depending on any secret.
+	hash := hashValues(values)
+	raw := copyValue(values).(map[string]interface{})
+	var secrets map[string]bool
+	var secretFiles []string
+	if !c.unresolved {
+		ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+		defer cancel()
+		if secrets, secretFiles, err = resolveSecrets(ctx, values); err != nil {
+			return err
+		}
 	}
+	newConfig := &Config{sources: c.sources, mv: mxj.Map(values), origins: origins, raw: raw, secrets: secrets, secretFiles: secretFiles}
+	err = c.apply(newConfig, hash, 0)
+	for _, s := range c.sources {
+		if r, ok := s.(rejectableSource); ok {
+			if err != nil {
+				r.rejected()
+			} else {
+				r.accepted()
+			}
+		}
+	}
+	return err
+}
+
+// apply validates a new configuration and, if it is accepted, makes it the current configuration.
+// rollbackOf is the version being restored by a rollback, or 0 for a normal load.
+func (c *Config) apply(newConfig *Config, hash string, rollbackOf int) error {
+	c.applyMu.Lock()
+	defer c.applyMu.Unlock()
 
-	newConfig := &Config{mv: mv}
-	for _, f := range c.validators {
+	c.RLock()
+	validators := c.validators
+	bindings := c.bindings
+	c.RUnlock()
+
+	for _, f := range validators {
 		if err := f(c, newConfig); err != nil {
-			log.Printf("Config validation failed: %v", err)
+			logger.Warningf(context.Background(), "Config validation failed: %v", err)
+			return err
+		}
+	}
+
+	// Bind every watched struct to the new config before accepting it, so that a config that can't be bound is
+	// rejected like any other invalid config.
+	bound := make([]interface{}, len(bindings))
+	for i, b := range bindings {
+		bound[i] = b.newValue()
+		if err := newConfig.Bind(b.prefix, bound[i]); err != nil {
+			logger.Warningf(context.Background(), "Config validation failed: %v", err)
 			return err
 		}
 	}
 
 	c.Lock()
-	c.mv = mv
+	old := c.snapshot()
+	c.mv = newConfig.mv
+	c.origins = newConfig.origins
+	c.raw = newConfig.raw
+	c.secrets = newConfig.secrets
+	c.secretFiles = newConfig.secretFiles
 	c.Unlock()
+
+	for i, b := range bindings {
+		b.publish(bound[i])
+	}
+	if changed := c.record(old, hash, rollbackOf); changed && old.mv != nil {
+		c.notify(old)
+	}
 	return nil
 }
 
-func (c *Config) background(ctx context.Context, watcher *fsnotify.Watcher) {
-	defer watcher.Close()
-	t := make(<-chan time.Time)
-	for {
-		select {
-		case <-ctx.Done():
-			// Stop watching when the context is cancelled.
-			return
-		case _, ok := <-watcher.Events:
-			if !ok {
-				log.Printf("Watcher ended for %q", c.filename)
-				return
-			}
-			// Create a timer to re-read the config file one second after noticing an event. This prevents the config file
-			// being read multiple times for a single file change.
-			t = time.After(1 * time.Second)
-			// Re-watch the file for further changes.
-			watcher.Add(c.filename)
-		case <-t:
-			if err := c.read(); err != nil {
-				log.Printf("Error re-reading config file, keeping existing config: %v", err)
-			} else {
-				log.Printf("Read changed config file %q", c.filename)
-			}
-		}
-	}
+// snapshot returns a copy of the current configuration values. The caller must hold the lock.
+func (c *Config) snapshot() *Config {
+	return &Config{sources: c.sources, mv: c.mv, origins: c.origins, raw: c.raw, secrets: c.secrets, secretFiles: c.secretFiles}
 }
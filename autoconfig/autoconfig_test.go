@@ -2,7 +2,18 @@ package autoconfig
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/assert"
@@ -16,6 +27,15 @@ const validConfig = `
 		"hash2": {
 			"hash2var1": ["foo", "bar"]
 		}
+	},
+	"types": {
+		"int": 42,
+		"intstring": "42",
+		"float": 1.5,
+		"bool": true,
+		"boolstring": "false",
+		"duration": "1m30s",
+		"seconds": 5
 	}
 }
 `
@@ -23,14 +43,14 @@ const validConfig = `
 func loadTestConfig() *Config {
 	Fs = afero.NewMemMapFs()
 	afero.WriteFile(Fs, "test.config", []byte(validConfig), 0644)
-	c, _ := Load(context.Background(), "test.config")
+	c, _ := Load(context.Background(), File("test.config"))
 	return c
 }
 
 func TestInvalidConfig(t *testing.T) {
 	Fs = afero.NewMemMapFs()
 	afero.WriteFile(Fs, "test.config", []byte("blahblah"), 0644)
-	c, err := Load(context.Background(), "test.config")
+	c, err := Load(context.Background(), File("test.config"))
 	assert.Nil(t, c)
 	assert.NotNil(t, err)
 }
@@ -38,7 +58,7 @@ func TestInvalidConfig(t *testing.T) {
 func TestLoad(t *testing.T) {
 	Fs = afero.NewMemMapFs()
 	afero.WriteFile(Fs, "test.config", []byte(validConfig), 0644)
-	c, err := Load(context.Background(), "test.config")
+	c, err := Load(context.Background(), File("test.config"))
 	assert.Nil(t, err)
 	assert.NotNil(t, c)
 }
@@ -54,5 +74,627 @@ func TestGetAll(t *testing.T) {
 	assert.Equal(t, c.GetAll("hash1.hash2.hash2var1"), []string{"foo", "bar"})
 }
 
+func TestGetNonString(t *testing.T) {
+	c := loadTestConfig()
+	assert.Equal(t, "42", c.Get("types.int"))
+	assert.Equal(t, "1.5", c.Get("types.float"))
+	assert.Equal(t, "true", c.Get("types.bool"))
+	assert.Equal(t, `{"hash2var1":["foo","bar"]}`, c.Get("hash1.hash2"))
+	assert.Equal(t, "", c.Get("types.missing"))
+}
+
+func TestGetInt(t *testing.T) {
+	c := loadTestConfig()
+	i, err := c.GetInt("types.int")
+	assert.Nil(t, err)
+	assert.Equal(t, 42, i)
+	i, err = c.GetInt("types.intstring")
+	assert.Nil(t, err)
+	assert.Equal(t, 42, i)
+
+	_, err = c.GetInt("types.float")
+	assert.NotNil(t, err)
+	_, err = c.GetInt("types.bool")
+	assert.NotNil(t, err)
+	_, err = c.GetInt("types.missing")
+	assert.IsType(t, &MissingError{}, err)
+
+	i, err = c.GetIntOr("types.missing", 7)
+	assert.Nil(t, err)
+	assert.Equal(t, 7, i)
+	_, err = c.GetIntOr("var1", 7)
+	assert.NotNil(t, err)
+}
+
+func TestGetFloat(t *testing.T) {
+	c := loadTestConfig()
+	f, err := c.GetFloat("types.float")
+	assert.Nil(t, err)
+	assert.Equal(t, 1.5, f)
+	f, err = c.GetFloatOr("types.missing", 2.5)
+	assert.Nil(t, err)
+	assert.Equal(t, 2.5, f)
+	_, err = c.GetFloat("var1")
+	assert.NotNil(t, err)
+}
+
+func TestGetBool(t *testing.T) {
+	c := loadTestConfig()
+	b, err := c.GetBool("types.bool")
+	assert.Nil(t, err)
+	assert.True(t, b)
+	b, err = c.GetBool("types.boolstring")
+	assert.Nil(t, err)
+	assert.False(t, b)
+	b, err = c.GetBoolOr("types.missing", true)
+	assert.Nil(t, err)
+	assert.True(t, b)
+	_, err = c.GetBool("types.int")
+	assert.NotNil(t, err)
+}
+
+func TestGetDuration(t *testing.T) {
+	c := loadTestConfig()
+	d, err := c.GetDuration("types.duration")
+	assert.Nil(t, err)
+	assert.Equal(t, 90*time.Second, d)
+	d, err = c.GetDuration("types.seconds")
+	assert.Nil(t, err)
+	assert.Equal(t, 5*time.Second, d)
+	d, err = c.GetDurationOr("types.missing", time.Hour)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Hour, d)
+	_, err = c.GetDuration("var1")
+	assert.NotNil(t, err)
+}
+
+func TestGetStringSlice(t *testing.T) {
+	c := loadTestConfig()
+	v, err := c.GetStringSlice("hash1.hash2.hash2var1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"foo", "bar"}, v)
+	v, err = c.GetStringSlice("var1")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"value1"}, v)
+	v, err = c.GetStringSliceOr("types.missing", []string{"default"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"default"}, v)
+	_, err = c.GetStringSlice("types.int")
+	assert.NotNil(t, err)
+}
+
+func TestGetMap(t *testing.T) {
+	c := loadTestConfig()
+	m, err := c.GetMap("hash1.hash2")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"foo", "bar"}, m["hash2var1"])
+
+	// The map is a copy.
+	m["hash2var1"] = "changed"
+	assert.Equal(t, []string{"foo", "bar"}, c.GetAll("hash1.hash2.hash2var1"))
+
+	_, err = c.GetMap("var1")
+	assert.NotNil(t, err)
+	m, err = c.GetMapOr("types.missing", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, m)
+}
+
 func TestValidator(t *testing.T) {
 }
+
+type testSettings struct {
+	Var1  string `config:"var1" required:"true"`
+	Hash1 struct {
+		Var1  string   `config:"hash1var1"`
+		Names []string `config:"hash2.hash2var1"`
+	} `config:"hash1"`
+	Types struct {
+		Int      int           `config:"int" min:"1" max:"100"`
+		Float    float64       `config:"float"`
+		Bool     bool          `config:"bool"`
+		Duration time.Duration `config:"duration" min:"1s"`
+		Default  int           `config:"missing" default:"12"`
+	} `config:"types"`
+	Optional string `config:"optional"`
+}
+
+func TestBind(t *testing.T) {
+	c := loadTestConfig()
+	var s testSettings
+	assert.Nil(t, c.Bind("", &s))
+	assert.Equal(t, "value1", s.Var1)
+	assert.Equal(t, "blah", s.Hash1.Var1)
+	assert.Equal(t, []string{"foo", "bar"}, s.Hash1.Names)
+	assert.Equal(t, 42, s.Types.Int)
+	assert.Equal(t, 1.5, s.Types.Float)
+	assert.True(t, s.Types.Bool)
+	assert.Equal(t, 90*time.Second, s.Types.Duration)
+	assert.Equal(t, 12, s.Types.Default)
+	assert.Equal(t, "", s.Optional)
+
+	var types struct {
+		Int int `config:"int"`
+	}
+	assert.Nil(t, c.Bind("types", &types))
+	assert.Equal(t, 42, types.Int)
+
+	assert.NotNil(t, c.Bind("", s))
+}
+
+func TestBindValidation(t *testing.T) {
+	c := loadTestConfig()
+	var s struct {
+		Missing  string        `config:"missing" required:"true"`
+		Int      int           `config:"types.int" max:"10"`
+		Duration time.Duration `config:"types.duration" max:"1m"`
+		Bad      int           `config:"var1"`
+	}
+	err := c.Bind("", &s)
+	if assert.IsType(t, &ValidationError{}, err) {
+		assert.Len(t, err.(*ValidationError).Problems, 4)
+	}
+}
+
+func TestBindWatch(t *testing.T) {
+	c := loadTestConfig()
+	b, err := c.BindWatch("", func() interface{} { return &testSettings{} })
+	assert.Nil(t, err)
+	assert.Equal(t, "value1", b.Get().(*testSettings).Var1)
+
+	var published *testSettings
+	b.Subscribe(func(v interface{}) { published = v.(*testSettings) })
+
+	// A valid reload replaces the bound struct.
+	afero.WriteFile(Fs, "test.config", []byte(`{"var1": "value2"}`), 0644)
+	assert.Nil(t, c.read())
+	assert.Equal(t, "value2", b.Get().(*testSettings).Var1)
+	assert.Equal(t, b.Get(), published)
+
+	// A reload that can't be bound is rejected.
+	afero.WriteFile(Fs, "test.config", []byte(`{"types": {"int": 1000}}`), 0644)
+	assert.NotNil(t, c.read())
+	assert.Equal(t, "value2", b.Get().(*testSettings).Var1)
+	assert.Equal(t, "value2", c.Get("var1"))
+}
+
+func TestLayers(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "base.json", []byte(`{"project": "p", "spanner": {"instance": "i", "database": "dev"}, "users": ["a", "b"]}`), 0644)
+	afero.WriteFile(Fs, "prod.json", []byte(`{"spanner": {"database": "prod"}, "users": ["c"]}`), 0644)
+	environ = func() []string {
+		return []string{"WAS_SPANNER_INSTANCE=instance-2", "WAS_KEY_CACHE_SIZE=10", "OTHER=x"}
+	}
+	defer func() { environ = os.Environ }()
+	set, err := Set([]string{"project=override"})
+	assert.Nil(t, err)
+
+	c, err := Load(context.Background(), File("base.json"), File("prod.json"), Env("WAS_"), set)
+	assert.Nil(t, err)
+	assert.Equal(t, "override", c.Get("project"))
+	assert.Equal(t, "instance-2", c.Get("spanner.instance"))
+	assert.Equal(t, "prod", c.Get("spanner.database"))
+	assert.Equal(t, []string{"c"}, c.GetAll("users"))
+	size, _ := c.GetInt("key.cache.size")
+	assert.Equal(t, 10, size)
+
+	assert.Equal(t, "flags", c.Origin("project"))
+	assert.Equal(t, "env:WAS_", c.Origin("spanner.instance"))
+	assert.Equal(t, "prod.json", c.Origin("spanner.database"))
+	assert.Equal(t, "prod.json", c.Origin("users"))
+	assert.Equal(t, "env:WAS_", c.Origin("spanner"))
+	assert.Equal(t, "", c.Origin("missing"))
+
+	_, err = Set([]string{"novalue"})
+	assert.NotNil(t, err)
+}
+
+func TestEnvPath(t *testing.T) {
+	base := map[string]interface{}{
+		"encryption": map[string]interface{}{
+			"key":       "api-kek",
+			"key_cache": map[string]interface{}{"ttl": "1h"},
+		},
+		"log-table": "access_log",
+	}
+	assert.Equal(t, "encryption.key_cache.ttl", envPath(base, "ENCRYPTION_KEY_CACHE_TTL"))
+	assert.Equal(t, "encryption.key", envPath(base, "ENCRYPTION_KEY"))
+	assert.Equal(t, "log-table", envPath(base, "LOG_TABLE"))
+	assert.Equal(t, "new.value", envPath(base, "NEW_VALUE"))
+}
+
+func TestSecrets(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "/etc/secrets/auth0", []byte("s3cret\n"), 0644)
+	afero.WriteFile(Fs, "test.config", []byte(`{
+		"auth0": {"client_secret": "secret://file/etc/secrets/auth0", "domain": "example.com"},
+		"port": "secret://env/SECRET_PORT",
+		"store": "secret://fake/api-key/versions/latest"
+	}`), 0644)
+	lookupEnv = func(key string) (string, bool) {
+		if key == "SECRET_PORT" {
+			return "not-a-number", true
+		}
+		return "", false
+	}
+	defer func() { lookupEnv = os.LookupEnv }()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/secrets/api-key/versions/latest:access", r.URL.Path)
+		fmt.Fprintf(w, `{"payload": {"data": %q}}`, base64.StdEncoding.EncodeToString([]byte("from-store")))
+	}))
+	defer server.Close()
+	RegisterSecretResolver("fake", &HTTPSecretResolver{BaseURL: server.URL + "/v1/secrets"})
+
+	c, err := Load(context.Background(), File("test.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cret", c.Get("auth0.client_secret"))
+	assert.Equal(t, "from-store", c.Get("store"))
+	assert.True(t, c.IsSecret("auth0"))
+	assert.False(t, c.IsSecret("auth0.domain"))
+	assert.Equal(t, Redacted, c.Display("auth0.client_secret"))
+	assert.Equal(t, "example.com", c.Display("auth0.domain"))
+	assert.Contains(t, c.files(), "/etc/secrets/auth0")
+
+	// Errors must not contain the secret.
+	_, err = c.GetInt("port")
+	assert.NotContains(t, err.Error(), "not-a-number")
+
+	// Rotating the secret goes through the validators.
+	var validated string
+	c.AddValidator(func(old, new *Config) error {
+		validated = new.Get("auth0.client_secret")
+		return nil
+	})
+	afero.WriteFile(Fs, "/etc/secrets/auth0", []byte("rotated"), 0644)
+	assert.Nil(t, c.read())
+	assert.Equal(t, "rotated", validated)
+	assert.Equal(t, "rotated", c.Get("auth0.client_secret"))
+
+	// A secret that can't be resolved rejects the reload.
+	Fs.Remove("/etc/secrets/auth0")
+	assert.NotNil(t, c.read())
+	assert.Equal(t, "rotated", c.Get("auth0.client_secret"))
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"key": "secret://unknown/x"}`), 0644)
+	_, err = Load(context.Background(), File("test.config"))
+	assert.NotNil(t, err)
+}
+
+const testSchema = `{
+	"type": "object",
+	"required": ["name", "storage"],
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"level": {"enum": ["debug", "info"]},
+		"count": {"type": "integer", "minimum": 1},
+		"timeout": {"type": ["string", "number"], "format": "duration"},
+		"storage": {
+			"type": "object",
+			"required": ["bucket"],
+			"additionalProperties": false,
+			"properties": {
+				"bucket": {"type": "string", "pattern": "^[a-z0-9][a-z0-9._-]{1,61}[a-z0-9]$"}
+			}
+		},
+		"users": {"type": "array", "items": {"type": "string"}}
+	}
+}`
+
+func TestSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	assert.Nil(t, err)
+
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "test.config", []byte(`{"name": "a", "level": "info", "count": 2, "timeout": 5, "storage": {"bucket": "my-bucket"}, "users": ["x"]}`), 0644)
+	c, err := LoadWithSchema(context.Background(), schema, File("test.config"))
+	assert.Nil(t, err)
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"level": "trace", "count": 1.5, "timeout": "soon", "storage": {"bucket": "Bad_Bucket", "extra": 1}, "users": [1]}`), 0644)
+	_, err = LoadWithSchema(context.Background(), schema, File("test.config"))
+	verr, ok := err.(*ValidationError)
+	if assert.True(t, ok, "expected a ValidationError, got %v", err) {
+		assert.Equal(t, []string{
+			`(root): missing required key "name"`,
+			`count: expected integer, got number`,
+			`level: "trace" is not one of debug, info`,
+			`storage.bucket: "Bad_Bucket" does not match ^[a-z0-9][a-z0-9._-]{1,61}[a-z0-9]$`,
+			`storage.extra: unknown key`,
+			`timeout: "soon" is not a duration`,
+			`users[0]: expected string, got number`,
+		}, verr.Problems)
+	}
+
+	// Bad reloads are rejected and the existing config is kept.
+	assert.NotNil(t, c.read())
+	assert.Equal(t, "a", c.Get("name"))
+}
+
+func TestCheckWithSchema(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	assert.Nil(t, err)
+
+	// The secret file doesn't exist, which only matters if the reference is resolved.
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "test.config", []byte(`{"name": "secret://file/missing", "storage": {"bucket": "my-bucket"}}`), 0644)
+	_, err = LoadWithSchema(context.Background(), schema, File("test.config"))
+	assert.NotNil(t, err)
+	c, err := CheckWithSchema(context.Background(), schema, File("test.config"))
+	if assert.Nil(t, err) {
+		assert.Equal(t, "secret://file/missing", c.Get("name"))
+	}
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"name": "secret://file/missing", "storage": {"bucket": "Bad_Bucket"}}`), 0644)
+	_, err = CheckWithSchema(context.Background(), schema, File("test.config"))
+	assert.IsType(t, &ValidationError{}, err)
+}
+
+func TestOnChange(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "test.config", []byte(`{"storage": {"bucket": "a", "class": "standard"}, "bigquery": {"dataset": "d"}}`), 0644)
+	c, err := Load(context.Background(), File("test.config"))
+	assert.Nil(t, err)
+
+	var storageChanged, bigqueryChanged []string
+	var oldBucket, newBucket string
+	c.OnChange("storage", func(old, new *Config, changed []string) {
+		storageChanged = changed
+		oldBucket, newBucket = old.Get("storage.bucket"), new.Get("storage.bucket")
+	})
+	c.OnChange("bigquery", func(old, new *Config, changed []string) {
+		bigqueryChanged = changed
+	})
+	c.OnChange("", func(old, new *Config, changed []string) {
+		panic("subscriber panics are recovered")
+	})
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"storage": {"bucket": "b", "location": "eu"}, "bigquery": {"dataset": "d"}}`), 0644)
+	assert.Nil(t, c.reload())
+	assert.Equal(t, []string{"storage.bucket", "storage.class", "storage.location"}, storageChanged)
+	assert.Equal(t, "a", oldBucket)
+	assert.Equal(t, "b", newBucket)
+	assert.Nil(t, bigqueryChanged)
+	assert.Equal(t, int64(1), c.Reloads())
+	assert.Nil(t, c.LastError())
+
+	afero.WriteFile(Fs, "test.config", []byte(`invalid`), 0644)
+	assert.NotNil(t, c.reload())
+	assert.Equal(t, int64(2), c.Reloads())
+	assert.NotNil(t, c.LastError())
+}
+
+func TestHTTPSource(t *testing.T) {
+	body := `{"spanner": {"database": "one"}}`
+	var fetches, notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", len(body)))
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	source := HTTP(server.URL)
+	c, err := Load(context.Background(), source)
+	assert.Nil(t, err)
+	assert.Equal(t, "one", c.Get("spanner.database"))
+
+	changed, err := source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed)
+	assert.Equal(t, 1, notModified)
+
+	body = `{"spanner": {"database": "second"}}`
+	changed, err = source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Nil(t, c.reload())
+	assert.Equal(t, "second", c.Get("spanner.database"))
+	assert.Equal(t, 3, fetches)
+}
+
+func TestHTTPSourceRejected(t *testing.T) {
+	body := `{"spanner": {"database": "one"}}`
+	var conditional int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf("%q", fmt.Sprintf("%x", len(body)))
+		if r.Header.Get("If-None-Match") != "" {
+			conditional++
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprint(w, body)
+	}))
+	defer server.Close()
+
+	source := HTTP(server.URL)
+	c, err := Load(context.Background(), source)
+	assert.Nil(t, err)
+	c.AddValidator(func(old, new *Config) error {
+		if new.Get("spanner.database") == "rejected" {
+			return errors.New("bad database")
+		}
+		return nil
+	})
+
+	body = `{"spanner": {"database": "rejected"}}`
+	changed, err := source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.NotNil(t, c.reload())
+	assert.Equal(t, "one", c.Get("spanner.database"))
+	values, err := source.Values(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"spanner": map[string]interface{}{"database": "one"}}, values)
+
+	// The rejected configuration is fetched again rather than being reported as unchanged.
+	conditional = 0
+	changed, err = source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, 0, conditional)
+}
+
+func TestDirectorySource(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "/etc/was/project", []byte("my-project\n"), 0644)
+	afero.WriteFile(Fs, "/etc/was/key_cache.size", []byte("64"), 0644)
+	afero.WriteFile(Fs, "/etc/was/..data/ignored", []byte("x"), 0644)
+	afero.WriteFile(Fs, "/etc/was/.hidden", []byte("x"), 0644)
+
+	source := Directory("/etc/was")
+	c, err := Load(context.Background(), source)
+	assert.Nil(t, err)
+	assert.Equal(t, "my-project", c.Get("project"))
+	size, _ := c.GetInt("key_cache.size")
+	assert.Equal(t, 64, size)
+	assert.Equal(t, []string{"key_cache.size", "project"}, sortedKeys(c.Origins()))
+
+	changed, err := source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	afero.WriteFile(Fs, "/etc/was/project", []byte("other-project"), 0644)
+	changed, err = source.Poll(context.Background())
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Nil(t, c.reload())
+	assert.Equal(t, "other-project", c.Get("project"))
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TestWatchSymlinkSwap updates a config file in the same way as Kubernetes updates a mounted ConfigMap.
+func TestWatchSymlinkSwap(t *testing.T) {
+	Fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "autoconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeVersion := func(version, value string) {
+		os.Mkdir(filepath.Join(dir, version), 0755)
+		ioutil.WriteFile(filepath.Join(dir, version, "config.json"), []byte(fmt.Sprintf(`{"value": %q}`, value)), 0644)
+		os.Symlink(version, filepath.Join(dir, "..data_tmp"))
+		os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data"))
+	}
+	writeVersion("..v1", "one")
+	os.Symlink(filepath.Join("..data", "config.json"), filepath.Join(dir, "config.json"))
+
+	c, err := Load(context.Background(), File(filepath.Join(dir, "config.json")))
+	assert.Nil(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.Nil(t, c.Watch(ctx))
+
+	// Writing an unrelated file in the directory doesn't reload the config.
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(`{}`), 0644)
+
+	writeVersion("..v2", "two")
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Get("value") != "two" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, "two", c.Get("value"))
+	assert.Equal(t, int64(1), c.Reloads())
+}
+
+func TestHistoryAndRollback(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "/secret", []byte("hunter2"), 0644)
+	afero.WriteFile(Fs, "test.config", []byte(`{"bucket": "a", "password": "secret://file/secret"}`), 0644)
+	c, err := Load(context.Background(), File("test.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, c.Version().ID)
+	firstHash := c.Version().Hash
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"bucket": "b", "password": "secret://file/secret"}`), 0644)
+	assert.Nil(t, c.reload())
+	assert.Equal(t, 2, c.Version().ID)
+	assert.Equal(t, []string{"bucket"}, c.Version().Changed)
+	assert.NotEqual(t, firstHash, c.Version().Hash)
+
+	// A reload that changes nothing doesn't create a new version.
+	assert.Nil(t, c.reload())
+	assert.Equal(t, 2, c.Version().ID)
+
+	afero.WriteFile(Fs, "test.config", []byte(`invalid`), 0644)
+	assert.NotNil(t, c.reload())
+
+	assert.Nil(t, c.Rollback(1))
+	assert.Equal(t, "a", c.Get("bucket"))
+	assert.Equal(t, 3, c.Version().ID)
+	assert.Equal(t, 1, c.Version().RollbackOf)
+	assert.Equal(t, firstHash, c.Version().Hash)
+	assert.NotNil(t, c.Rollback(3))
+	assert.NotNil(t, c.Rollback(42))
+
+	c.SetHistorySize(2)
+	assert.Len(t, c.History(), 2)
+	assert.NotNil(t, c.Rollback(1))
+
+	w := httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/config", nil))
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	var debug struct {
+		Version Version                `json:"version"`
+		Config  map[string]interface{} `json:"config"`
+		Errors  []ReloadError          `json:"errors"`
+	}
+	assert.Nil(t, json.Unmarshal(w.Body.Bytes(), &debug))
+	assert.Equal(t, 3, debug.Version.ID)
+	assert.Equal(t, Redacted, debug.Config["password"])
+	assert.Equal(t, "a", debug.Config["bucket"])
+	assert.Len(t, debug.Errors, 1)
+}
+
+func TestPlainSecretsRedacted(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "test.config", []byte(`{"auth0": {"domain": "example.com", "client_secret": "s3cret"}, "audit": {"hmac_key": "0123456789abcdef"}}`), 0644)
+	c, err := Load(context.Background(), File("test.config"))
+	assert.Nil(t, err)
+	assert.Equal(t, "s3cret", c.Get("auth0.client_secret"))
+	assert.True(t, c.IsSecret("auth0"))
+	assert.True(t, c.IsSecret("audit.hmac_key"))
+	assert.False(t, c.IsSecret("auth0.domain"))
+	assert.Equal(t, Redacted, c.Display("auth0.client_secret"))
+
+	w := httptest.NewRecorder()
+	c.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/debug/config", nil))
+	assert.NotContains(t, w.Body.String(), "s3cret")
+	assert.NotContains(t, w.Body.String(), "0123456789abcdef")
+	assert.Contains(t, w.Body.String(), "example.com")
+}
+
+func TestRollbackResolvesSecrets(t *testing.T) {
+	Fs = afero.NewMemMapFs()
+	afero.WriteFile(Fs, "/secret", []byte("hunter2"), 0644)
+	afero.WriteFile(Fs, "test.config", []byte(`{"bucket": "a", "password": "secret://file/secret"}`), 0644)
+	c, err := Load(context.Background(), File("test.config"))
+	assert.Nil(t, err)
+
+	afero.WriteFile(Fs, "test.config", []byte(`{"bucket": "b", "password": "secret://file/secret"}`), 0644)
+	afero.WriteFile(Fs, "/secret", []byte("rotated"), 0644)
+	assert.Nil(t, c.reload())
+	assert.Equal(t, "rotated", c.Get("password"))
+
+	// The rolled back version uses the secret as it is now, not as it was.
+	assert.Nil(t, c.Rollback(1))
+	assert.Equal(t, "a", c.Get("bucket"))
+	assert.Equal(t, "rotated", c.Get("password"))
+}
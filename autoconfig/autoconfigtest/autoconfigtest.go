@@ -0,0 +1,32 @@
+// Package autoconfigtest provides helpers for testing packages that are configured with autoconfig.
+package autoconfigtest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+
+	"github.com/spf13/afero"
+)
+
+// Load returns the configuration in body, a JSON document. It replaces autoconfig.Fs with an in-memory filesystem
+// holding the document, and fails the test if the configuration can't be loaded.
+func Load(t testing.TB, body string) *autoconfig.Config {
+	autoconfig.Fs = afero.NewMemMapFs()
+	afero.WriteFile(autoconfig.Fs, "test.config", []byte(body), 0644)
+	config, err := autoconfig.Load(context.Background(), autoconfig.File("test.config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// WaitForReload waits up to 5 seconds for config to have been reloaded n times.
+func WaitForReload(config *autoconfig.Config, n int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for config.Reloads() < n && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,289 @@
+package autoconfig
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// ValidationError contains every problem found while binding a configuration into a struct.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Bind fills the struct pointed to by v from the configuration below prefix (which may be empty).
+//
+// Fields are mapped using struct tags:
+//
+//	config:"path"     Path of the value, relative to prefix. Fields without this tag are ignored, except for nested
+//	                  structs, which are bound using the same prefix.
+//	default:"value"   Value to use if the path is not set.
+//	required:"true"   The path must be set.
+//	min:"x", max:"y"  Inclusive range for numbers and durations.
+//
+// Supported field types are strings, integers, floats, bools, time.Duration, []string, map[string]interface{} and
+// nested structs. A ValidationError listing every problem is returned if any field is missing or invalid.
+func (c *Config) Bind(prefix string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("Bind requires a pointer to a struct")
+	}
+	verr := &ValidationError{}
+	c.bindStruct(prefix, rv.Elem(), verr)
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+func joinPath(prefix, path string) string {
+	if prefix == "" {
+		return path
+	}
+	if path == "" {
+		return prefix
+	}
+	return prefix + "." + path
+}
+
+func (c *Config) bindStruct(prefix string, rv reflect.Value, verr *ValidationError) {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported.
+			continue
+		}
+		tag, hasTag := field.Tag.Lookup("config")
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			c.bindStruct(joinPath(prefix, tag), fv, verr)
+			continue
+		}
+		if !hasTag {
+			continue
+		}
+		path := joinPath(prefix, tag)
+		if err := c.bindField(path, field, fv); err != nil {
+			verr.Problems = append(verr.Problems, err.Error())
+		}
+	}
+}
+
+func (c *Config) bindField(path string, field reflect.StructField, fv reflect.Value) error {
+	if !c.Has(path) {
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setFromString(fv, def); err != nil {
+				return fmt.Errorf("%s: invalid default %q: %v", path, def, err)
+			}
+			return checkRange(path, field, fv)
+		}
+		if field.Tag.Get("required") == "true" {
+			return fmt.Errorf("%s is required", path)
+		}
+		return nil
+	}
+
+	switch {
+	case fv.Type() == durationType:
+		d, err := c.GetDuration(path)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+	case fv.Kind() == reflect.String:
+		fv.SetString(c.Get(path))
+	case fv.Kind() == reflect.Bool:
+		b, err := c.GetBool(path)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case fv.Kind() >= reflect.Int && fv.Kind() <= reflect.Int64:
+		i, err := c.GetInt(path)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(i))
+	case fv.Kind() >= reflect.Uint && fv.Kind() <= reflect.Uint64:
+		i, err := c.GetInt(path)
+		if err != nil {
+			return err
+		}
+		if i < 0 {
+			return fmt.Errorf("%s must not be negative", path)
+		}
+		fv.SetUint(uint64(i))
+	case fv.Kind() == reflect.Float32 || fv.Kind() == reflect.Float64:
+		f, err := c.GetFloat(path)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+		s, err := c.GetStringSlice(path)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(s))
+	case fv.Kind() == reflect.Map && fv.Type().Key().Kind() == reflect.String && fv.Type().Elem().Kind() == reflect.Interface:
+		m, err := c.GetMap(path)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("%s: unsupported field type %s", path, fv.Type())
+	}
+	return checkRange(path, field, fv)
+}
+
+// setFromString sets a field from the string form of a value, as used in default tags.
+func setFromString(fv reflect.Value, s string) error {
+	switch {
+	case fv.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(int64(d))
+	case fv.Kind() == reflect.String:
+		fv.SetString(s)
+	case fv.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case fv.Kind() >= reflect.Int && fv.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(i)
+	case fv.Kind() >= reflect.Uint && fv.Kind() <= reflect.Uint64:
+		i, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetUint(i)
+	case fv.Kind() == reflect.Float32 || fv.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(f)
+	case fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.String:
+		var parts []string
+		if s != "" {
+			parts = strings.Split(s, ",")
+		}
+		fv.Set(reflect.ValueOf(parts))
+	default:
+		return fmt.Errorf("defaults are not supported for %s", fv.Type())
+	}
+	return nil
+}
+
+// checkRange validates the min and max tags of a numeric or duration field.
+func checkRange(path string, field reflect.StructField, fv reflect.Value) error {
+	for _, bound := range []string{"min", "max"} {
+		tag, ok := field.Tag.Lookup(bound)
+		if !ok {
+			continue
+		}
+		limit := reflect.New(fv.Type()).Elem()
+		if err := setFromString(limit, tag); err != nil {
+			return fmt.Errorf("%s: invalid %s %q: %v", path, bound, tag, err)
+		}
+		var cmp int
+		switch {
+		case fv.Kind() >= reflect.Int && fv.Kind() <= reflect.Int64:
+			cmp = compare(float64(fv.Int()), float64(limit.Int()))
+		case fv.Kind() >= reflect.Uint && fv.Kind() <= reflect.Uint64:
+			cmp = compare(float64(fv.Uint()), float64(limit.Uint()))
+		case fv.Kind() == reflect.Float32 || fv.Kind() == reflect.Float64:
+			cmp = compare(fv.Float(), limit.Float())
+		default:
+			return fmt.Errorf("%s: %s is not supported for %s", path, bound, fv.Type())
+		}
+		if bound == "min" && cmp < 0 {
+			return fmt.Errorf("%s must be at least %s, got %v", path, tag, fv.Interface())
+		}
+		if bound == "max" && cmp > 0 {
+			return fmt.Errorf("%s must be at most %s, got %v", path, tag, fv.Interface())
+		}
+	}
+	return nil
+}
+
+func compare(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// Binding holds a struct that is bound to the configuration, and re-bound every time the configuration is reloaded.
+type Binding struct {
+	prefix   string
+	newValue func() interface{}
+	value    atomic.Value
+
+	mu          sync.Mutex
+	subscribers []func(v interface{})
+}
+
+// BindWatch binds a new struct created by newValue (which must return a pointer to a struct) and keeps it up to date.
+// On every reload, a fresh struct is bound to the new configuration. If binding fails the reload is rejected, in the
+// same way as a failing validator. Once the reload has been accepted, the new struct replaces the old one atomically
+// and is passed to each subscriber.
+// Bound structs are shared between goroutines and must be treated as read-only.
+func (c *Config) BindWatch(prefix string, newValue func() interface{}) (*Binding, error) {
+	b := &Binding{prefix: prefix, newValue: newValue}
+	v := newValue()
+	if err := c.Bind(prefix, v); err != nil {
+		return nil, err
+	}
+	b.value.Store(v)
+	c.Lock()
+	c.bindings = append(c.bindings, b)
+	c.Unlock()
+	return b, nil
+}
+
+// Get returns the most recently bound struct.
+func (b *Binding) Get() interface{} {
+	return b.value.Load()
+}
+
+// Subscribe adds a function that is called with the newly bound struct after each accepted reload.
+func (b *Binding) Subscribe(f func(v interface{})) {
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, f)
+	b.mu.Unlock()
+}
+
+func (b *Binding) publish(v interface{}) {
+	b.value.Store(v)
+	b.mu.Lock()
+	subscribers := append([]func(interface{}){}, b.subscribers...)
+	b.mu.Unlock()
+	for _, f := range subscribers {
+		f(v)
+	}
+}
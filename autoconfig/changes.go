@@ -0,0 +1,158 @@
+package autoconfig
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// ChangeFunc is called after a reload has been accepted. changed contains the dotted path of every value below the
+// subscribed prefix that was added, removed or modified, in sorted order.
+type ChangeFunc func(old, new *Config, changed []string)
+
+type subscription struct {
+	prefix string
+	f      ChangeFunc
+}
+
+// OnChange adds a function that is called whenever a reload changes any value at or below prefix. An empty prefix
+// matches every value.
+//
+// Functions are called in the order they were added, from the goroutine that reloaded the configuration, once the
+// new configuration is visible through Get. They should rebuild whatever state depends on the changed values and
+// return quickly. Both configurations must be treated as read-only.
+func (c *Config) OnChange(prefix string, f ChangeFunc) {
+	c.Lock()
+	c.subscriptions = append(c.subscriptions, subscription{prefix, f})
+	c.Unlock()
+}
+
+// Diff returns the dotted path of every value at or below prefix that differs between two configurations.
+func Diff(old, new *Config, prefix string) []string {
+	oldValues := old.leaves(prefix)
+	newValues := new.leaves(prefix)
+	var changed []string
+	for p, v := range newValues {
+		if ov, ok := oldValues[p]; !ok || !reflect.DeepEqual(ov, v) {
+			changed = append(changed, p)
+		}
+	}
+	for p := range oldValues {
+		if _, ok := newValues[p]; !ok {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// leaves returns every value at or below prefix by dotted path. Lists are treated as a single value.
+func (c *Config) leaves(prefix string) map[string]interface{} {
+	c.RLock()
+	defer c.RUnlock()
+	r := make(map[string]interface{})
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+			for k, child := range m {
+				walk(joinPath(path, k), child)
+			}
+			return
+		}
+		if prefix == "" || path == prefix || strings.HasPrefix(path, prefix+".") {
+			r[path] = v
+		}
+	}
+	walk("", map[string]interface{}(c.mv))
+	return r
+}
+
+// notify calls every subscription affected by a reload.
+func (c *Config) notify(old *Config) {
+	c.RLock()
+	subscriptions := c.subscriptions
+	c.RUnlock()
+	for _, s := range subscriptions {
+		if changed := Diff(old, c, s.prefix); len(changed) > 0 {
+			callSubscriber(s, old, c, changed)
+		}
+	}
+}
+
+func callSubscriber(s subscription, old, new *Config, changed []string) {
+	// A failing subscriber must not stop the watcher or the other subscribers.
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf(context.Background(), "Config change subscriber for %q panicked: %v", s.prefix, r)
+		}
+	}()
+	s.f(old, new, changed)
+}
+
+var (
+	reloads     = stats.Int64("autoconfig/measure/reloads", "Number of configuration reloads", "1")
+	reloadError = stats.Int64("autoconfig/measure/reload_error", "1 if the last configuration reload failed, otherwise 0", "1")
+
+	resultKey, _ = tag.NewKey("autoconfig/keys/result")
+)
+
+// Views contains the views for the configuration reload metrics. These must be registered to be exported.
+var Views = []*view.View{
+	{
+		Name:        "autoconfig/views/reloads",
+		Description: "configuration reloads over time, by result",
+		TagKeys:     []tag.Key{resultKey},
+		Measure:     reloads,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "autoconfig/views/last_reload_error",
+		Description: "whether the last configuration reload failed",
+		Measure:     reloadError,
+		Aggregation: view.LastValue(),
+	},
+}
+
+// reload re-reads the configuration after a change and records the result.
+func (c *Config) reload() error {
+	err := c.read()
+	result, failed := "success", int64(0)
+	if err != nil {
+		result, failed = "failure", 1
+	}
+	atomic.AddInt64(&c.reloads, 1)
+	c.Lock()
+	c.lastError = err
+	if err != nil {
+		c.errors = append(c.errors, ReloadError{Time: time.Now(), Error: err.Error()})
+		if len(c.errors) > maxReloadErrors {
+			c.errors = c.errors[len(c.errors)-maxReloadErrors:]
+		}
+	}
+	c.Unlock()
+	ctx, _ := tag.New(context.Background(), tag.Upsert(resultKey, result))
+	stats.Record(ctx, reloads.M(1), reloadError.M(failed))
+	return err
+}
+
+// Reloads returns the number of times the configuration has been reloaded after the initial load, including reloads
+// that were rejected.
+func (c *Config) Reloads() int64 {
+	return atomic.LoadInt64(&c.reloads)
+}
+
+// LastError returns the error from the most recent reload, or nil if it succeeded.
+func (c *Config) LastError() error {
+	c.RLock()
+	defer c.RUnlock()
+	return c.lastError
+}
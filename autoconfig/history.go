@@ -0,0 +1,213 @@
+package autoconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"github.com/clbanning/mxj"
+)
+
+// DefaultHistorySize is the number of accepted configurations kept for rollback, unless changed with SetHistorySize.
+const DefaultHistorySize = 10
+
+// maxReloadErrors is the number of failed reloads kept for Errors.
+const maxReloadErrors = 10
+
+// Version describes a configuration that was accepted.
+type Version struct {
+	// ID increases by one for every accepted configuration, starting at 1 for the initial load.
+	ID     int       `json:"id"`
+	Loaded time.Time `json:"loaded"`
+	// Hash is the SHA-256 of the merged configuration before secrets are resolved.
+	Hash string `json:"hash"`
+	// Changed lists the paths that differ from the previous version.
+	Changed []string `json:"changed,omitempty"`
+	// RollbackOf is the ID of the version that was restored, if this version was created by Rollback.
+	RollbackOf int `json:"rollback_of,omitempty"`
+
+	config *Config
+}
+
+// ReloadError records a reload that was rejected.
+type ReloadError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+func hashValues(values map[string]interface{}) string {
+	// encoding/json sorts map keys, so the encoding is canonical.
+	b, _ := json.Marshal(values)
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
+
+// SetHistorySize changes the number of accepted configurations that are kept.
+func (c *Config) SetHistorySize(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.historySize = n
+	c.trimHistory()
+}
+
+// trimHistory drops the oldest versions. The caller must hold the lock.
+func (c *Config) trimHistory() {
+	size := c.historySize
+	if size <= 0 {
+		size = DefaultHistorySize
+	}
+	if len(c.history) > size {
+		c.history = append([]*Version(nil), c.history[len(c.history)-size:]...)
+	}
+}
+
+// record adds the current configuration to the history if it differs from old, and logs what changed. It returns
+// false if nothing changed.
+func (c *Config) record(old *Config, hash string, rollbackOf int) bool {
+	var changed []string
+	if old.mv != nil {
+		changed = Diff(old, c, "")
+		if len(changed) == 0 {
+			return false
+		}
+		for _, path := range changed {
+			logger.Infof(context.Background(), "Config %s changed from %s to %s", path, old.displayOrUnset(path), c.displayOrUnset(path))
+		}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	c.nextVersion++
+	c.history = append(c.history, &Version{
+		ID:         c.nextVersion,
+		Loaded:     time.Now(),
+		Hash:       hash,
+		Changed:    changed,
+		RollbackOf: rollbackOf,
+		config:     c.snapshot(),
+	})
+	c.trimHistory()
+	return true
+}
+
+func (c *Config) displayOrUnset(path string) string {
+	if !c.Has(path) {
+		return "(unset)"
+	}
+	return c.Display(path)
+}
+
+// Version returns the active configuration version.
+func (c *Config) Version() Version {
+	c.RLock()
+	defer c.RUnlock()
+	if len(c.history) == 0 {
+		// Configurations passed to validators have no history.
+		return Version{}
+	}
+	return *c.history[len(c.history)-1]
+}
+
+// History returns the accepted configurations that are available for rollback, oldest first.
+func (c *Config) History() []Version {
+	c.RLock()
+	defer c.RUnlock()
+	r := make([]Version, len(c.history))
+	for i, v := range c.history {
+		r[i] = *v
+	}
+	return r
+}
+
+// Errors returns the most recent reloads that were rejected, oldest first.
+func (c *Config) Errors() []ReloadError {
+	c.RLock()
+	defer c.RUnlock()
+	return append([]ReloadError(nil), c.errors...)
+}
+
+// Rollback makes a previous version the active configuration again. The old version goes through the validators
+// again, and is recorded in the history as a new version. Its secret references are resolved again, so that a secret
+// that has been rotated since isn't rolled back with it.
+//
+// A rollback lasts until the next change to any source, at which point the sources are read again. The bad source
+// should be fixed before that happens.
+func (c *Config) Rollback(id int) error {
+	c.RLock()
+	var target *Version
+	for _, v := range c.history {
+		if v.ID == id {
+			target = v
+		}
+	}
+	current := 0
+	if len(c.history) > 0 {
+		current = c.history[len(c.history)-1].ID
+	}
+	c.RUnlock()
+
+	if target == nil {
+		return fmt.Errorf("config version %d is not in the history", id)
+	}
+	if id == current {
+		return fmt.Errorf("config version %d is already active", id)
+	}
+	old := target.config
+	values := copyValue(old.raw).(map[string]interface{})
+	ctx, cancel := context.WithTimeout(context.Background(), secretTimeout)
+	defer cancel()
+	secrets, secretFiles, err := resolveSecrets(ctx, values)
+	if err != nil {
+		return fmt.Errorf("couldn't resolve secrets of config version %d: %v", id, err)
+	}
+	newConfig := &Config{
+		sources:     c.sources,
+		mv:          mxj.Map(values),
+		origins:     old.origins,
+		raw:         old.raw,
+		secrets:     secrets,
+		secretFiles: secretFiles,
+	}
+	if err := c.apply(newConfig, target.Hash, id); err != nil {
+		return err
+	}
+	logger.Infof(context.Background(), "Rolled back config to version %d", id)
+	return nil
+}
+
+// redacted returns a copy of the configuration values with every secret, and every value with a name that looks like
+// a secret, replaced by Redacted.
+func (c *Config) redacted() map[string]interface{} {
+	c.RLock()
+	defer c.RUnlock()
+	values := copyValue(map[string]interface{}(c.mv)).(map[string]interface{})
+	for path := range c.secrets {
+		setPath(values, path, Redacted)
+	}
+	for _, path := range namedSecrets(values, "") {
+		setPath(values, path, Redacted)
+	}
+	return values
+}
+
+// DebugHandler returns a handler that shows the active configuration with secrets redacted, where each value came
+// from, the active version, the history and recent reload errors.
+func (c *Config) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(map[string]interface{}{
+			"version": c.Version(),
+			"config":  c.redacted(),
+			"origins": c.Origins(),
+			"history": c.History(),
+			"reloads": c.Reloads(),
+			"errors":  c.Errors(),
+		})
+	})
+}
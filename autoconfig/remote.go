@@ -0,0 +1,203 @@
+package autoconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// remoteTimeout limits the time taken to fetch a remote source.
+const remoteTimeout = 30 * time.Second
+
+// HTTPSource reads a JSON configuration from an HTTP endpoint. It implements Poller, and uses the ETag returned by the
+// server to avoid downloading the configuration again when it hasn't changed. If a fetched configuration is rejected,
+// the source goes back to the configuration last accepted and forgets the ETag, so that the next poll fetches it again.
+type HTTPSource struct {
+	URL string
+	// Client is used to make requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+	// Interval is the time between polls, 30 seconds if unset.
+	Interval time.Duration
+
+	mu     sync.Mutex
+	etag   string
+	values map[string]interface{}
+	// last is the configuration last accepted by a reload.
+	last map[string]interface{}
+}
+
+// HTTP returns a source that reads a JSON configuration from url.
+func HTTP(url string) *HTTPSource {
+	return &HTTPSource{URL: url}
+}
+
+func (h *HTTPSource) Name() string {
+	return h.URL
+}
+
+// Values returns the configuration from the most recent poll, fetching it if it hasn't been fetched yet.
+func (h *HTTPSource) Values(base map[string]interface{}) (map[string]interface{}, error) {
+	h.mu.Lock()
+	values := h.values
+	h.mu.Unlock()
+	if values != nil {
+		return values, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+	if _, err := h.Poll(ctx); err != nil {
+		return nil, err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.values, nil
+}
+
+func (h *HTTPSource) Poll(ctx context.Context) (bool, error) {
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest("GET", h.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	h.mu.Lock()
+	if h.etag != "" && h.values != nil {
+		req.Header.Set("If-None-Match", h.etag)
+	}
+	h.mu.Unlock()
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, fmt.Errorf("couldn't fetch config from %q: %v", h.URL, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, fmt.Errorf("couldn't fetch config from %q: %v", h.URL, err)
+	}
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("couldn't fetch config from %q: %s", h.URL, resp.Status)
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(body, &values); err != nil {
+		return false, fmt.Errorf("couldn't parse config from %q: %v", h.URL, err)
+	}
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.etag = resp.Header.Get("ETag")
+	h.values = values
+	return true, nil
+}
+
+func (h *HTTPSource) accepted() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = h.values
+}
+
+func (h *HTTPSource) rejected() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.etag = ""
+	h.values = h.last
+}
+
+func (h *HTTPSource) PollInterval() time.Duration {
+	if h.Interval == 0 {
+		return 30 * time.Second
+	}
+	return h.Interval
+}
+
+// DirectorySource reads one configuration value from each file in a directory, in the same way as a Kubernetes
+// ConfigMap mounted as a volume. Each file name is the dotted path of a value, and the contents (without a trailing
+// newline) are parsed in the same way as Env. Directories and files starting with "." are ignored.
+//
+// The directory is read through Fs, and is polled for changes rather than watched.
+type DirectorySource struct {
+	Dir string
+	// Interval is the time between polls, 10 seconds if unset.
+	Interval time.Duration
+
+	mu          sync.Mutex
+	fingerprint string
+}
+
+// Directory returns a source that reads a value from each file in dir.
+func Directory(dir string) *DirectorySource {
+	return &DirectorySource{Dir: dir}
+}
+
+func (d *DirectorySource) Name() string {
+	return d.Dir
+}
+
+func (d *DirectorySource) Values(base map[string]interface{}) (map[string]interface{}, error) {
+	values, fingerprint, err := d.read()
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.fingerprint = fingerprint
+	d.mu.Unlock()
+	return values, nil
+}
+
+func (d *DirectorySource) Poll(ctx context.Context) (bool, error) {
+	_, fingerprint, err := d.read()
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return fingerprint != d.fingerprint, nil
+}
+
+func (d *DirectorySource) PollInterval() time.Duration {
+	if d.Interval == 0 {
+		return 10 * time.Second
+	}
+	return d.Interval
+}
+
+// read returns the values in the directory, and a hash of the names and contents of every file.
+func (d *DirectorySource) read() (map[string]interface{}, string, error) {
+	infos, err := afero.ReadDir(Fs, d.Dir)
+	if err != nil {
+		return nil, "", fmt.Errorf("couldn't read config directory %q: %v", d.Dir, err)
+	}
+	values := make(map[string]interface{})
+	hash := sha256.New()
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || strings.HasPrefix(name, ".") {
+			continue
+		}
+		body, err := afero.ReadFile(Fs, filepath.Join(d.Dir, name))
+		if err != nil {
+			return nil, "", fmt.Errorf("couldn't read config file %q: %v", name, err)
+		}
+		fmt.Fprintf(hash, "%q=%q\n", name, body)
+		setPath(values, name, parseValue(strings.TrimRight(string(body), "\r\n")))
+	}
+	return values, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
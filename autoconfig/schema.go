@@ -0,0 +1,256 @@
+package autoconfig
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Schema validates a configuration against a JSON Schema.
+//
+// Only the subset of JSON Schema needed for configuration files is supported: type, properties, required,
+// additionalProperties, items, enum, pattern, minLength, maxLength, minimum, maximum and minItems. The format
+// "duration" checks that a string can be parsed by time.ParseDuration. Other keywords are ignored.
+type Schema struct {
+	Type                 schemaType         `json:"type"`
+	Properties           map[string]*Schema `json:"properties"`
+	Required             []string           `json:"required"`
+	AdditionalProperties *Schema            `json:"-"`
+	NoAdditional         bool               `json:"-"`
+	Items                *Schema            `json:"items"`
+	Enum                 []interface{}      `json:"enum"`
+	Pattern              string             `json:"pattern"`
+	Format               string             `json:"format"`
+	MinLength            *int               `json:"minLength"`
+	MaxLength            *int               `json:"maxLength"`
+	Minimum              *float64           `json:"minimum"`
+	Maximum              *float64           `json:"maximum"`
+	MinItems             *int               `json:"minItems"`
+
+	pattern *regexp.Regexp
+}
+
+// schemaType is either a single type name or a list of them.
+type schemaType []string
+
+func (t *schemaType) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*t = []string{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return fmt.Errorf("type must be a string or a list of strings")
+	}
+	*t = l
+	return nil
+}
+
+// ParseSchema parses a JSON Schema document.
+func ParseSchema(body []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(body, &s); err != nil {
+		return nil, fmt.Errorf("couldn't parse config schema: %v", err)
+	}
+	return &s, nil
+}
+
+func (s *Schema) UnmarshalJSON(b []byte) error {
+	// Decode into a type without this method to avoid recursion.
+	type schema Schema
+	var raw struct {
+		schema
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*s = Schema(raw.schema)
+	if len(raw.AdditionalProperties) > 0 {
+		var allowed bool
+		if err := json.Unmarshal(raw.AdditionalProperties, &allowed); err == nil {
+			s.NoAdditional = !allowed
+		} else {
+			s.AdditionalProperties = &Schema{}
+			if err := json.Unmarshal(raw.AdditionalProperties, s.AdditionalProperties); err != nil {
+				return err
+			}
+		}
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+	return nil
+}
+
+// Validate checks a configuration against the schema. A ValidationError listing every problem by path is returned if
+// the configuration is not valid. Secret values are never included in the errors.
+func (s *Schema) Validate(c *Config) error {
+	c.RLock()
+	values := map[string]interface{}(c.mv)
+	c.RUnlock()
+	verr := &ValidationError{}
+	s.validate(c, "", values, verr)
+	if len(verr.Problems) > 0 {
+		return verr
+	}
+	return nil
+}
+
+// Validator returns a function that can be passed to AddValidator to reject any reload that doesn't match the schema.
+func (s *Schema) Validator() func(old, new *Config) error {
+	return func(old, new *Config) error {
+		return s.Validate(new)
+	}
+}
+
+// LoadWithSchema is the same as Load, but validates the configuration against schema. Both the initial load and every
+// reload are validated, before any other validator is called.
+func LoadWithSchema(ctx context.Context, schema *Schema, sources ...Source) (*Config, error) {
+	return load(ctx, []func(old, new *Config) error{schema.Validator()}, sources, false)
+}
+
+// CheckWithSchema loads the configuration like LoadWithSchema, but leaves secret references unresolved, so that a
+// configuration can be checked where its secrets aren't available, such as in CI. The references are checked as the
+// strings they are. The configuration returned should only be used for checking.
+func CheckWithSchema(ctx context.Context, schema *Schema, sources ...Source) (*Config, error) {
+	return load(ctx, []func(old, new *Config) error{schema.Validator()}, sources, true)
+}
+
+func (s *Schema) validate(c *Config, path string, v interface{}, verr *ValidationError) {
+	problem := func(format string, args ...interface{}) {
+		name := path
+		if name == "" {
+			name = "(root)"
+		}
+		verr.Problems = append(verr.Problems, name+": "+fmt.Sprintf(format, args...))
+	}
+
+	if len(s.Type) > 0 && !s.hasType(v) {
+		problem("expected %s, got %s", strings.Join(s.Type, " or "), jsonType(v))
+		return
+	}
+	if len(s.Enum) > 0 {
+		found := false
+		for _, e := range s.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) && jsonType(e) == jsonType(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			var allowed []string
+			for _, e := range s.Enum {
+				allowed = append(allowed, fmt.Sprintf("%v", e))
+			}
+			problem("%s is not one of %s", s.display(c, path, v), strings.Join(allowed, ", "))
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, ok := t[key]; !ok {
+				problem("missing required key %q", key)
+			}
+		}
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := joinPath(path, k)
+			if ps, ok := s.Properties[k]; ok {
+				ps.validate(c, child, t[k], verr)
+			} else if s.AdditionalProperties != nil {
+				s.AdditionalProperties.validate(c, child, t[k], verr)
+			} else if s.NoAdditional {
+				verr.Problems = append(verr.Problems, child+": unknown key")
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(t) < *s.MinItems {
+			problem("must contain at least %d items", *s.MinItems)
+		}
+		if s.Items != nil {
+			for i, item := range t {
+				s.Items.validate(c, fmt.Sprintf("%s[%d]", path, i), item, verr)
+			}
+		}
+	case string:
+		if s.MinLength != nil && len(t) < *s.MinLength {
+			problem("must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(t) > *s.MaxLength {
+			problem("must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(t) {
+			problem("%s does not match %s", s.display(c, path, t), s.Pattern)
+		}
+		if s.Format == "duration" {
+			if _, err := time.ParseDuration(t); err != nil {
+				problem("%s is not a duration", s.display(c, path, t))
+			}
+		}
+	case float64:
+		if s.Minimum != nil && t < *s.Minimum {
+			problem("must be at least %v, got %v", *s.Minimum, t)
+		}
+		if s.Maximum != nil && t > *s.Maximum {
+			problem("must be at most %v, got %v", *s.Maximum, t)
+		}
+	}
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	actual := jsonType(v)
+	for _, t := range s.Type {
+		if t == actual {
+			return true
+		}
+		if t == "integer" && actual == "number" && v.(float64) == float64(int64(v.(float64))) {
+			return true
+		}
+	}
+	return false
+}
+
+// display formats a value for an error message, unless path contains a secret.
+func (s *Schema) display(c *Config, path string, v interface{}) string {
+	// Secrets in lists are recorded against the path of the list.
+	if i := strings.Index(path, "["); i >= 0 {
+		path = path[:i]
+	}
+	if c.IsSecret(path) {
+		return Redacted
+	}
+	return fmt.Sprintf("%q", fmt.Sprint(v))
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
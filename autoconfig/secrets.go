@@ -0,0 +1,253 @@
+package autoconfig
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// SecretPrefix marks a string config value as a reference to a secret, in the form secret://<resolver>/<reference>.
+//
+//	secret://file/etc/secrets/auth0   The contents of /etc/secrets/auth0, without a trailing newline.
+//	secret://env/AUTH0_SECRET         The value of the AUTH0_SECRET environment variable.
+//
+// Other resolvers can be added with RegisterSecretResolver. References are resolved every time the configuration is
+// loaded, and a reload is rejected if any of them can't be resolved. Secret files are watched along with the config
+// files, so rotating a secret reloads the configuration.
+const SecretPrefix = "secret://"
+
+// Redacted is shown in place of secret values.
+const Redacted = "[REDACTED]"
+
+// secretNames are parts of key names that mark a value as secret even when it is written in plain text rather than
+// as a secret reference.
+var secretNames = []string{"secret", "password", "hmac_key"}
+
+// secretTimeout limits the time taken to resolve all the secrets in a configuration.
+const secretTimeout = 30 * time.Second
+
+// SecretResolver looks up the value of a secret.
+type SecretResolver interface {
+	// Resolve returns the secret identified by ref, which is the part of the reference after the resolver name.
+	Resolve(ctx context.Context, ref string) (string, error)
+}
+
+// SecretResolverFunc adapts a function to a SecretResolver.
+type SecretResolverFunc func(ctx context.Context, ref string) (string, error)
+
+func (f SecretResolverFunc) Resolve(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]SecretResolver{
+		"file": SecretResolverFunc(resolveFile),
+		"env":  SecretResolverFunc(resolveEnv),
+	}
+)
+
+// RegisterSecretResolver makes a resolver available to configuration values starting with secret://<name>/.
+// Resolvers must be registered before the configuration is loaded.
+func RegisterSecretResolver(name string, r SecretResolver) {
+	resolversMu.Lock()
+	resolvers[name] = r
+	resolversMu.Unlock()
+}
+
+func resolveFile(ctx context.Context, ref string) (string, error) {
+	body, err := afero.ReadFile(Fs, "/"+ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
+
+// lookupEnv is replaced in tests.
+var lookupEnv = os.LookupEnv
+
+func resolveEnv(ctx context.Context, ref string) (string, error) {
+	v, ok := lookupEnv(ref)
+	if !ok {
+		return "", fmt.Errorf("environment variable %q is not set", ref)
+	}
+	return v, nil
+}
+
+// HTTPSecretResolver fetches secrets from an HTTP secret store with an API in the style of Google Cloud Secret
+// Manager. A reference is appended to BaseURL, so with a BaseURL of
+// https://secretmanager.googleapis.com/v1/projects/my-project/secrets the reference
+// secret://gcp/auth0/versions/latest is fetched from .../secrets/auth0/versions/latest:access.
+//
+// The response must be a JSON object containing the base64 encoded secret in payload.data.
+type HTTPSecretResolver struct {
+	BaseURL string
+	// Client is used to make requests, and is responsible for authentication. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+func (r *HTTPSecretResolver) Resolve(ctx context.Context, ref string) (string, error) {
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	parts := strings.Split(ref, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	req, err := http.NewRequest("GET", strings.TrimRight(r.BaseURL, "/")+"/"+strings.Join(parts, "/")+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("secret store returned %s", resp.Status)
+	}
+	var response struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &response); err != nil {
+		return "", fmt.Errorf("invalid response from secret store: %v", err)
+	}
+	value, err := base64.StdEncoding.DecodeString(response.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("invalid secret payload: %v", err)
+	}
+	return string(value), nil
+}
+
+// resolveSecrets replaces every secret reference in values with the secret value. It returns the paths that contained
+// secrets, and the files that were read.
+func resolveSecrets(ctx context.Context, values map[string]interface{}) (map[string]bool, []string, error) {
+	paths := make(map[string]bool)
+	var files []string
+	var resolve func(v interface{}, path string) (interface{}, error)
+	resolve = func(v interface{}, path string) (interface{}, error) {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			for k, child := range t {
+				r, err := resolve(child, joinPath(path, k))
+				if err != nil {
+					return nil, err
+				}
+				t[k] = r
+			}
+		case []interface{}:
+			for i, child := range t {
+				r, err := resolve(child, path)
+				if err != nil {
+					return nil, err
+				}
+				t[i] = r
+			}
+		case string:
+			if !strings.HasPrefix(t, SecretPrefix) {
+				return t, nil
+			}
+			ref := t[len(SecretPrefix):]
+			i := strings.Index(ref, "/")
+			if i <= 0 {
+				return nil, fmt.Errorf("config %q: invalid secret reference %q", path, t)
+			}
+			resolversMu.RLock()
+			r, ok := resolvers[ref[:i]]
+			resolversMu.RUnlock()
+			if !ok {
+				return nil, fmt.Errorf("config %q: unknown secret resolver %q", path, ref[:i])
+			}
+			if ref[:i] == "file" {
+				files = append(files, "/"+ref[i+1:])
+			}
+			s, err := r.Resolve(ctx, ref[i+1:])
+			if err != nil {
+				return nil, fmt.Errorf("config %q: couldn't resolve %s: %v", path, t, err)
+			}
+			paths[path] = true
+			return s, nil
+		}
+		return v, nil
+	}
+	if _, err := resolve(values, ""); err != nil {
+		return nil, nil, err
+	}
+	return paths, files, nil
+}
+
+// IsSecret returns true if the value at path, or any value inside it, was resolved from a secret reference or has a
+// key name that looks like a secret, such as "client_secret" or "password".
+// Secret values must not be logged; use Display to show configuration values.
+func (c *Config) IsSecret(path string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	for p := range c.secrets {
+		if p == path || strings.HasPrefix(p, path+".") || path == "" {
+			return true
+		}
+	}
+	for _, p := range namedSecrets(map[string]interface{}(c.mv), "") {
+		if p == path || strings.HasPrefix(p, path+".") || strings.HasPrefix(path, p+".") || path == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// namedSecrets returns the dotted path of every value below prefix whose key name looks like a secret.
+func namedSecrets(values map[string]interface{}, prefix string) []string {
+	var paths []string
+	for k, v := range values {
+		path := joinPath(prefix, k)
+		if isSecretName(k) {
+			paths = append(paths, path)
+		} else if m, ok := v.(map[string]interface{}); ok {
+			paths = append(paths, namedSecrets(m, path)...)
+		}
+	}
+	return paths
+}
+
+func isSecretName(key string) bool {
+	key = strings.ToLower(key)
+	for _, name := range secretNames {
+		if strings.Contains(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Display returns the value at path in a form that is safe to log, with secrets redacted.
+func (c *Config) Display(path string) string {
+	if c.IsSecret(path) {
+		return Redacted
+	}
+	return strings.Join(c.GetAll(path), ", ")
+}
+
+// quote formats a value from path for an error message, unless it is a secret.
+func (c *Config) quote(path, s string) string {
+	if c.IsSecret(path) {
+		return Redacted
+	}
+	return fmt.Sprintf("%q", s)
+}
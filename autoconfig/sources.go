@@ -0,0 +1,274 @@
+package autoconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// Source is a single layer of configuration. Sources are passed to Load in order of increasing priority, and each
+// layer is deep merged over the layers below it: objects are merged key by key, and any other value (including a list)
+// replaces the value below it.
+type Source interface {
+	// Name identifies the source in error messages and in Origin.
+	Name() string
+	// Values returns the values provided by this layer. base contains the merged values of every lower layer and
+	// must not be modified.
+	Values(base map[string]interface{}) (map[string]interface{}, error)
+}
+
+// watchedSource is implemented by sources backed by files that should be watched for changes.
+type watchedSource interface {
+	files() []string
+}
+
+// rejectableSource is implemented by sources that need to know whether the values they last returned were accepted,
+// such as a remote source that would otherwise keep returning a rejected configuration.
+type rejectableSource interface {
+	accepted()
+	rejected()
+}
+
+type fileSource string
+
+// File returns a source that reads a JSON configuration file. The file must exist.
+func File(filename string) Source {
+	return fileSource(filename)
+}
+
+func (f fileSource) Name() string {
+	return string(f)
+}
+
+func (f fileSource) Values(base map[string]interface{}) (map[string]interface{}, error) {
+	body, err := afero.ReadFile(Fs, string(f))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read config file %q: %v", string(f), err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file %q: %v", string(f), err)
+	}
+	return m, nil
+}
+
+func (f fileSource) files() []string {
+	return []string{string(f)}
+}
+
+// environ is replaced in tests.
+var environ = os.Environ
+
+type envSource string
+
+// Env returns a source that reads configuration from environment variables starting with prefix.
+//
+// The rest of the variable name is matched against the keys already present in lower layers, ignoring case and
+// treating any punctuation as an underscore, so WAS_SPANNER_INSTANCE sets spanner.instance and
+// WAS_ENCRYPTION_KEY_CACHE_TTL sets encryption.key_cache.ttl. Names that don't match an existing key are split on every
+// underscore.
+//
+// Values that are valid JSON (numbers, booleans, lists and objects) are decoded, anything else is used as a string.
+func Env(prefix string) Source {
+	return envSource(prefix)
+}
+
+func (e envSource) Name() string {
+	return "env:" + string(e)
+}
+
+func (e envSource) Values(base map[string]interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for _, kv := range environ() {
+		i := strings.Index(kv, "=")
+		if i < 0 || !strings.HasPrefix(kv[:i], string(e)) || i == len(e) {
+			continue
+		}
+		path := envPath(base, strings.ToUpper(kv[len(e):i]))
+		setPath(m, path, parseValue(kv[i+1:]))
+	}
+	return m, nil
+}
+
+// envPath finds the config path for an environment variable name, with the prefix removed.
+func envPath(m map[string]interface{}, name string) string {
+	// Try the longest matching key first, so that KEY_CACHE is preferred over KEY.
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return len(keys[i]) > len(keys[j]) })
+	for _, k := range keys {
+		norm := envName(k)
+		if name == norm {
+			return k
+		}
+		if child, ok := m[k].(map[string]interface{}); ok && strings.HasPrefix(name, norm+"_") {
+			return k + "." + envPath(child, name[len(norm)+1:])
+		}
+	}
+	return strings.ToLower(strings.Replace(name, "_", ".", -1))
+}
+
+// envName converts a config key to the form used in environment variable names.
+func envName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+type setSource []string
+
+// Set returns a source containing key=value pairs, such as those passed to a --set flag. Keys are in dotted path
+// notation, and values are parsed in the same way as Env.
+func Set(pairs []string) (Source, error) {
+	for _, kv := range pairs {
+		if i := strings.Index(kv, "="); i <= 0 {
+			return nil, fmt.Errorf("invalid config override %q, expected key=value", kv)
+		}
+	}
+	return setSource(pairs), nil
+}
+
+func (s setSource) Name() string {
+	return "flags"
+}
+
+func (s setSource) Values(base map[string]interface{}) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for _, kv := range s {
+		i := strings.Index(kv, "=")
+		setPath(m, kv[:i], parseValue(kv[i+1:]))
+	}
+	return m, nil
+}
+
+// parseValue decodes a value given as a string on the command line or in the environment.
+func parseValue(s string) interface{} {
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil || v == nil {
+		return s
+	}
+	return v
+}
+
+// setPath sets a value in a nested map, creating intermediate objects as required.
+func setPath(m map[string]interface{}, path string, v interface{}) {
+	parts := strings.Split(path, ".")
+	for _, p := range parts[:len(parts)-1] {
+		child, ok := m[p].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			m[p] = child
+		}
+		m = child
+	}
+	m[parts[len(parts)-1]] = v
+}
+
+// merge deep merges src into dst, recording the source of every leaf value in origins.
+func merge(dst, src map[string]interface{}, prefix, name string, origins map[string]string) {
+	for k, v := range src {
+		path := joinPath(prefix, k)
+		if sm, ok := v.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				merge(dm, sm, path, name, origins)
+				continue
+			}
+		}
+		// The value is being replaced, so forget where anything below it came from.
+		for p := range origins {
+			if p == path || strings.HasPrefix(p, path+".") {
+				delete(origins, p)
+			}
+		}
+		dst[k] = copyValue(v)
+		recordOrigins(v, path, name, origins)
+	}
+}
+
+func recordOrigins(v interface{}, path, name string, origins map[string]string) {
+	if m, ok := v.(map[string]interface{}); ok && len(m) > 0 {
+		for k, child := range m {
+			recordOrigins(child, path+"."+k, name, origins)
+		}
+		return
+	}
+	origins[path] = name
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, child := range t {
+			m[k] = copyValue(child)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, child := range t {
+			l[i] = copyValue(child)
+		}
+		return l
+	}
+	return v
+}
+
+// loadSources merges every source in order.
+func loadSources(sources []Source) (map[string]interface{}, map[string]string, error) {
+	values := make(map[string]interface{})
+	origins := make(map[string]string)
+	for _, s := range sources {
+		m, err := s.Values(values)
+		if err != nil {
+			return nil, nil, err
+		}
+		merge(values, m, "", s.Name(), origins)
+	}
+	return values, origins, nil
+}
+
+// Origin returns the name of the source that provided the effective value at path, or an empty string if the path is
+// not set. For an object, the source of the highest priority value inside it is returned.
+func (c *Config) Origin(path string) string {
+	c.RLock()
+	defer c.RUnlock()
+	if name, ok := c.origins[path]; ok {
+		return name
+	}
+	best := -1
+	var name string
+	for p, n := range c.origins {
+		if !strings.HasPrefix(p, path+".") {
+			continue
+		}
+		for i, s := range c.sources {
+			if s.Name() == n && i > best {
+				best, name = i, n
+			}
+		}
+	}
+	return name
+}
+
+// Origins returns the source of every effective leaf value, keyed by dotted path.
+func (c *Config) Origins() map[string]string {
+	c.RLock()
+	defer c.RUnlock()
+	r := make(map[string]string, len(c.origins))
+	for p, n := range c.origins {
+		r[p] = n
+	}
+	return r
+}
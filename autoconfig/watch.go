@@ -0,0 +1,172 @@
+package autoconfig
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Poller is implemented by sources that can't be watched for file events, such as remote sources. Watch calls Poll
+// every PollInterval, and reloads the configuration when it reports a change.
+type Poller interface {
+	// Poll fetches the latest version of the source and returns true if it differs from the version last returned by
+	// Values.
+	Poll(ctx context.Context) (bool, error)
+	PollInterval() time.Duration
+}
+
+// Watch reloads the configuration whenever any of the files it was loaded from changes, and polls every source that
+// implements Poller.
+//
+// Files are watched through their parent directories rather than directly, so that a file which is replaced by a
+// rename or a symlink swap is still noticed. This is how Kubernetes updates a mounted ConfigMap or Secret: each file is
+// a symlink through a ..data symlink, and ..data is atomically replaced.
+func (c *Config) Watch(ctx context.Context) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("couldn't create config watcher: %v", err)
+	}
+	w := &fileWatcher{watcher: watcher, dirs: make(map[string]bool)}
+	if err := w.update(c.files()); err != nil {
+		watcher.Close()
+		return fmt.Errorf("couldn't create config watcher: %v", err)
+	}
+
+	changes := make(chan string, 1)
+	for _, s := range c.sources {
+		if p, ok := s.(Poller); ok {
+			go poll(ctx, s.Name(), p, changes)
+		}
+	}
+	go c.background(ctx, w, changes)
+	return nil
+}
+
+// fileWatcher tracks the directories being watched, and where each watched file currently resolves to.
+type fileWatcher struct {
+	watcher *fsnotify.Watcher
+	dirs    map[string]bool
+	targets map[string]string // Cleaned file name -> resolved path, empty if the file doesn't exist.
+}
+
+// update watches the directories containing files, and stops watching directories that are no longer needed.
+func (w *fileWatcher) update(files []string) error {
+	targets := make(map[string]string, len(files))
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		f = filepath.Clean(f)
+		targets[f] = resolve(f)
+		dirs[filepath.Dir(f)] = true
+	}
+	for dir := range dirs {
+		if !w.dirs[dir] {
+			if err := w.watcher.Add(dir); err != nil {
+				return err
+			}
+		}
+	}
+	for dir := range w.dirs {
+		if !dirs[dir] {
+			w.watcher.Remove(dir)
+		}
+	}
+	w.dirs = dirs
+	w.targets = targets
+	return nil
+}
+
+// changed returns true if an event in a watched directory affects any watched file. Other files in the same
+// directories are ignored.
+func (w *fileWatcher) changed(event fsnotify.Event) bool {
+	name := filepath.Clean(event.Name)
+	changed := false
+	for f, target := range w.targets {
+		if f == name {
+			changed = true
+		}
+		// An event on anything else in the directory, such as ..data, may have changed where a symlink points.
+		if t := resolve(f); t != target {
+			w.targets[f] = t
+			changed = true
+		}
+	}
+	return changed
+}
+
+// resolve returns the path that a file refers to after following symlinks, or an empty string if it doesn't exist.
+func resolve(f string) string {
+	t, err := filepath.EvalSymlinks(f)
+	if err != nil {
+		return ""
+	}
+	return t
+}
+
+func poll(ctx context.Context, name string, p Poller, changes chan<- string) {
+	t := time.NewTicker(p.PollInterval())
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		changed, err := p.Poll(ctx)
+		if err != nil {
+			logger.Errorf(ctx, "Error polling config source %q: %v", name, err)
+			continue
+		}
+		if changed {
+			select {
+			case changes <- name:
+			default:
+				// A reload is already pending.
+			}
+		}
+	}
+}
+
+func (c *Config) background(ctx context.Context, w *fileWatcher, changes <-chan string) {
+	defer w.watcher.Close()
+	t := make(<-chan time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop watching when the context is cancelled.
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				logger.Warningf(ctx, "Watcher ended for %q", c.files())
+				return
+			}
+			if !w.changed(event) {
+				continue
+			}
+			// Create a timer to re-read the config one second after noticing an event. This prevents the config being
+			// read multiple times for a single file change.
+			t = time.After(1 * time.Second)
+		case err, ok := <-w.watcher.Errors:
+			if ok {
+				logger.Errorf(ctx, "Error watching config files: %v", err)
+			}
+		case name := <-changes:
+			logger.Infof(ctx, "Config source %q changed", name)
+			t = time.After(1 * time.Second)
+		case <-t:
+			if err := c.reload(); err != nil {
+				logger.Errorf(ctx, "Error re-reading config file, keeping existing config: %v", err)
+			} else {
+				logger.Infof(ctx, "Read changed config files %q", c.files())
+			}
+			// Watch any secret files that were added by the new config, and stop watching any that were removed.
+			if err := w.update(c.files()); err != nil {
+				logger.Errorf(ctx, "Error watching config files: %v", err)
+			}
+		}
+	}
+}
@@ -14,8 +14,11 @@ import (
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"text/tabwriter"
 
+	"github.com/dparrish/build-web-application-demo/encryption"
+
 	cli "gopkg.in/urfave/cli.v1"
 )
 
@@ -23,9 +26,38 @@ var (
 	endpoint  string
 	authToken string
 	insecure  bool
+	keyFile   string
+
+	// Key material for client-side encryption.
+	clientKeyFile  string
+	passphraseFile string
 )
 
+// readKeyFile reads a 256-bit customer-supplied encryption key. The file may contain either the raw key or the key
+// encoded as base64.
+func readKeyFile(filename string) (encryption.Key, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %v", err)
+	}
+	if len(body) != 32 {
+		body, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(body)))
+		if err != nil || len(body) != 32 {
+			return nil, fmt.Errorf("key file %q must contain a 256-bit key, either raw or base64 encoded", filename)
+		}
+	}
+	var key [32]byte
+	copy(key[:], body)
+	return &key, nil
+}
+
 func Request(method string, path string, request map[string]string) ([]byte, error) {
+	body, _, err := RequestWithHeader(method, path, request)
+	return body, err
+}
+
+// RequestWithHeader is the same as Request but also returns the response headers.
+func RequestWithHeader(method string, path string, request map[string]string) ([]byte, http.Header, error) {
 	uri, _ := url.Parse(endpoint)
 	rel, _ := url.Parse(path)
 	uri = uri.ResolveReference(rel)
@@ -38,11 +70,18 @@ func Request(method string, path string, request map[string]string) ([]byte, err
 		req, err = http.NewRequest(method, uri.String(), nil)
 	}
 	if err != nil {
-		return nil, fmt.Errorf("creating login request: %v", err)
+		return nil, nil, fmt.Errorf("creating login request: %v", err)
 	}
 	req.Header.Add("Content-Type", "application/json")
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Authorization", "Bearer "+authToken)
+	if keyFile != "" && sendsCustomerKey(method, path) {
+		key, err := readKeyFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		encryption.SetCustomerKey(req.Header, key)
+	}
 
 	tr := &http.Transport{}
 	if insecure {
@@ -52,15 +91,27 @@ func Request(method string, path string, request map[string]string) ([]byte, err
 
 	res, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("sending HTTP request: %v", err)
+		return nil, nil, fmt.Errorf("sending HTTP request: %v", err)
 	}
 	defer res.Body.Close()
 
 	body, _ := ioutil.ReadAll(res.Body)
 	if res.StatusCode != http.StatusOK {
-		return body, errors.New(http.StatusText(res.StatusCode))
+		return body, res.Header, errors.New(http.StatusText(res.StatusCode))
+	}
+	return body, res.Header, nil
+}
+
+// sendsCustomerKey returns true for the requests that use a customer-supplied encryption key, which are uploading and
+// downloading a document. The key isn't sent anywhere else.
+func sendsCustomerKey(method, path string) bool {
+	switch method {
+	case "POST":
+		return path == "/document/"
+	case "GET":
+		return strings.HasPrefix(path, "/document/") && path != "/document/"
 	}
-	return body, nil
+	return false
 }
 
 func POSTJSON(path string, request map[string]string) (map[string]string, error) {
@@ -105,6 +156,7 @@ func cmdList(c *cli.Context) error {
 	var res []struct {
 		Id, Userid, Name, MimeType string
 		Size                       int
+		NameEncrypted              bool `json:"name_encrypted"`
 	}
 	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&res); err != nil {
 		return err
@@ -113,11 +165,19 @@ func cmdList(c *cli.Context) error {
 		fmt.Println("No documents found")
 		return nil
 	}
+	// Encrypted names are shown as-is unless client-side encryption key material is available.
+	key, _ := loadClientKey()
+
 	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
 	fmt.Fprintln(w, "ID\tSize\tName")
 	fmt.Fprintln(w, "------------------------------------\t------\t---------------\t")
 
 	for _, row := range res {
+		if row.NameEncrypted && key != nil {
+			if name, err := key.DecryptName(row.Name); err == nil {
+				row.Name = name
+			}
+		}
 		fmt.Fprintf(w, "%s\t%-d\t%s\t\n", row.Id, row.Size, row.Name)
 	}
 	w.Flush()
@@ -134,11 +194,36 @@ func cmdUpload(c *cli.Context) error {
 		return fmt.Errorf("Error reading file: %v", err)
 	}
 
+	name := c.Args()[c.NArg()-1]
+	clientEncrypted := c.Bool("client_encrypt") || c.Bool("encrypt_name")
+	if clientEncrypted {
+		key, err := loadClientKey()
+		if err != nil {
+			return err
+		}
+		var ciphertext bytes.Buffer
+		if err := key.Encrypt(bytes.NewReader(body), &ciphertext); err != nil {
+			return fmt.Errorf("Error encrypting file: %v", err)
+		}
+		body = ciphertext.Bytes()
+		if c.Bool("encrypt_name") {
+			if name, err = key.EncryptName(name); err != nil {
+				return fmt.Errorf("Error encrypting name: %v", err)
+			}
+		}
+	}
+
 	req := map[string]string{
 		"body":      base64.StdEncoding.EncodeToString(body),
-		"name":      c.Args()[c.NArg()-1],
+		"name":      name,
 		"mime_type": c.String("mime_type"),
 	}
+	if clientEncrypted {
+		req["client_encrypted"] = "true"
+	}
+	if c.Bool("encrypt_name") {
+		req["name_encrypted"] = "true"
+	}
 	res, err := Request("POST", "/document/", req)
 	if err != nil {
 		return fmt.Errorf("Error from server: %v", err)
@@ -147,7 +232,7 @@ func cmdUpload(c *cli.Context) error {
 	if err := json.Unmarshal(res, &r); err != nil {
 		return fmt.Errorf("Error decoding server response: %v", err)
 	}
-	fmt.Printf("Uploaded %q as document %q\n", r["name"], r["id"])
+	fmt.Printf("Uploaded %q as document %q\n", c.Args()[c.NArg()-1], r["id"])
 	return nil
 }
 
@@ -156,10 +241,20 @@ func cmdDownload(c *cli.Context) error {
 		cli.ShowCommandHelpAndExit(c, "download", 1)
 		return nil
 	}
-	body, err := Request("GET", path.Join("/document", c.Args()[0]), nil)
+	body, header, err := RequestWithHeader("GET", path.Join("/document", c.Args()[0]), nil)
 	if err != nil {
 		return fmt.Errorf("Error retrieving %s: %v\n", c.Args()[0], err)
 	}
+	if header.Get("X-Client-Encrypted") == "true" {
+		key, err := loadClientKey()
+		if err != nil {
+			return err
+		}
+		if err := key.Decrypt(bytes.NewReader(body), os.Stdout); err != nil {
+			return fmt.Errorf("Error decrypting %s: %v\n", c.Args()[0], err)
+		}
+		return nil
+	}
 	os.Stdout.Write(body)
 	return nil
 }
@@ -194,6 +289,9 @@ func main() {
 		cli.StringFlag{Name: "token, t", Usage: "Authentication token", Destination: &authToken, EnvVar: "TOKEN"},
 		cli.StringFlag{Name: "url, u", Usage: "Base URL of service", Value: defaultEndpoint, Destination: &endpoint},
 		cli.BoolFlag{Name: "insecure", Usage: "Ignore invalid SSL certificates", Destination: &insecure},
+		cli.StringFlag{Name: "key-file", Usage: "File containing a 256-bit customer-supplied encryption key", Destination: &keyFile},
+		cli.StringFlag{Name: "client-key-file", Usage: "File containing a 256-bit key for client-side encryption", Destination: &clientKeyFile},
+		cli.StringFlag{Name: "passphrase-file", Usage: "File containing a passphrase for client-side encryption", Destination: &passphraseFile},
 	}
 	app.Commands = []cli.Command{
 		{
@@ -215,6 +313,8 @@ func main() {
 			ArgsUsage: "<filename> [name]",
 			Flags: []cli.Flag{
 				cli.StringFlag{Name: "mime_type", Usage: "MIME type of the file (default is autodetected)"},
+				cli.BoolFlag{Name: "client_encrypt", Usage: "Encrypt the file locally before upload"},
+				cli.BoolFlag{Name: "encrypt_name", Usage: "Encrypt the file name locally as well, implies --client_encrypt"},
 			},
 		},
 		{
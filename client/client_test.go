@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendsCustomerKey(t *testing.T) {
+	for _, test := range []struct {
+		method, path string
+		want         bool
+	}{
+		{"POST", "/document/", true},
+		{"GET", "/document/abc", true},
+		{"GET", "/document/", false},
+		{"DELETE", "/document/abc", false},
+		{"POST", "login", false},
+		{"DELETE", "/account", false},
+	} {
+		assert.Equal(t, test.want, sendsCustomerKey(test.method, test.path), "%s %s", test.method, test.path)
+	}
+}
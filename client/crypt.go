@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/dparrish/build-web-application-demo/encryption"
+
+	"github.com/gtank/cryptopasta"
+)
+
+// Client-side encrypted data starts with a short header, followed by the same stream that encryption.Envelope
+// produces on the server. The format is described in encryption.ClientMagic, so that the server can check it.
+const (
+	clientMagic    = encryption.ClientMagic
+	modeKeyFile    = encryption.ClientModeKeyFile
+	modePassphrase = encryption.ClientModePassphrase
+)
+
+// clientKey holds the key material used for client-side encryption. Exactly one of key or passphrase is set.
+//
+// With a passphrase, every name and body has its own random salt, so a key is derived for each one. Key derivation is
+// deliberately slow, which makes listing many encrypted names slow too.
+type clientKey struct {
+	key        encryption.Key
+	passphrase []byte
+}
+
+// loadClientKey finds the key material for client-side encryption from the command line flags or the environment.
+func loadClientKey() (*clientKey, error) {
+	if clientKeyFile != "" {
+		key, err := readKeyFile(clientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &clientKey{key: key}, nil
+	}
+	if passphraseFile != "" {
+		body, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading passphrase file: %v", err)
+		}
+		return newPassphraseKey(strings.TrimRight(string(body), "\r\n"))
+	}
+	if p := os.Getenv("PASSPHRASE"); p != "" {
+		return newPassphraseKey(p)
+	}
+	return nil, errors.New("client-side encryption requires --client-key-file, --passphrase-file or $PASSPHRASE")
+}
+
+func newPassphraseKey(passphrase string) (*clientKey, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	return &clientKey{passphrase: []byte(passphrase)}, nil
+}
+
+// writeHeader writes a new header and returns the key to encrypt the data following it.
+func (k *clientKey) writeHeader(w io.Writer) (encryption.Key, error) {
+	header := []byte(clientMagic)
+	key := k.key
+	if key != nil {
+		header = append(header, modeKeyFile)
+	} else {
+		salt, err := encryption.NewSalt()
+		if err != nil {
+			return nil, err
+		}
+		if key, err = encryption.DeriveKey(k.passphrase, salt); err != nil {
+			return nil, err
+		}
+		header = append(append(header, modePassphrase), salt...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// readHeader reads the header and returns the key to decrypt the data following it.
+func (k *clientKey) readHeader(r io.Reader) (encryption.Key, error) {
+	header := make([]byte, len(clientMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(clientMagic)]) != clientMagic {
+		return nil, errors.New("data is not client-side encrypted")
+	}
+	switch header[len(clientMagic)] {
+	case modeKeyFile:
+		if k.key == nil {
+			return nil, errors.New("data was encrypted with a key file, use --client-key-file")
+		}
+		return k.key, nil
+	case modePassphrase:
+		if k.passphrase == nil {
+			return nil, errors.New("data was encrypted with a passphrase, use --passphrase-file or $PASSPHRASE")
+		}
+		salt := make([]byte, encryption.SaltSize)
+		if _, err := io.ReadFull(r, salt); err != nil {
+			return nil, errors.New("truncated client-side encryption header")
+		}
+		return encryption.DeriveKey(k.passphrase, salt)
+	default:
+		return nil, fmt.Errorf("unknown client-side encryption mode %d", header[len(clientMagic)])
+	}
+}
+
+// Encrypt encrypts data before it is uploaded.
+func (k *clientKey) Encrypt(r io.Reader, w io.Writer) error {
+	key, err := k.writeHeader(w)
+	if err != nil {
+		return err
+	}
+	return (&encryption.Envelope{}).Encrypt(key, r, w)
+}
+
+// Decrypt decrypts data after it has been downloaded. The server isn't trusted, so only the authenticated stream
+// format is accepted.
+func (k *clientKey) Decrypt(r io.Reader, w io.Writer) error {
+	key, err := k.readHeader(r)
+	if err != nil {
+		return err
+	}
+	return (&encryption.Envelope{}).DecryptStream(key, r, w)
+}
+
+// EncryptName encrypts a document name so that it can be stored in place of the real name.
+// Names are short, so they use authenticated encryption rather than the streaming format.
+func (k *clientKey) EncryptName(name string) (string, error) {
+	var buf bytes.Buffer
+	key, err := k.writeHeader(&buf)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := cryptopasta.Encrypt([]byte(name), key)
+	if err != nil {
+		return "", err
+	}
+	buf.Write(ciphertext)
+	return base64.RawURLEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// DecryptName reverses EncryptName.
+func (k *clientKey) DecryptName(name string) (string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(name)
+	if err != nil {
+		return "", errors.New("name is not encrypted")
+	}
+	r := bytes.NewReader(b)
+	key, err := k.readHeader(r)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, _ := ioutil.ReadAll(r)
+	plain, err := cryptopasta.Decrypt(ciphertext, key)
+	if err != nil {
+		return "", fmt.Errorf("error decrypting name: %v", err)
+	}
+	return string(plain), nil
+}
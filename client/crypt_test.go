@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"strings"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/encryption"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientEncryptPassphrase(t *testing.T) {
+	key, err := newPassphraseKey("correct horse battery staple")
+	assert.Nil(t, err)
+
+	var ciphertext bytes.Buffer
+	assert.Nil(t, key.Encrypt(strings.NewReader("hello world"), &ciphertext))
+	assert.True(t, strings.HasPrefix(ciphertext.String(), clientMagic))
+
+	// A fresh key with the same passphrase must be able to decrypt.
+	key, _ = newPassphraseKey("correct horse battery staple")
+	var plain bytes.Buffer
+	assert.Nil(t, key.Decrypt(&ciphertext, &plain))
+	assert.Equal(t, "hello world", plain.String())
+}
+
+func TestClientEncryptKeyFile(t *testing.T) {
+	key := &clientKey{key: (&encryption.Envelope{}).NewKey()}
+
+	var ciphertext bytes.Buffer
+	assert.Nil(t, key.Encrypt(strings.NewReader("hello world"), &ciphertext))
+
+	passphrase, _ := newPassphraseKey("not the key")
+	assert.NotNil(t, passphrase.Decrypt(bytes.NewReader(ciphertext.Bytes()), &bytes.Buffer{}))
+
+	var plain bytes.Buffer
+	assert.Nil(t, key.Decrypt(&ciphertext, &plain))
+	assert.Equal(t, "hello world", plain.String())
+}
+
+func TestClientEncryptName(t *testing.T) {
+	key, _ := newPassphraseKey("passphrase")
+	encrypted, err := key.EncryptName("secret plans.txt")
+	assert.Nil(t, err)
+	assert.NotContains(t, encrypted, "secret")
+
+	name, err := key.DecryptName(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret plans.txt", name)
+
+	other, _ := newPassphraseKey("wrong")
+	_, err = other.DecryptName(encrypted)
+	assert.NotNil(t, err)
+}
+
+func TestClientDecryptRejectsUnauthenticated(t *testing.T) {
+	key := &clientKey{key: (&encryption.Envelope{}).NewKey()}
+	header := clientMagic + string(modeKeyFile)
+
+	// A body in the original unauthenticated format, which a server could tamper with undetected.
+	block, err := aes.NewCipher(key.key[:])
+	assert.Nil(t, err)
+	iv := make([]byte, aes.BlockSize)
+	ofb := make([]byte, len("hello world"))
+	cipher.NewOFB(block, iv).XORKeyStream(ofb, []byte("hello world"))
+	body := header + string(iv) + string(ofb)
+
+	var plain bytes.Buffer
+	assert.NotNil(t, key.Decrypt(strings.NewReader(body), &plain))
+	assert.Equal(t, 0, plain.Len())
+
+	// A body stripped after the header.
+	assert.NotNil(t, key.Decrypt(strings.NewReader(header), &plain))
+	assert.Equal(t, 0, plain.Len())
+}
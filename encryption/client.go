@@ -0,0 +1,110 @@
+package encryption
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Documents encrypted by the client before upload start with a short header, followed by the chunked stream format.
+//
+//	magic (4 bytes) | mode (1 byte) | salt (SaltSize bytes, passphrase mode only) | stream
+const ClientMagic = "WAS1"
+
+const (
+	ClientModeKeyFile    byte = 1
+	ClientModePassphrase byte = 2
+)
+
+// gcmOverhead is the size of the tag sealed onto each chunk of the stream.
+const gcmOverhead = 16
+
+// ClientChecker checks that the data written to it has the layout of a client-encrypted document. It doesn't have the
+// key, so it can't tell ciphertext from random data, but it stops a client from storing plaintext unencrypted just by
+// claiming that it was encrypted.
+//
+// Write returns an error as soon as the header is found to be invalid. Close must be called after the last write to
+// check that the stream isn't truncated.
+type ClientChecker struct {
+	header []byte // Buffered until it is complete.
+	chunk  int64  // Size of each sealed chunk, once the header has been read.
+	body   int64  // Number of bytes following the header.
+	err    error
+}
+
+// headerLen returns the length of the whole header, or 0 if not enough of it has been read to know.
+func (c *ClientChecker) headerLen() int {
+	if len(c.header) <= len(ClientMagic) {
+		return 0
+	}
+	n := len(ClientMagic) + 1
+	if c.header[len(ClientMagic)] == ClientModePassphrase {
+		n += SaltSize
+	}
+	return n + len(streamMagic) + 4 + 12
+}
+
+func (c *ClientChecker) Write(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	total := len(b)
+	if c.chunk == 0 {
+		need := c.headerLen()
+		for need == 0 || len(c.header) < need {
+			if len(b) == 0 {
+				return total, nil
+			}
+			n := 1
+			if need > 0 {
+				n = need - len(c.header)
+				if n > len(b) {
+					n = len(b)
+				}
+			}
+			c.header = append(c.header, b[:n]...)
+			b = b[n:]
+			need = c.headerLen()
+		}
+		if c.err = c.checkHeader(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	c.body += int64(len(b))
+	return total, nil
+}
+
+func (c *ClientChecker) checkHeader() error {
+	if string(c.header[:len(ClientMagic)]) != ClientMagic {
+		return fmt.Errorf("data is not client-side encrypted")
+	}
+	switch mode := c.header[len(ClientMagic)]; mode {
+	case ClientModeKeyFile, ClientModePassphrase:
+	default:
+		return fmt.Errorf("unknown client-side encryption mode %d", mode)
+	}
+	stream := c.header[len(c.header)-len(streamMagic)-4-12:]
+	if string(stream[:len(streamMagic)]) != streamMagic {
+		return fmt.Errorf("client-side encrypted data is not in the chunked stream format")
+	}
+	size := int64(binary.BigEndian.Uint32(stream[len(streamMagic):]))
+	if size <= 0 || size > maxChunkSize {
+		return fmt.Errorf("invalid encrypted stream chunk size %d", size)
+	}
+	c.chunk = size + gcmOverhead
+	return nil
+}
+
+// Close checks that a complete stream was written: a header, then whole chunks and a final chunk that holds at least a
+// tag.
+func (c *ClientChecker) Close() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.chunk == 0 {
+		return fmt.Errorf("client-side encryption header is truncated")
+	}
+	if last := c.body % c.chunk; c.body < gcmOverhead || (last != 0 && last < gcmOverhead) {
+		return errShortStream
+	}
+	return nil
+}
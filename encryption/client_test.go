@@ -0,0 +1,78 @@
+package encryption
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// checkClient writes data to a ClientChecker a few bytes at a time, and returns the first error.
+func checkClient(data []byte) error {
+	c := &ClientChecker{}
+	for len(data) > 0 {
+		n := 3
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := c.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return c.Close()
+}
+
+func TestClientChecker(t *testing.T) {
+	e := Envelope{chunkSize: 64, workers: 2}
+	key := e.NewKey()
+	salt, err := NewSalt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 1, 64, 65, 200} {
+		var stream bytes.Buffer
+		if err := e.Encrypt(key, strings.NewReader(strings.Repeat("x", size)), &stream); err != nil {
+			t.Fatal(err)
+		}
+		keyFile := append([]byte(ClientMagic+"\x01"), stream.Bytes()...)
+		passphrase := append(append([]byte(ClientMagic+"\x02"), salt...), stream.Bytes()...)
+		for _, data := range [][]byte{keyFile, passphrase} {
+			if err := checkClient(data); err != nil {
+				t.Errorf("Valid %d byte document rejected: %v", size, err)
+			}
+			// Cutting the final chunk short of a whole tag is detected. Other truncations are only found when the
+			// document is decrypted.
+			last := (stream.Len() - len(streamMagic) - 4 - 12) % (64 + gcmOverhead)
+			if last == 0 {
+				last = 64 + gcmOverhead
+			}
+			if err := checkClient(data[:len(data)-last+8]); err == nil {
+				t.Errorf("Truncated %d byte document accepted", size)
+			}
+		}
+	}
+
+	var stream bytes.Buffer
+	if err := e.Encrypt(key, strings.NewReader("hello"), &stream); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string][]byte{
+		"plaintext":      []byte("hello world, this is not encrypted at all, but is long enough to have a header"),
+		"empty":          nil,
+		"header only":    []byte(ClientMagic + "\x01"),
+		"unknown mode":   append([]byte(ClientMagic+"\x07"), stream.Bytes()...),
+		"not a stream":   append([]byte(ClientMagic+"\x01"), bytes.Repeat([]byte{0}, 64)...),
+		"missing stream": append([]byte(ClientMagic+"\x01"), stream.Bytes()[:len(streamMagic)+16]...),
+	} {
+		if err := checkClient(data); err == nil {
+			t.Errorf("Invalid document %q accepted", name)
+		}
+	}
+
+	// Nothing more is accepted after an invalid header.
+	c := &ClientChecker{}
+	if _, err := io.Copy(c, strings.NewReader(strings.Repeat("plain", 100))); err == nil {
+		t.Errorf("Write accepted plaintext")
+	}
+}
@@ -0,0 +1,67 @@
+package encryption
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Customer-supplied encryption keys are passed in these request headers, in the same style as Google Cloud Storage.
+const (
+	AlgorithmHeader = "X-Encryption-Algorithm"
+	KeyHeader       = "X-Encryption-Key"
+	KeySHA256Header = "X-Encryption-Key-Sha256"
+)
+
+// ErrKeyMismatch is returned when a customer-supplied key does not match the fingerprint it is being checked against.
+var ErrKeyMismatch = errors.New("encryption key does not match")
+
+// CustomerKey extracts a customer-supplied encryption key from request headers.
+// If the request does not contain a key, a nil key and no error is returned.
+// The returned fingerprint is the base64 encoded SHA-256 hash of the key, which is safe to store.
+func CustomerKey(h http.Header) (Key, string, error) {
+	encoded := h.Get(KeyHeader)
+	if encoded == "" {
+		return nil, "", nil
+	}
+	if alg := h.Get(AlgorithmHeader); alg != "" && !strings.EqualFold(alg, "AES256") {
+		return nil, "", fmt.Errorf("unsupported encryption algorithm %q", alg)
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid encryption key encoding: %v", err)
+	}
+	if len(raw) != 32 {
+		return nil, "", fmt.Errorf("encryption key must be 256 bits, got %d", len(raw)*8)
+	}
+	var key [32]byte
+	copy(key[:], raw)
+
+	fingerprint := Fingerprint(&key)
+	if sum := h.Get(KeySHA256Header); sum != "" && !MatchFingerprint(&key, sum) {
+		return nil, "", fmt.Errorf("%s does not match the supplied key", KeySHA256Header)
+	}
+	return &key, fingerprint, nil
+}
+
+// Fingerprint returns the base64 encoded SHA-256 hash of a key.
+func Fingerprint(key Key) string {
+	sum := sha256.Sum256(key[:])
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// MatchFingerprint checks whether the key matches a fingerprint in constant time.
+func MatchFingerprint(key Key, fingerprint string) bool {
+	return subtle.ConstantTimeCompare([]byte(Fingerprint(key)), []byte(fingerprint)) == 1
+}
+
+// SetCustomerKey adds the headers required to send a customer-supplied key with a request.
+func SetCustomerKey(h http.Header, key Key) {
+	h.Set(AlgorithmHeader, "AES256")
+	h.Set(KeyHeader, base64.StdEncoding.EncodeToString(key[:]))
+	h.Set(KeySHA256Header, Fingerprint(key))
+}
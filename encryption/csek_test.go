@@ -0,0 +1,47 @@
+package encryption
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCustomerKey(t *testing.T) {
+	e := Envelope{}
+	key := e.NewKey()
+	h := http.Header{}
+	SetCustomerKey(h, key)
+
+	got, fingerprint, err := CustomerKey(h)
+	assert.Nil(t, err)
+	assert.Equal(t, *key, *got)
+	assert.Equal(t, Fingerprint(key), fingerprint)
+	assert.True(t, MatchFingerprint(got, fingerprint))
+	assert.False(t, MatchFingerprint(e.NewKey(), fingerprint))
+}
+
+func TestCustomerKeyMissing(t *testing.T) {
+	key, fingerprint, err := CustomerKey(http.Header{})
+	assert.Nil(t, err)
+	assert.Nil(t, key)
+	assert.Equal(t, "", fingerprint)
+}
+
+func TestCustomerKeyInvalid(t *testing.T) {
+	e := Envelope{}
+	h := http.Header{}
+	h.Set(KeyHeader, "c2hvcnQ=")
+	_, _, err := CustomerKey(h)
+	assert.NotNil(t, err)
+
+	SetCustomerKey(h, e.NewKey())
+	h.Set(KeySHA256Header, Fingerprint(e.NewKey()))
+	_, _, err = CustomerKey(h)
+	assert.NotNil(t, err)
+
+	SetCustomerKey(h, e.NewKey())
+	h.Set(AlgorithmHeader, "DES")
+	_, _, err = CustomerKey(h)
+	assert.NotNil(t, err)
+}
@@ -5,16 +5,18 @@
 package encryption
 
 import (
+	"bytes"
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"io"
-	"log"
 	"path"
 
 	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
 	"go.opencensus.io/trace"
 
 	"golang.org/x/oauth2/google"
@@ -28,27 +30,85 @@ type Key *[32]byte
 type Envelope struct {
 	config *autoconfig.Config
 	svc    *cloudkms.Service // Google KMS Service client.
+
+	chunkSize int // Plaintext bytes per chunk, DefaultChunkSize if unset.
+	workers   int // Number of chunks to encrypt or decrypt in parallel, GOMAXPROCS if unset.
 }
 
 func New(ctx context.Context, config *autoconfig.Config) *Envelope {
 	client, err := google.DefaultClient(ctx, cloudkms.CloudPlatformScope)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf(ctx, "Error creating envelope encryption: %v", err)
 	}
 
 	kmsService, err := cloudkms.New(client)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf(ctx, "Error creating envelope encryption: %v", err)
 	}
 
-	return &Envelope{
+	e := &Envelope{
 		config: config,
 		svc:    kmsService,
 	}
+	if e.chunkSize, err = config.GetIntOr("encryption.chunk_size", DefaultChunkSize); err != nil {
+		logger.Fatalf(ctx, "Error creating envelope encryption: %v", err)
+	}
+	if e.chunkSize <= 0 || e.chunkSize > maxChunkSize {
+		logger.Fatalf(ctx, "encryption.chunk_size must be between 1 and %d", maxChunkSize)
+	}
+	if e.workers, err = config.GetIntOr("encryption.workers", 0); err != nil {
+		logger.Fatalf(ctx, "Error creating envelope encryption: %v", err)
+	}
+	return e
 }
 
-// Encrypt encrypts data using enveloe encryption.
+// Encrypt encrypts data using envelope encryption.
+// The data is split into chunks which are encrypted in parallel, see stream.go for the format.
 func (e *Envelope) Encrypt(key Key, reader io.Reader, writer io.Writer) error {
+	size := e.chunkSize
+	if size == 0 {
+		size = DefaultChunkSize
+	}
+	if err := encryptStream(key, reader, writer, size, e.workers); err != nil {
+		logger.Errorf(context.Background(), "Error writing encrypted data: %v", err)
+		return err
+	}
+	return nil
+}
+
+// Decrypt decrypts data using envelope encryption. Data written by the chunked format and by the original single
+// stream format (encryptOFB) can both be decrypted.
+func (e *Envelope) Decrypt(key Key, reader io.Reader, writer io.Writer) error {
+	// The original format starts with a random IV, which is vanishingly unlikely to match the magic.
+	var prefix [len(streamMagic)]byte
+	n, err := io.ReadFull(reader, prefix[:])
+	if err == nil && string(prefix[:]) == streamMagic {
+		return decryptStream(key, reader, writer, e.workers)
+	}
+	if err == io.EOF {
+		// Empty input decrypts to empty output, as it did before the chunked format was added.
+		return nil
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	return decryptOFB(key, io.MultiReader(bytes.NewReader(prefix[:n]), reader), writer)
+}
+
+// DecryptStream decrypts data written by Encrypt, and rejects anything else. Unlike Decrypt, it doesn't accept the
+// original unauthenticated format or empty input, so it should be used wherever the ciphertext comes from an untrusted
+// source.
+func (e *Envelope) DecryptStream(key Key, reader io.Reader, writer io.Writer) error {
+	var prefix [len(streamMagic)]byte
+	if _, err := io.ReadFull(reader, prefix[:]); err != nil || string(prefix[:]) != streamMagic {
+		return errors.New("data is not an encrypted stream")
+	}
+	return decryptStream(key, reader, writer, e.workers)
+}
+
+// encryptOFB encrypts data as a single AES-OFB stream. This was the original format, and is kept to compare
+// performance against the chunked format.
+func encryptOFB(key Key, reader io.Reader, writer io.Writer) error {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return err
@@ -58,24 +118,28 @@ func (e *Envelope) Encrypt(key Key, reader io.Reader, writer io.Writer) error {
 		return err
 	}
 	// Write the IV as the first [aes.BlockSize] bytes of the stream.
-	writer.Write(iv[:])
+	if _, err := writer.Write(iv[:]); err != nil {
+		return err
+	}
 	stream := cipher.NewOFB(block, iv[:])
 	out := &cipher.StreamWriter{S: stream, W: writer}
 	if _, err := io.Copy(out, reader); err != nil {
-		log.Printf("Error writing encrypted data: %v", err)
+		logger.Errorf(context.Background(), "Error writing encrypted data: %v", err)
 		return err
 	}
 	return nil
 }
 
-// Decrypt decrypts data using enveloe encryption.
-func (e *Envelope) Decrypt(key Key, reader io.Reader, writer io.Writer) error {
+// decryptOFB decrypts data written by encryptOFB.
+func decryptOFB(key Key, reader io.Reader, writer io.Writer) error {
 	block, err := aes.NewCipher(key[:])
 	if err != nil {
 		return err
 	}
 	var iv [aes.BlockSize]byte
-	reader.Read(iv[:])
+	if _, err := io.ReadFull(reader, iv[:]); err != nil {
+		return err
+	}
 	stream := cipher.NewOFB(block, iv[:])
 	out := &cipher.StreamWriter{S: stream, W: writer}
 	if _, err := io.Copy(out, reader); err != nil {
@@ -2,6 +2,9 @@ package encryption
 
 import (
 	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
 )
@@ -30,3 +33,174 @@ func TestEncryptAndDecrypt(t *testing.T) {
 		t.Errorf("Decrypted does not match input")
 	}
 }
+
+func TestEncryptAndDecryptChunks(t *testing.T) {
+	e := Envelope{chunkSize: 64, workers: 3}
+	key := e.NewKey()
+	for _, size := range []int{0, 1, 63, 64, 65, 128, 1000} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		var ciphertext bytes.Buffer
+		if err := e.Encrypt(key, bytes.NewReader(plain), &ciphertext); err != nil {
+			t.Fatalf("Encrypt(%d bytes): %v", size, err)
+		}
+		var out bytes.Buffer
+		if err := e.Decrypt(key, &ciphertext, &out); err != nil {
+			t.Fatalf("Decrypt(%d bytes): %v", size, err)
+		}
+		if !bytes.Equal(plain, out.Bytes()) {
+			t.Errorf("Decrypted %d bytes does not match input", size)
+		}
+	}
+}
+
+func TestDecryptTampered(t *testing.T) {
+	e := Envelope{chunkSize: 64}
+	key := e.NewKey()
+	var ciphertext bytes.Buffer
+	if err := e.Encrypt(key, strings.NewReader(testPlain), &ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	b := ciphertext.Bytes()
+
+	// Flip a bit in the second chunk.
+	tampered := append([]byte{}, b...)
+	tampered[len(streamMagic)+16+100] ^= 1
+	if err := e.Decrypt(key, bytes.NewReader(tampered), ioutil.Discard); err == nil {
+		t.Errorf("Decrypt succeeded on tampered data")
+	}
+
+	// Drop the final chunk, leaving a stream that ends on a chunk boundary.
+	truncated := b[:len(streamMagic)+16+2*(64+16)]
+	if err := e.Decrypt(key, bytes.NewReader(truncated), ioutil.Discard); err == nil {
+		t.Errorf("Decrypt succeeded on truncated data")
+	}
+
+	// Use the wrong key.
+	if err := e.Decrypt(e.NewKey(), bytes.NewReader(b), ioutil.Discard); err == nil {
+		t.Errorf("Decrypt succeeded with the wrong key")
+	}
+}
+
+func TestDecryptOFB(t *testing.T) {
+	// Data written in the original format must still be readable.
+	e := Envelope{}
+	key := e.NewKey()
+	var ciphertext bytes.Buffer
+	if err := encryptOFB(key, strings.NewReader(testPlain), &ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if err := e.Decrypt(key, &ciphertext, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.String() != testPlain {
+		t.Errorf("Decrypted does not match input")
+	}
+}
+
+func TestDecryptEmpty(t *testing.T) {
+	e := Envelope{}
+	var plain bytes.Buffer
+	if err := e.Decrypt(e.NewKey(), bytes.NewReader(nil), &plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.Len() != 0 {
+		t.Errorf("Decrypted %d bytes from empty input", plain.Len())
+	}
+}
+
+func TestDecryptStream(t *testing.T) {
+	e := Envelope{}
+	key := e.NewKey()
+	var ciphertext bytes.Buffer
+	if err := e.Encrypt(key, strings.NewReader(testPlain), &ciphertext); err != nil {
+		t.Fatal(err)
+	}
+	var plain bytes.Buffer
+	if err := e.DecryptStream(key, &ciphertext, &plain); err != nil {
+		t.Fatal(err)
+	}
+	if plain.String() != testPlain {
+		t.Errorf("Decrypted does not match input")
+	}
+
+	// Only the chunked format is accepted.
+	var ofb bytes.Buffer
+	if err := encryptOFB(key, strings.NewReader(testPlain), &ofb); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.DecryptStream(key, &ofb, ioutil.Discard); err == nil {
+		t.Errorf("DecryptStream succeeded on the original format")
+	}
+	if err := e.DecryptStream(key, bytes.NewReader(nil), ioutil.Discard); err == nil {
+		t.Errorf("DecryptStream succeeded on empty input")
+	}
+}
+
+func TestBufferPoolShared(t *testing.T) {
+	key := (&Envelope{}).NewKey()
+	a, err := newPipeline(key, make([]byte, 12), 1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newPipeline(key, make([]byte, 12), 1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.pool != b.pool {
+		t.Errorf("Streams with the same chunk size don't share a buffer pool")
+	}
+}
+
+const benchmarkSize = 64 << 20
+
+func benchmarkEncrypt(b *testing.B, encrypt func(Key, io.Reader, io.Writer) error) {
+	e := Envelope{}
+	key := e.NewKey()
+	plain := make([]byte, benchmarkSize)
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encrypt(key, bytes.NewReader(plain), ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkDecrypt(b *testing.B, encrypt func(Key, io.Reader, io.Writer) error) {
+	e := Envelope{}
+	key := e.NewKey()
+	var ciphertext bytes.Buffer
+	if err := encrypt(key, bytes.NewReader(make([]byte, benchmarkSize)), &ciphertext); err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(benchmarkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := e.Decrypt(key, bytes.NewReader(ciphertext.Bytes()), ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	e := Envelope{}
+	benchmarkEncrypt(b, e.Encrypt)
+}
+
+func BenchmarkEncryptOFB(b *testing.B) {
+	benchmarkEncrypt(b, encryptOFB)
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	e := Envelope{}
+	benchmarkDecrypt(b, e.Encrypt)
+}
+
+func BenchmarkDecryptOFB(b *testing.B) {
+	benchmarkDecrypt(b, encryptOFB)
+}
@@ -0,0 +1,32 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// SaltSize is the size of the random salt used by DeriveKey.
+const SaltSize = 16
+
+// NewSalt returns a new random salt for use with DeriveKey.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// DeriveKey derives a 256-bit key from a passphrase using scrypt.
+func DeriveKey(passphrase, salt []byte) (Key, error) {
+	k, err := scrypt.Key(passphrase, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err)
+	}
+	var key [32]byte
+	copy(key[:], k)
+	return &key, nil
+}
@@ -0,0 +1,266 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// The chunked stream format splits the data into fixed size chunks that are each sealed with AES-GCM, so that chunks
+// can be encrypted and decrypted independently and in parallel.
+//
+//	magic (8 bytes) | chunk size (4 bytes, big endian) | base nonce (12 bytes) | chunk 0 | chunk 1 | ...
+//
+// Every chunk except the last contains exactly chunk size bytes of plaintext followed by a 16 byte tag. The nonce for
+// each chunk is the base nonce with the chunk index XORed into the last 8 bytes, and the top bit of the first byte
+// flipped on the final chunk, so that chunks can't be reordered and the stream can't be truncated without detection.
+const streamMagic = "WAS\x00GCM2"
+
+const (
+	// DefaultChunkSize is the amount of plaintext in each chunk when none is configured.
+	DefaultChunkSize = 256 << 10
+	// maxChunkSize limits the buffer size that a stream header can ask a reader to allocate.
+	maxChunkSize = 16 << 20
+)
+
+var errShortStream = errors.New("encrypted stream is truncated")
+
+// chunk is a unit of work in the pipeline. Once a worker has sealed or opened the chunk, it is sent on done.
+type chunk struct {
+	index uint64
+	last  bool
+	buf   []byte // Input, and then output of the worker.
+	err   error
+	done  chan *chunk
+}
+
+// pipeline runs a bounded pool of workers over a sequence of chunks and writes the results in order.
+type pipeline struct {
+	aead    cipher.AEAD
+	nonce   []byte
+	size    int // Plaintext chunk size.
+	workers int
+	pool    *sync.Pool
+}
+
+// bufferPools holds a pool of chunk buffers for each buffer size. They are shared by every stream, so that buffers
+// are reused across requests rather than only within one.
+var bufferPools = struct {
+	sync.Mutex
+	m map[int]*sync.Pool
+}{m: make(map[int]*sync.Pool)}
+
+// bufferPool returns the pool of buffers of size bytes.
+func bufferPool(size int) *sync.Pool {
+	bufferPools.Lock()
+	defer bufferPools.Unlock()
+	pool, ok := bufferPools.m[size]
+	if !ok {
+		pool = &sync.Pool{New: func() interface{} {
+			b := make([]byte, size)
+			return &b
+		}}
+		bufferPools.m[size] = pool
+	}
+	return pool
+}
+
+func newPipeline(key Key, nonce []byte, size, workers int) (*pipeline, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &pipeline{
+		aead:    aead,
+		nonce:   nonce,
+		size:    size,
+		workers: workers,
+		pool:    bufferPool(size + aead.Overhead()),
+	}, nil
+}
+
+func (p *pipeline) chunkNonce(index uint64, last bool) []byte {
+	nonce := make([]byte, len(p.nonce))
+	copy(nonce, p.nonce)
+	var ctr [8]byte
+	binary.BigEndian.PutUint64(ctr[:], index)
+	for i := range ctr {
+		nonce[len(nonce)-8+i] ^= ctr[i]
+	}
+	if last {
+		nonce[0] ^= 0x80
+	}
+	return nonce
+}
+
+// run reads chunks using next, which fills a buffer with the input for one chunk, processes them with process on the
+// worker pool and writes the output in order.
+// next returns the number of bytes read and whether this is the final chunk.
+func (p *pipeline) run(w io.Writer, next func(buf []byte) (int, bool, error), process func(c *chunk) error) error {
+	jobs := make(chan *chunk)
+	// order holds chunks in the order they were read. Its capacity bounds the number of chunks in flight.
+	order := make(chan *chunk, p.workers*2)
+	stop := make(chan struct{})
+	var readErr error
+
+	var wg sync.WaitGroup
+	for i := 0; i < p.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range jobs {
+				c.err = process(c)
+				c.done <- c
+			}
+		}()
+	}
+
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		for index := uint64(0); ; index++ {
+			buf := *p.pool.Get().(*[]byte)
+			buf = buf[:cap(buf)]
+			n, last, err := next(buf)
+			if err != nil {
+				readErr = err
+				p.pool.Put(&buf)
+				return
+			}
+			c := &chunk{index: index, last: last, buf: buf[:n], done: make(chan *chunk, 1)}
+			select {
+			case order <- c:
+			case <-stop:
+				return
+			}
+			jobs <- c
+			if last {
+				return
+			}
+		}
+	}()
+
+	var err error
+	stopped := false
+	for c := range order {
+		<-c.done
+		if err == nil {
+			err = c.err
+		}
+		if err == nil {
+			if _, werr := w.Write(c.buf); werr != nil {
+				err = werr
+			}
+		}
+		buf := c.buf[:0]
+		p.pool.Put(&buf)
+		if err != nil && !stopped {
+			// Stop reading any more input, but keep draining the chunks already in flight.
+			close(stop)
+			stopped = true
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return readErr
+}
+
+// encryptStream encrypts reader into writer using the chunked stream format.
+func encryptStream(key Key, reader io.Reader, writer io.Writer, size, workers int) error {
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	p, err := newPipeline(key, nonce, size, workers)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(streamMagic)+4, len(streamMagic)+4+len(nonce))
+	copy(header, streamMagic)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], uint32(size))
+	header = append(header, nonce...)
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+
+	// Read one byte ahead so that the final chunk can be identified before it is sealed.
+	br := bufio.NewReaderSize(reader, size)
+	next := func(buf []byte) (int, bool, error) {
+		n, err := io.ReadFull(br, buf[:p.size])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return n, true, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if _, err := br.Peek(1); err == io.EOF {
+			return n, true, nil
+		}
+		return n, false, nil
+	}
+	process := func(c *chunk) error {
+		c.buf = p.aead.Seal(c.buf[:0], p.chunkNonce(c.index, c.last), c.buf, nil)
+		return nil
+	}
+	return p.run(writer, next, process)
+}
+
+// decryptStream decrypts a chunked stream from reader into writer. The magic has already been read.
+func decryptStream(key Key, reader io.Reader, writer io.Writer, workers int) error {
+	header := make([]byte, 4+12)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return errShortStream
+	}
+	size := int(binary.BigEndian.Uint32(header[:4]))
+	if size <= 0 || size > maxChunkSize {
+		return fmt.Errorf("invalid encrypted stream chunk size %d", size)
+	}
+	p, err := newPipeline(key, header[4:], size, workers)
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(reader, size)
+	next := func(buf []byte) (int, bool, error) {
+		n, err := io.ReadFull(br, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			if n < p.aead.Overhead() {
+				return 0, false, errShortStream
+			}
+			return n, true, nil
+		}
+		if err != nil {
+			return 0, false, err
+		}
+		if _, err := br.Peek(1); err == io.EOF {
+			return n, true, nil
+		}
+		return n, false, nil
+	}
+	process := func(c *chunk) error {
+		plain, err := p.aead.Open(c.buf[:0], p.chunkNonce(c.index, c.last), c.buf, nil)
+		if err != nil {
+			return fmt.Errorf("error decrypting chunk %d: %v", c.index, err)
+		}
+		c.buf = plain
+		return nil
+	}
+	return p.run(writer, next, process)
+}
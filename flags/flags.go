@@ -0,0 +1,352 @@
+// Package flags evaluates feature flags defined in the "flags" section of the configuration.
+//
+// A boolean flag is either true or false, or an object:
+//
+//	"streaming_upload": {
+//		"enabled": true,        // Kill switch, the flag is off for everybody if false. Defaults to true.
+//		"percentage": 10,       // Percentage of users that get the flag, 100 if unset.
+//		"allow": ["user-1"],    // Users that always get the flag, unless it is disabled.
+//		"deny": ["user-2"]      // Users that never get the flag.
+//	}
+//
+// A variant flag assigns each user one of several named variants:
+//
+//	"upload_path": {
+//		"default": "legacy",              // Variant for users outside the rollout, denied users and when disabled.
+//		"variants": {"chunked": 25},      // Percentage of users assigned to each variant. The rest get the default.
+//		"overrides": {"user-1": "chunked"}
+//	}
+//
+// Users are assigned to a percentage by hashing their ID with the flag name, so each user sees a stable result for a
+// flag, and increasing a percentage only adds users. Requests without an authenticated user only see flags that are
+// on for 100% of users.
+//
+// Flags are re-read whenever the configuration is reloaded, and a reload containing an invalid flag is rejected.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/dparrish/build-web-application-demo/authentication"
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"go.opencensus.io/trace"
+)
+
+// flag is a parsed flag definition.
+type flag struct {
+	enabled    bool
+	percentage float64
+	allow      map[string]bool
+	deny       map[string]bool
+
+	// Variant flags only.
+	def       string
+	variants  []variant
+	overrides map[string]string
+}
+
+type variant struct {
+	name       string
+	percentage float64
+}
+
+// Flags holds the current set of flags from a configuration.
+type Flags struct {
+	flags atomic.Value // map[string]*flag
+}
+
+// New reads the flags from config, and keeps them up to date as the configuration changes.
+func New(config *autoconfig.Config) (*Flags, error) {
+	flags, err := parse(config)
+	if err != nil {
+		return nil, err
+	}
+	f := &Flags{}
+	f.flags.Store(flags)
+	config.AddValidator(func(old, new *autoconfig.Config) error {
+		_, err := parse(new)
+		return err
+	})
+	config.OnChange("flags", func(old, new *autoconfig.Config, changed []string) {
+		flags, err := parse(new)
+		if err != nil {
+			// The validator should have rejected this configuration.
+			logger.Errorf(context.Background(), "Error reading feature flags, keeping existing flags: %v", err)
+			return
+		}
+		logger.Infof(context.Background(), "Feature flags changed: %v", changed)
+		f.flags.Store(flags)
+	})
+	return f, nil
+}
+
+// Enabled returns true if the boolean flag name is on for the user making the request in ctx. Unknown flags are off.
+// The result is added to the current trace span.
+func (f *Flags) Enabled(ctx context.Context, name string) bool {
+	fl := f.lookup(name)
+	on := fl != nil && fl.variants == nil && fl.enabled
+	if on {
+		userid := authentication.UserID(ctx)
+		switch {
+		case fl.deny[userid]:
+			on = false
+		case fl.allow[userid]:
+		default:
+			on = fl.percentage >= 100 || (userid != "" && bucket(name, userid) < fl.percentage)
+		}
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.BoolAttribute("flag."+name, on))
+	}
+	return on
+}
+
+// Variant returns the variant of flag name for the user making the request in ctx. Unknown flags return an empty
+// string. The result is added to the current trace span.
+func (f *Flags) Variant(ctx context.Context, name string) string {
+	fl := f.lookup(name)
+	var v string
+	if fl != nil {
+		v = fl.variant(name, authentication.UserID(ctx))
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.StringAttribute("flag."+name, v))
+	}
+	return v
+}
+
+func (fl *flag) variant(name, userid string) string {
+	if !fl.enabled || fl.deny[userid] {
+		return fl.def
+	}
+	if v, ok := fl.overrides[userid]; ok {
+		return v
+	}
+	if userid == "" {
+		return fl.def
+	}
+	b := bucket(name, userid)
+	var total float64
+	for _, v := range fl.variants {
+		total += v.percentage
+		if b < total {
+			return v.name
+		}
+	}
+	return fl.def
+}
+
+func (f *Flags) lookup(name string) *flag {
+	flags, _ := f.flags.Load().(map[string]*flag)
+	return flags[name]
+}
+
+// bucket returns a stable number in [0, 100) for a user and flag.
+func bucket(name, userid string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(userid))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// parse reads every flag from the configuration.
+func parse(config *autoconfig.Config) (map[string]*flag, error) {
+	flags := make(map[string]*flag)
+	if !config.Has("flags") {
+		return flags, nil
+	}
+	m, err := config.GetMap("flags")
+	if err != nil {
+		return nil, err
+	}
+	for name, v := range m {
+		fl, err := parseFlag(v)
+		if err != nil {
+			return nil, fmt.Errorf("flag %q: %v", name, err)
+		}
+		flags[name] = fl
+	}
+	return flags, nil
+}
+
+func parseFlag(v interface{}) (*flag, error) {
+	fl := &flag{enabled: true, percentage: 100}
+	hasPercentage := false
+	switch t := v.(type) {
+	case bool:
+		fl.enabled = t
+		return fl, nil
+	case map[string]interface{}:
+		for k, v := range t {
+			var err error
+			switch k {
+			case "enabled":
+				b, ok := v.(bool)
+				if !ok {
+					return nil, fmt.Errorf("enabled must be a boolean")
+				}
+				fl.enabled = b
+			case "percentage":
+				fl.percentage, err = percentage(v)
+				hasPercentage = true
+			case "allow":
+				fl.allow, err = userSet(v)
+			case "deny":
+				fl.deny, err = userSet(v)
+			case "default":
+				s, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("default must be a string")
+				}
+				fl.def = s
+			case "variants":
+				fl.variants, err = variants(v)
+			case "overrides":
+				fl.overrides, err = overrides(v)
+			default:
+				return nil, fmt.Errorf("unknown setting %q", k)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, fmt.Errorf("must be a boolean or an object")
+	}
+
+	if fl.variants == nil {
+		if fl.def != "" || fl.overrides != nil {
+			return nil, fmt.Errorf("default and overrides are only valid for variant flags")
+		}
+		return fl, nil
+	}
+	if fl.def == "" {
+		return nil, fmt.Errorf("variant flags require a default")
+	}
+	if len(fl.allow) > 0 || hasPercentage {
+		return nil, fmt.Errorf("allow and percentage are not valid for variant flags, use overrides and variants")
+	}
+	for userid, v := range fl.overrides {
+		if v != fl.def && !fl.hasVariant(v) {
+			return nil, fmt.Errorf("override for %q is an unknown variant %q", userid, v)
+		}
+	}
+	return fl, nil
+}
+
+func (fl *flag) hasVariant(name string) bool {
+	for _, v := range fl.variants {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func percentage(v interface{}) (float64, error) {
+	p, ok := v.(float64)
+	if !ok || p < 0 || p > 100 {
+		return 0, fmt.Errorf("percentage must be a number between 0 and 100")
+	}
+	return p, nil
+}
+
+func userSet(v interface{}) (map[string]bool, error) {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("user lists must be lists of strings")
+	}
+	users := make(map[string]bool, len(l))
+	for _, u := range l {
+		s, ok := u.(string)
+		if !ok {
+			return nil, fmt.Errorf("user lists must be lists of strings")
+		}
+		users[s] = true
+	}
+	return users, nil
+}
+
+func variants(v interface{}) ([]variant, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("variants must be an object of name to percentage")
+	}
+	var total float64
+	r := make([]variant, 0, len(m))
+	for name, p := range m {
+		pct, err := percentage(p)
+		if err != nil {
+			return nil, fmt.Errorf("variant %q: %v", name, err)
+		}
+		total += pct
+		r = append(r, variant{name, pct})
+	}
+	if total > 100 {
+		return nil, fmt.Errorf("variant percentages add up to more than 100")
+	}
+	// Sort so that every replica assigns users to variants in the same order.
+	sort.Slice(r, func(i, j int) bool { return r[i].name < r[j].name })
+	return r, nil
+}
+
+func overrides(v interface{}) (map[string]string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("overrides must be an object of user ID to variant")
+	}
+	r := make(map[string]string, len(m))
+	for userid, v := range m {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("override for %q must be a string", userid)
+		}
+		r[userid] = s
+	}
+	return r, nil
+}
+
+// defaultFlags is used by the package level functions. It is set with SetDefault.
+var (
+	defaultMu    sync.RWMutex
+	defaultFlags *Flags
+)
+
+// SetDefault sets the flags used by the package level Enabled and Variant functions.
+func SetDefault(f *Flags) {
+	defaultMu.Lock()
+	defaultFlags = f
+	defaultMu.Unlock()
+}
+
+func getDefault() *Flags {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+	return defaultFlags
+}
+
+// Enabled calls Enabled on the default flags. Every flag is off if SetDefault hasn't been called.
+func Enabled(ctx context.Context, name string) bool {
+	f := getDefault()
+	if f == nil {
+		return false
+	}
+	return f.Enabled(ctx, name)
+}
+
+// Variant calls Variant on the default flags. Every flag returns an empty string if SetDefault hasn't been called.
+func Variant(ctx context.Context, name string) string {
+	f := getDefault()
+	if f == nil {
+		return ""
+	}
+	return f.Variant(ctx, name)
+}
@@ -0,0 +1,162 @@
+package flags
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/authentication"
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/autoconfig/autoconfigtest"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+const testFlags = `{
+	"flags": {
+		"on": true,
+		"off": false,
+		"half": {"percentage": 50, "allow": ["allowed"], "deny": ["denied"]},
+		"killed": {"enabled": false, "allow": ["allowed"]},
+		"path": {"default": "legacy", "variants": {"chunked": 30, "streaming": 20}, "overrides": {"allowed": "streaming"}}
+	}
+}`
+
+func loadFlags(t *testing.T, body string) (*autoconfig.Config, *Flags) {
+	config := autoconfigtest.Load(t, body)
+	f, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, f
+}
+
+func user(userid string) context.Context {
+	return authentication.WithUserID(context.Background(), userid)
+}
+
+func TestEnabled(t *testing.T) {
+	_, f := loadFlags(t, testFlags)
+	anonymous := context.Background()
+	assert.True(t, f.Enabled(anonymous, "on"))
+	assert.False(t, f.Enabled(anonymous, "off"))
+	assert.False(t, f.Enabled(anonymous, "missing"))
+	assert.False(t, f.Enabled(anonymous, "half"))
+	assert.True(t, f.Enabled(user("allowed"), "half"))
+	assert.False(t, f.Enabled(user("denied"), "half"))
+	assert.False(t, f.Enabled(user("allowed"), "killed"))
+	assert.False(t, f.Enabled(user("allowed"), "path"))
+
+	// Roughly half the users get the flag, and each user always gets the same result.
+	on := 0
+	for i := 0; i < 1000; i++ {
+		ctx := user(fmt.Sprintf("user-%d", i))
+		if f.Enabled(ctx, "half") {
+			on++
+		}
+		assert.Equal(t, f.Enabled(ctx, "half"), f.Enabled(ctx, "half"))
+	}
+	assert.InDelta(t, 500, on, 60)
+}
+
+func TestVariant(t *testing.T) {
+	_, f := loadFlags(t, testFlags)
+	assert.Equal(t, "legacy", f.Variant(context.Background(), "path"))
+	assert.Equal(t, "streaming", f.Variant(user("allowed"), "path"))
+	assert.Equal(t, "", f.Variant(user("allowed"), "missing"))
+
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[f.Variant(user(fmt.Sprintf("user-%d", i)), "path")]++
+	}
+	assert.InDelta(t, 500, counts["legacy"], 60)
+	assert.InDelta(t, 300, counts["chunked"], 60)
+	assert.InDelta(t, 200, counts["streaming"], 60)
+}
+
+// spanRecorder keeps the spans that are exported.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestSpanAttributes(t *testing.T) {
+	_, f := loadFlags(t, testFlags)
+	r := &spanRecorder{}
+	trace.RegisterExporter(r)
+	defer trace.UnregisterExporter(r)
+
+	ctx, span := trace.StartSpan(user("allowed"), "test", trace.WithSampler(trace.AlwaysSample()))
+	f.Enabled(ctx, "half")
+	f.Enabled(ctx, "missing")
+	f.Variant(ctx, "path")
+	span.End()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if assert.Len(t, r.spans, 1) {
+		assert.Equal(t, map[string]interface{}{
+			"flag.half":    true,
+			"flag.missing": false,
+			"flag.path":    "streaming",
+		}, r.spans[0].Attributes)
+	}
+}
+
+func TestInvalidFlags(t *testing.T) {
+	for _, body := range []string{
+		`{"flags": {"x": "yes"}}`,
+		`{"flags": {"x": {"percentage": 150}}}`,
+		`{"flags": {"x": {"allow": "user"}}}`,
+		`{"flags": {"x": {"colour": "blue"}}}`,
+		`{"flags": {"x": {"variants": {"a": 60, "b": 60}, "default": "c"}}}`,
+		`{"flags": {"x": {"variants": {"a": 10}}}}`,
+		`{"flags": {"x": {"variants": {"a": 10}, "default": "b", "overrides": {"u": "c"}}}}`,
+	} {
+		_, err := parse(autoconfigtest.Load(t, body))
+		assert.NotNil(t, err, body)
+	}
+}
+
+func TestReload(t *testing.T) {
+	autoconfig.Fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "flags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{"flags": {"x": false}}`), 0644)
+	config, err := autoconfig.Load(context.Background(), autoconfig.File(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config.Watch(ctx)
+	assert.False(t, f.Enabled(context.Background(), "x"))
+
+	// An invalid flag is rejected, then a valid change is applied.
+	ioutil.WriteFile(filename, []byte(`{"flags": {"x": "yes"}}`), 0644)
+	autoconfigtest.WaitForReload(config, 1)
+	assert.False(t, f.Enabled(context.Background(), "x"))
+	ioutil.WriteFile(filename, []byte(`{"flags": {"x": true}}`), 0644)
+	autoconfigtest.WaitForReload(config, 2)
+	assert.True(t, f.Enabled(context.Background(), "x"))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/logging"
+)
+
+// sinksConfig is the section of the configuration containing the access log sinks.
+const sinksConfig = "access_log.sinks"
+
+// createAccessLog creates the access log middleware, and keeps its sinks up to date as the configuration changes.
+func (s *DocumentService) createAccessLog(config *autoconfig.Config) (*logging.LogMiddleware, error) {
+	m := &logging.LogMiddleware{}
+	sink, err := s.accessLogSink(config)
+	if err != nil {
+		return nil, err
+	}
+	m.SetSink(sink)
+
+	settings := s.settings().AccessLog
+	if err := m.SetRedaction(settings.Redaction); err != nil {
+		return nil, err
+	}
+	if err := m.SetSampling(settings.Sampling); err != nil {
+		return nil, err
+	}
+	var spool *logging.Spool
+	if settings.SpoolDir != "" {
+		spool, err = logging.OpenSpool(settings.SpoolDir, logging.SpoolOptions{MaxBytes: settings.SpoolMaxBytes})
+		if err != nil {
+			return nil, err
+		}
+	}
+	m.Shipper, err = logging.NewShipper(m.Write, logging.ShipperOptions{
+		QueueSize:     settings.QueueSize,
+		BatchSize:     settings.BatchSize,
+		FlushInterval: settings.FlushInterval,
+		Workers:       settings.Workers,
+		Overflow:      logging.Overflow(settings.Overflow),
+		Spool:         spool,
+		RetryInterval: settings.RetryInterval,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	config.AddValidator(func(old, new *autoconfig.Config) error {
+		_, err := logging.ParseSinks(new, sinksConfig)
+		return err
+	})
+	update := func(old, new *autoconfig.Config, changed []string) {
+		sink, err := s.accessLogSink(new)
+		if err != nil {
+			logger.Errorf(context.Background(), "Error creating access log sinks, keeping existing sinks: %v", err)
+			return
+		}
+		logger.Infof(context.Background(), "Access log configuration changed: %v", changed)
+		if err := m.SetSink(sink).Close(); err != nil {
+			logger.Warningf(context.Background(), "Error closing access log sink: %v", err)
+		}
+	}
+	config.OnChange(sinksConfig, update)
+	// The default sink uses the BigQuery settings.
+	config.OnChange("bigquery", update)
+	config.OnChange("access_log.redaction", func(old, new *autoconfig.Config, changed []string) {
+		if err := m.SetRedaction(s.settings().AccessLog.Redaction); err != nil {
+			logger.Errorf(context.Background(), "Error changing access log redaction, keeping existing policy: %v", err)
+			return
+		}
+		logger.Infof(context.Background(), "Access log redaction changed: %v", changed)
+	})
+	config.OnChange("access_log.sampling", func(old, new *autoconfig.Config, changed []string) {
+		if err := m.SetSampling(s.settings().AccessLog.Sampling); err != nil {
+			logger.Errorf(context.Background(), "Error changing access log sampling, keeping existing policy: %v", err)
+			return
+		}
+		logger.Infof(context.Background(), "Access log sampling changed: %v", changed)
+	})
+
+	s.accessLog = m
+	return m, nil
+}
+
+// accessLogSink creates the sinks in the access_log.sinks section of config. BigQuery sinks default to the dataset,
+// log table and timeout in the bigquery section. If no sinks are configured, entries are written to that table.
+func (s *DocumentService) accessLogSink(config *autoconfig.Config) (logging.Sink, error) {
+	var settings Settings
+	if err := config.Bind("", &settings); err != nil {
+		return nil, err
+	}
+	configs, err := logging.ParseSinks(config, sinksConfig)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		configs["bigquery"] = &logging.SinkConfig{Type: "bigquery"}
+	}
+	sinks := make(logging.FanOut)
+	for name, c := range configs {
+		if c.Type == "bigquery" {
+			if c.Dataset == "" {
+				c.Dataset = settings.BigQuery.Dataset
+			}
+			if c.Table == "" {
+				c.Table = settings.BigQuery.LogTable
+			}
+			if !config.Has(sinksConfig + "." + name + ".timeout") {
+				c.Timeout = settings.BigQuery.Timeout
+			}
+		}
+		sink, err := c.New(s.bigquery, os.Stdout)
+		if err != nil {
+			return nil, fmt.Errorf("access log sink %q: %v", name, err)
+		}
+		sinks[name] = sink
+	}
+	// An in-memory activity store sees every entry, whatever sinks are configured.
+	if m, ok := s.activity.(*logging.MemoryActivity); ok {
+		sinks[activitySink] = m
+	}
+	if len(sinks) == 1 {
+		for _, sink := range sinks {
+			return sink, nil
+		}
+	}
+	return sinks, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/metadata"
+	"github.com/dparrish/build-web-application-demo/swagger"
+
+	"cloud.google.com/go/storage"
+	"go.opencensus.io/trace"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// DeleteAccount deletes the logged-in user's account.
+func (s *DocumentService) DeleteAccount(w http.ResponseWriter, r *http.Request) {
+	userid := gcontext.Get(r, "userid").(string)
+	s.deleteAccount(w, r, userid, userid)
+}
+
+// AdminDeleteAccount deletes any user's account.
+func (s *DocumentService) AdminDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	admin := gcontext.Get(r, "userid").(string)
+	s.deleteAccount(w, r, mux.Vars(r)["userid"], admin)
+}
+
+// AdminGetAccountDeletion returns the deletion record for a user, which shows whether the deletion has completed.
+func (s *DocumentService) AdminGetAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.AdminGetAccountDeletion", packagePath))
+	defer reqSpan.End()
+
+	d, err := metadata.GetDeletion(reqCtx, s.spanner, mux.Vars(r)["userid"])
+	if err != nil {
+		swagger.Errorf(w, http.StatusNotFound, "No deletion found for user")
+		return
+	}
+	json.NewEncoder(w).Encode(d)
+}
+
+// AdminFlushKeyCache evicts every data encryption key cached by this replica.
+func (s *DocumentService) AdminFlushKeyCache(w http.ResponseWriter, r *http.Request) {
+	n := metadata.FlushKeyCache()
+	logger.Infof(r.Context(), "Flushed %d keys from the encryption key cache, requested by %q", n, gcontext.Get(r, "userid"))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "flushed": n})
+}
+
+// checkAccount writes an error response and returns false if the user's account has been deleted. Requests for
+// documents that don't use the user's data encryption key must check this before touching storage, as the check in
+// GetEncryptionKey doesn't happen for them.
+func (s *DocumentService) checkAccount(ctx context.Context, w http.ResponseWriter, userid string) bool {
+	err := metadata.CheckAccount(ctx, s.spanner, userid)
+	if err == metadata.ErrAccountDeleted {
+		swagger.Errorf(w, http.StatusGone, "Account has been deleted")
+		return false
+	}
+	if err != nil {
+		logger.Errorf(ctx, "Error checking account of user %q: %v", userid, err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error checking account")
+		return false
+	}
+	return true
+}
+
+// deleteAccount crypto-shreds a user account by destroying the data encryption key. This happens synchronously so that
+// all the user's data is unrecoverable as soon as the request returns, except through other replicas that have the key
+// cached, which drop it within account.deletion_poll_interval. The blobs and metadata are removed in the background.
+func (s *DocumentService) deleteAccount(w http.ResponseWriter, r *http.Request, userid, requestedBy string) {
+	// Record trace.
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.DeleteAccount", packagePath))
+	defer reqSpan.End()
+	reqSpan.AddAttributes(
+		trace.StringAttribute("userid", userid),
+		trace.StringAttribute("requested_by", requestedBy),
+	)
+
+	ctx, cancel := context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
+	defer cancel()
+	d, err := metadata.ShredUser(ctx, s.spanner, userid, requestedBy)
+	if err != nil {
+		logger.Errorf(reqCtx, "Error deleting account of user %q: %v", userid, err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error deleting account")
+		return
+	}
+	logger.Infof(reqCtx, "Destroyed encryption key for user %q, requested by %q", userid, requestedBy)
+
+	if !d.Completed.Valid {
+		go s.purgeAccount(context.Background(), userid)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
+
+// resumeDeletions restarts the purge of any account deletions that were interrupted, such as by a restart.
+func (s *DocumentService) resumeDeletions(ctx context.Context) {
+	deletions, err := s.accounts.pendingDeletions(ctx)
+	if err != nil {
+		logger.Errorf(ctx, "Error fetching pending account deletions: %v", err)
+		return
+	}
+	for _, d := range deletions {
+		s.purgeAccount(ctx, d.UserID)
+	}
+}
+
+// purgeAccount removes every blob and metadata row belonging to a user whose encryption key has been destroyed, then
+// records the deletion as complete.
+// The completion record contains a SHA-256 digest of the sorted object IDs that were removed.
+func (s *DocumentService) purgeAccount(ctx context.Context, userid string) {
+	rows, err := s.accounts.listDocuments(ctx, userid)
+	if err != nil {
+		logger.Errorf(ctx, "Error listing documents to purge for user %q: %v", userid, err)
+		return
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].ID < rows[j].ID })
+
+	hash := sha256.New()
+	for _, row := range rows {
+		if err := s.accounts.deleteDocument(ctx, row.ID); err != nil {
+			logger.Warningf(ctx, "Error deleting document %q for user %q, purge will be retried on restart: %v", row.ID, userid, err)
+			return
+		}
+		fmt.Fprintln(hash, row.ID)
+	}
+
+	digest := hex.EncodeToString(hash.Sum(nil))
+	if err := s.accounts.completeDeletion(ctx, userid, int64(len(rows)), digest); err != nil {
+		logger.Errorf(ctx, "Error completing account deletion for user %q: %v", userid, err)
+		return
+	}
+	logger.Infof(ctx, "Completed deletion of user %q, removed %d documents", userid, len(rows))
+}
+
+// accountStore holds the documents and deletion records of accounts. It is an interface so that purging deleted
+// accounts can be tested without Spanner and Cloud Storage.
+type accountStore interface {
+	pendingDeletions(ctx context.Context) ([]*metadata.Deletion, error)
+	listDocuments(ctx context.Context, userid string) ([]metadata.Row, error)
+	// deleteDocument removes the blob and metadata row of a document. A blob that has already gone isn't an error.
+	deleteDocument(ctx context.Context, id string) error
+	completeDeletion(ctx context.Context, userid string, objects int64, digest string) error
+}
+
+// cloudAccountStore keeps documents in Cloud Storage and Spanner.
+type cloudAccountStore struct {
+	s *DocumentService
+}
+
+func (c *cloudAccountStore) pendingDeletions(ctx context.Context) ([]*metadata.Deletion, error) {
+	return metadata.PendingDeletions(ctx, c.s.spanner)
+}
+
+func (c *cloudAccountStore) listDocuments(ctx context.Context, userid string) ([]metadata.Row, error) {
+	return metadata.ListForUser(ctx, c.s.spanner, userid)
+}
+
+func (c *cloudAccountStore) deleteDocument(ctx context.Context, id string) error {
+	bucket := c.s.storage.Bucket(c.s.settings().Storage.Bucket)
+	if err := bucket.Object(id).Delete(ctx); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("error deleting blob: %v", err)
+	}
+	if err := metadata.Delete(ctx, c.s.spanner, id); err != nil {
+		return fmt.Errorf("error deleting metadata: %v", err)
+	}
+	return nil
+}
+
+func (c *cloudAccountStore) completeDeletion(ctx context.Context, userid string, objects int64, digest string) error {
+	return metadata.CompleteDeletion(ctx, c.s.spanner, userid, objects, digest)
+}
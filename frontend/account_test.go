@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/metadata"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAccountStore keeps documents and deletion records in memory. Deleting a document in broken fails.
+type fakeAccountStore struct {
+	mu        sync.Mutex
+	documents map[string]string // Owner of each document, by ID.
+	pending   []*metadata.Deletion
+	completed map[string]*metadata.Deletion
+	broken    map[string]bool
+}
+
+func newFakeAccountStore(documents map[string]string) *fakeAccountStore {
+	return &fakeAccountStore{
+		documents: documents,
+		completed: make(map[string]*metadata.Deletion),
+		broken:    make(map[string]bool),
+	}
+}
+
+func (s *fakeAccountStore) pendingDeletions(ctx context.Context) ([]*metadata.Deletion, error) {
+	return s.pending, nil
+}
+
+func (s *fakeAccountStore) listDocuments(ctx context.Context, userid string) ([]metadata.Row, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows []metadata.Row
+	for id, owner := range s.documents {
+		if owner == userid {
+			rows = append(rows, metadata.Row{ID: id, UserID: owner})
+		}
+	}
+	return rows, nil
+}
+
+func (s *fakeAccountStore) deleteDocument(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.broken[id] {
+		return errors.New("unavailable")
+	}
+	delete(s.documents, id)
+	return nil
+}
+
+func (s *fakeAccountStore) completeDeletion(ctx context.Context, userid string, objects int64, digest string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed[userid] = &metadata.Deletion{UserID: userid, ObjectsDeleted: objects, Digest: digest}
+	return nil
+}
+
+func digestOf(ids ...string) string {
+	hash := sha256.New()
+	for _, id := range ids {
+		hash.Write([]byte(id + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func TestPurgeAccount(t *testing.T) {
+	store := newFakeAccountStore(map[string]string{"b": "user1", "a": "user1", "c": "user2"})
+	s := &DocumentService{accounts: store}
+	s.purgeAccount(context.Background(), "user1")
+
+	// Only the user's documents are removed, and the digest covers their sorted IDs.
+	assert.Equal(t, map[string]string{"c": "user2"}, store.documents)
+	if assert.Contains(t, store.completed, "user1") {
+		assert.Equal(t, int64(2), store.completed["user1"].ObjectsDeleted)
+		assert.Equal(t, digestOf("a", "b"), store.completed["user1"].Digest)
+	}
+}
+
+func TestPurgeAccountFailure(t *testing.T) {
+	store := newFakeAccountStore(map[string]string{"a": "user1", "b": "user1"})
+	store.broken["b"] = true
+	s := &DocumentService{accounts: store}
+	s.purgeAccount(context.Background(), "user1")
+
+	// The deletion isn't completed while documents remain, so that it is resumed later.
+	assert.Equal(t, map[string]string{"b": "user1"}, store.documents)
+	assert.NotContains(t, store.completed, "user1")
+
+	store.broken["b"] = false
+	s.purgeAccount(context.Background(), "user1")
+	assert.Empty(t, store.documents)
+	if assert.Contains(t, store.completed, "user1") {
+		assert.Equal(t, int64(1), store.completed["user1"].ObjectsDeleted)
+	}
+}
+
+func TestResumeDeletions(t *testing.T) {
+	store := newFakeAccountStore(map[string]string{"a": "user1", "b": "user2", "c": "user3"})
+	store.pending = []*metadata.Deletion{{UserID: "user1"}, {UserID: "user2"}}
+	s := &DocumentService{accounts: store}
+	s.resumeDeletions(context.Background())
+
+	assert.Equal(t, map[string]string{"c": "user3"}, store.documents)
+	assert.Contains(t, store.completed, "user1")
+	assert.Contains(t, store.completed, "user2")
+	assert.NotContains(t, store.completed, "user3")
+}
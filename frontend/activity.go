@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/logging"
+	"github.com/dparrish/build-web-application-demo/metadata"
+	"github.com/dparrish/build-web-application-demo/swagger"
+
+	"go.opencensus.io/trace"
+
+	"github.com/gorilla/mux"
+)
+
+// activitySink is the name of the sink that feeds an in-memory activity store. It contains a dot so that it can't
+// clash with the name of a configured sink.
+const activitySink = "access_log.activity"
+
+// maxActivityEntries is the most entries returned by an activity request at once.
+const maxActivityEntries = 1000
+
+// createActivityStore creates the store that answers activity requests from the access log.
+func (s *DocumentService) createActivityStore() (logging.ActivityStore, error) {
+	settings := s.settings()
+	switch settings.AccessLog.Activity.Store {
+	case "bigquery":
+		return &logging.BigQueryActivity{
+			Client:  s.bigquery,
+			Table:   s.bigquery.Dataset(settings.BigQuery.Dataset).Table(settings.BigQuery.LogTable),
+			Timeout: settings.AccessLog.Activity.Timeout,
+		}, nil
+	case "memory":
+		return logging.NewMemoryActivity(settings.AccessLog.Activity.MaxEntries), nil
+	default:
+		return nil, fmt.Errorf("unknown access_log.activity.store %q", settings.AccessLog.Activity.Store)
+	}
+}
+
+// createActivityLimit limits the activity requests that each user may make, as each one may read a lot of the access
+// log. The limit is replaced whenever the access_log.activity configuration changes.
+func (s *DocumentService) createActivityLimit() {
+	update := func() {
+		settings := s.settings().AccessLog.Activity
+		s.activityLimit.Store(logging.NewUserLimiter(settings.UserRate, settings.UserBurst))
+	}
+	update()
+	s.config.OnChange("access_log.activity", func(old, new *autoconfig.Config, changed []string) {
+		logger.Infof(context.Background(), "Activity configuration changed: %v", changed)
+		update()
+	})
+}
+
+// DocumentActivity returns the requests made for one of the logged-in user's documents, and a summary of them.
+func (s *DocumentService) DocumentActivity(w http.ResponseWriter, r *http.Request) {
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.DocumentActivity", packagePath))
+	defer reqSpan.End()
+
+	q, ok := s.activityQuery(w, r)
+	if !ok {
+		return
+	}
+	// Only the owner of a document may see who has accessed it.
+	q.DocumentID = mux.Vars(r)["id"]
+	ctx, cancel := context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
+	defer cancel()
+	if _, err := metadata.Get(ctx, s.spanner, actor(r), q.DocumentID); err != nil {
+		swagger.Errorf(w, http.StatusNotFound, "Invalid object ID")
+		return
+	}
+	s.writeActivity(reqCtx, w, q)
+}
+
+// AccountActivity returns the requests made by the logged-in user, and a summary of them.
+func (s *DocumentService) AccountActivity(w http.ResponseWriter, r *http.Request) {
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.AccountActivity", packagePath))
+	defer reqSpan.End()
+
+	q, ok := s.activityQuery(w, r)
+	if !ok {
+		return
+	}
+	q.UserID = actor(r)
+	s.writeActivity(reqCtx, w, q)
+}
+
+// activityQuery parses the since, until, interval, offset and limit parameters of an activity request. The range
+// defaults to the last 30 days, and is limited to access_log.activity.max_range. If the user has made too many
+// activity requests or the parameters are invalid, an error response is written and false is returned.
+func (s *DocumentService) activityQuery(w http.ResponseWriter, r *http.Request) (*logging.ActivityQuery, bool) {
+	if !s.activityLimit.Load().(*logging.UserLimiter).Allow(actor(r)) {
+		swagger.Errorf(w, http.StatusTooManyRequests, "Too many activity requests, try again later")
+		return nil, false
+	}
+	params := r.URL.Query()
+	q := &logging.ActivityQuery{Until: time.Now().UTC(), Interval: 24 * time.Hour, Limit: 100}
+	var err error
+	if v := params.Get("until"); v != "" {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid until parameter, must be an RFC 3339 time")
+			return nil, false
+		}
+	}
+	q.Since = q.Until.Add(-30 * 24 * time.Hour)
+	if v := params.Get("since"); v != "" {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid since parameter, must be an RFC 3339 time")
+			return nil, false
+		}
+	}
+	if !q.Until.After(q.Since) {
+		swagger.Errorf(w, http.StatusBadRequest, "The until parameter must be after since")
+		return nil, false
+	}
+	if max := s.settings().AccessLog.Activity.MaxRange; q.Until.Sub(q.Since) > max {
+		swagger.Errorf(w, http.StatusBadRequest, "The time range may not be longer than %s", max)
+		return nil, false
+	}
+	switch params.Get("interval") {
+	case "", "day":
+	case "hour":
+		q.Interval = time.Hour
+	default:
+		swagger.Errorf(w, http.StatusBadRequest, "Invalid interval parameter, must be hour or day")
+		return nil, false
+	}
+	if v := params.Get("offset"); v != "" {
+		if q.Offset, err = strconv.Atoi(v); err != nil || q.Offset < 0 {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid offset parameter")
+			return nil, false
+		}
+	}
+	if v := params.Get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxActivityEntries {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid limit parameter, must be between 1 and %d", maxActivityEntries)
+			return nil, false
+		}
+	}
+	return q, true
+}
+
+func (s *DocumentService) writeActivity(ctx context.Context, w http.ResponseWriter, q *logging.ActivityQuery) {
+	activity, err := s.activity.Activity(ctx, q)
+	if err != nil {
+		logger.Errorf(ctx, "Error querying activity: %v", err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error querying activity")
+		return
+	}
+	json.NewEncoder(w).Encode(activity)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/audit"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/middleware"
+	"github.com/dparrish/build-web-application-demo/swagger"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/trace"
+
+	gcontext "github.com/gorilla/context"
+	"github.com/gorilla/mux"
+)
+
+// auditTimeout is the time allowed for writing an audit event after the request has been handled. It doesn't depend
+// on the request, so that an event is still written if the client goes away.
+const auditTimeout = 10 * time.Second
+
+// auditFailures counts the audit events that couldn't be written, which are missing from the audit trail. The
+// audit-failures alert policy in the deployment fires when it increases.
+var auditFailures = stats.Int64("frontend/measure/audit_failures", "Number of audit events that couldn't be written", "1")
+
+type auditEventKey struct{}
+
+// setAuditDocument records the document that a request acts on in its audit event, for requests that don't have the
+// document ID in the URL.
+func setAuditDocument(ctx context.Context, id string) {
+	if e, ok := ctx.Value(auditEventKey{}).(*audit.Event); ok {
+		e.DocumentID = id
+	}
+}
+
+// statusWriter keeps the status code of the response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// actor returns the logged-in user, whose own documents and account are being acted on.
+func actor(r *http.Request) string {
+	userid, _ := gcontext.Get(r, "userid").(string)
+	return userid
+}
+
+// targetUser returns the user that an administrator is acting on.
+func targetUser(r *http.Request) string {
+	return mux.Vars(r)["userid"]
+}
+
+// audited writes an audit event for every request handled by next, in the partition of the user returned by
+// partition. It must be used inside authentication.Middleware or authentication.Admin.
+func (s *DocumentService) audited(action audit.Action, partition func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := &audit.Event{
+			Partition:  partition(r),
+			Actor:      actor(r),
+			Action:     action,
+			DocumentID: mux.Vars(r)["id"],
+			RequestID:  middleware.GetRequestID(r.Context()),
+		}
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), auditEventKey{}, e)))
+
+		if sw.code == 0 {
+			sw.code = http.StatusOK
+		}
+		e.Outcome = audit.OutcomeOf(sw.code)
+		ctx, cancel := context.WithTimeout(context.Background(), auditTimeout)
+		defer cancel()
+		if err := s.audit.Append(ctx, e); err != nil {
+			stats.Record(ctx, auditFailures.M(1))
+			logger.Errorf(r.Context(), "Error writing audit event %+v: %v", e, err)
+		}
+	}
+}
+
+// maxAuditEvents is the most events returned by GetAudit at once.
+const maxAuditEvents = 1000
+
+// GetAudit returns the audit trail for the logged-in user's documents and account, oldest first. It is paged by
+// passing the returned next value as the after parameter.
+func (s *DocumentService) GetAudit(w http.ResponseWriter, r *http.Request) {
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.GetAudit", packagePath))
+	defer reqSpan.End()
+
+	after, limit := int64(0), 100
+	var err error
+	if v := r.URL.Query().Get("after"); v != "" {
+		if after, err = strconv.ParseInt(v, 10, 64); err != nil || after < 0 {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid after parameter")
+			return
+		}
+	}
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxAuditEvents {
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid limit parameter, must be between 1 and %d", maxAuditEvents)
+			return
+		}
+	}
+	document := r.URL.Query().Get("document")
+
+	events, err := s.audit.Events(reqCtx, actor(r), after, limit)
+	if err != nil {
+		logger.Errorf(reqCtx, "Error reading audit events: %v", err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error reading audit events")
+		return
+	}
+	response := struct {
+		Events []*audit.Event `json:"events"`
+		Next   int64          `json:"next,omitempty"`
+	}{Events: []*audit.Event{}}
+	for _, e := range events {
+		if document == "" || e.DocumentID == document {
+			response.Events = append(response.Events, e)
+		}
+	}
+	// A full page means there may be more events, even if none of this page matched the document.
+	if len(events) == limit {
+		response.Next = events[len(events)-1].Sequence
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// AdminVerifyAudit checks the integrity of the audit trail of one user, given by the userid parameter, or of every
+// user.
+func (s *DocumentService) AdminVerifyAudit(w http.ResponseWriter, r *http.Request) {
+	reqCtx, reqSpan := trace.StartSpan(r.Context(), fmt.Sprintf("%s.AdminVerifyAudit", packagePath))
+	defer reqSpan.End()
+
+	var reports []*audit.Report
+	var err error
+	if userid := r.URL.Query().Get("userid"); userid != "" {
+		var report *audit.Report
+		if report, err = audit.Verify(reqCtx, s.audit, s.auditKey, userid); err == nil {
+			reports = append(reports, report)
+		}
+	} else {
+		reports, err = audit.VerifyAll(reqCtx, s.audit, s.auditKey)
+	}
+	if err != nil {
+		logger.Errorf(reqCtx, "Error verifying audit trail: %v", err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error verifying audit trail")
+		return
+	}
+
+	ok := true
+	for _, report := range reports {
+		if len(report.Problems) > 0 {
+			ok = false
+			logger.Errorf(reqCtx, "Audit trail of user %q is damaged, requested by %q: %+v", report.Partition, actor(r), report.Problems)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": ok, "partitions": reports})
+}
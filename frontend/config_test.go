@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestConfigSchema checks the shipped configuration files against config_schema.json, without their secrets.
+func TestConfigSchema(t *testing.T) {
+	body, err := ioutil.ReadFile("../config_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := autoconfig.ParseSchema(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bucket is a placeholder that is filled in when deploying, and isn't a valid name until then.
+	set, err := autoconfig.Set([]string{"storage.bucket=example-prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := autoconfig.CheckWithSchema(context.Background(), schema, autoconfig.File("../config.json"), autoconfig.File("../config-prod.json"), set)
+	if assert.Nil(t, err) {
+		assert.Nil(t, config.Bind("", &Settings{}))
+		assert.Equal(t, "secret://file/etc/secrets/audit-hmac-key", config.Get("audit.hmac_key"))
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/dparrish/build-web-application-demo/maintenance"
+
+	health "github.com/docker/go-healthcheck"
+)
+
+// HealthCheck reports whether the server is healthy. It is used as the liveness check, so it never fails because of
+// maintenance, but the maintenance mode is reported in the response headers.
+func (s *DocumentService) HealthCheck(w http.ResponseWriter, r *http.Request) {
+	if mode := s.maintenance.State().Mode; mode != maintenance.Off {
+		w.Header().Set(maintenance.Header, string(mode))
+	}
+	health.StatusHandler(w, r)
+}
+
+// ReadinessCheck reports whether the server should receive traffic. It fails while the server is draining, so that it
+// is taken out of the load balancer.
+func (s *DocumentService) ReadinessCheck(w http.ResponseWriter, r *http.Request) {
+	if s.maintenance.State().Mode == maintenance.Drain {
+		s.maintenance.Reject(w)
+		return
+	}
+	s.HealthCheck(w, r)
+}
@@ -7,16 +7,26 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/dparrish/build-web-application-demo/audit"
 	"github.com/dparrish/build-web-application-demo/authentication"
 	"github.com/dparrish/build-web-application-demo/autoconfig"
 	"github.com/dparrish/build-web-application-demo/encryption"
+	"github.com/dparrish/build-web-application-demo/flags"
+	"github.com/dparrish/build-web-application-demo/logger"
 	"github.com/dparrish/build-web-application-demo/logging"
+	"github.com/dparrish/build-web-application-demo/maintenance"
 	"github.com/dparrish/build-web-application-demo/metadata"
 	"github.com/dparrish/build-web-application-demo/middleware"
 	"github.com/dparrish/build-web-application-demo/swagger"
@@ -29,8 +39,8 @@ import (
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 	"go.opencensus.io/trace"
+	"golang.org/x/oauth2/google"
 
-	health "github.com/docker/go-healthcheck"
 	"github.com/google/uuid"
 	gcontext "github.com/gorilla/context"
 	"github.com/gorilla/handlers"
@@ -38,12 +48,50 @@ import (
 )
 
 var (
-	configFile  = flag.String("config", "", "Configuration file location")
-	warmSpanner = flag.Bool("warm_spanner", false, "Send a warming query to spanner on startup")
+	configFiles  stringList
+	configSet    stringList
+	configDir    = flag.String("config_dir", "", "Directory containing one file per configuration value, merged over the configuration files")
+	configURL    = flag.String("config_url", "", "URL of a JSON configuration, polled for changes and merged over the configuration files")
+	configEnv    = flag.String("config_env_prefix", "WAS_", "Prefix of environment variables that override configuration values")
+	secretStore  = flag.String("secret_store_url", "", "Base URL of the secret store used for secret://gcp/ config values, e.g. https://secretmanager.googleapis.com/v1/projects/[PROJECT]/secrets")
+	configSchema = flag.String("config_schema", "config_schema.json", "JSON Schema that the configuration is validated against when it is loaded, on every reload and by --check-config")
+	checkConfig  = flag.Bool("check-config", false, "Validate the configuration against the schema and exit, with a non-zero status if it is invalid. Secret references are not resolved")
+	printConfig  = flag.Bool("print_config", false, "Print the effective configuration and where each value came from, then exit")
+	warmSpanner  = flag.Bool("warm_spanner", false, "Send a warming query to spanner on startup")
 )
 
+func init() {
+	flag.Var(&configFiles, "config", "Configuration file location. May be repeated, later files are merged over earlier ones")
+	flag.Var(&configSet, "set", "Override a configuration value, as key=value. May be repeated")
+}
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 const packagePath = "github.com/dparrish/build-web-application-demo/frontend"
 
+// shutdownTimeout is the time allowed for requests to finish and buffered access logs to be written after a SIGTERM.
+// Kubernetes kills the pod 30 seconds after sending SIGTERM.
+const shutdownTimeout = 25 * time.Second
+
+// clientEncryptedHeader is set on document responses when the document was encrypted by the client before upload.
+const clientEncryptedHeader = "X-Client-Encrypted"
+
+// keyCacheSweepInterval is how often expired data encryption keys are removed from memory.
+const keyCacheSweepInterval = 30 * time.Second
+
+// maxNameLength is the longest document name that fits in the Name column of the Metadata table.
+const maxNameLength = 255
+
 type DocumentService struct {
 	// Cloud API Clients
 	config   *autoconfig.Config
@@ -60,6 +108,15 @@ type DocumentService struct {
 
 	Handler    *mux.Router // The http.Handler responsible for all the requests.
 	encryption *encryption.Envelope
+
+	boundSettings *autoconfig.Binding // Contains *Settings, use settings() to access.
+	audit         audit.Store
+	auditKey      []byte
+	accounts      accountStore
+	activity      logging.ActivityStore
+	activityLimit atomic.Value // *logging.UserLimiter
+	maintenance   *maintenance.Maintenance
+	accessLog     *logging.LogMiddleware
 }
 
 var (
@@ -73,23 +130,103 @@ func NewDocumentService(config *autoconfig.Config, ctx context.Context) (*Docume
 		config:  config,
 		Handler: mux.NewRouter(),
 	}
+	if err := s.loadSettings(); err != nil {
+		return nil, err
+	}
 	s.createClients(ctx)
+	s.accounts = &cloudAccountStore{s}
+	s.auditKey = []byte(s.settings().Audit.HMACKey)
+	if len(s.auditKey) == 0 {
+		logger.Warningf(ctx, "audit.hmac_key is not set, audit events will be hashed without a key")
+	}
+	s.audit = &audit.SpannerStore{Client: s.spanner, Timeout: s.settings().Spanner.Timeout, Key: s.auditKey}
+	activity, err := s.createActivityStore()
+	if err != nil {
+		return nil, err
+	}
+	s.activity = activity
+	s.createActivityLimit()
+	if err := s.createKeyCache(); err != nil {
+		return nil, err
+	}
+	f, err := flags.New(config)
+	if err != nil {
+		return nil, err
+	}
+	flags.SetDefault(f)
+
+	// Health checks, logging in and the admin endpoints that don't modify any data keep working during maintenance,
+	// so that maintenance can be monitored and the configuration rolled back. Every route below must be listed here,
+	// or it is blocked in read_only mode.
+	s.maintenance, err = maintenance.New(config, map[string]maintenance.Access{
+		"healthcheck":             maintenance.Exempt,
+		"readinesscheck":          maintenance.Exempt,
+		"debugConfig":             maintenance.Exempt,
+		"login":                   maintenance.Exempt,
+		"list":                    maintenance.Reads,
+		"upload":                  maintenance.Writes,
+		"get":                     maintenance.Reads,
+		"delete":                  maintenance.Writes,
+		"documentActivity":        maintenance.Reads,
+		"deleteAccount":           maintenance.Writes,
+		"accountActivity":         maintenance.Reads,
+		"audit":                   maintenance.Reads,
+		"adminGetAccountDeletion": maintenance.Reads,
+		"adminDeleteAccount":      maintenance.Writes,
+		"adminVerifyAudit":        maintenance.Exempt,
+		"adminFlushKeyCache":      maintenance.Exempt,
+		"adminRollbackConfig":     maintenance.Exempt,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Every request gets an ID and a trace span first, so that everything logged while handling it can be correlated.
+	s.Handler.Use(middleware.RequestID)
+	s.Handler.Use(s.maintenance.Middleware)
 
 	// These is the un-authenticated endpoint that handles authentication with Auth0.
-	s.Handler.HandleFunc("/debug/health", health.StatusHandler).Methods("GET")
-	s.Handler.Handle("/login", middleware.JSON(authentication.Handler(config))).Methods("POST")
+	s.Handler.HandleFunc("/debug/health", s.HealthCheck).Methods("GET").Name("healthcheck")
+	s.Handler.HandleFunc("/debug/ready", s.ReadinessCheck).Methods("GET").Name("readinesscheck")
+	s.Handler.Handle("/debug/config", authentication.Admin(config, config.DebugHandler().ServeHTTP)).Methods("GET").Name("debugConfig")
+	s.Handler.Handle("/login", middleware.JSON(authentication.Handler(config))).Methods("POST").Name("login")
 
 	// These requests all require authentication.
-	logMiddleware := logging.LogMiddleware{
-		Table: s.bigquery.Dataset(config.Get("bigquery.dataset")).Table(config.Get("bigquery.log_table")),
+	logMiddleware, err := s.createAccessLog(config)
+	if err != nil {
+		return nil, err
 	}
 	authRouter := s.Handler.PathPrefix("/document").Subrouter()
-	authRouter.Handle("/", middleware.JSON(authentication.Middleware(config, s.ListDocuments))).Methods("GET")
-	authRouter.Handle("/", middleware.JSON(authentication.Middleware(config, s.UploadDocument))).Methods("POST")
-	authRouter.Handle("/{id}", authentication.Middleware(config, s.GetDocument)).Methods("GET")
-	authRouter.Handle("/{id}", middleware.JSON(authentication.Middleware(config, s.DeleteDocument))).Methods("DELETE")
+	authRouter.Handle("/", middleware.JSON(authentication.Middleware(config, s.audited(audit.ListDocuments, actor, s.ListDocuments)))).Methods("GET").Name("list")
+	authRouter.Handle("/", middleware.JSON(authentication.Middleware(config, s.audited(audit.UploadDocument, actor, s.UploadDocument)))).Methods("POST").Name("upload")
+	authRouter.Handle("/{id}", authentication.Middleware(config, s.audited(audit.ReadDocument, actor, s.GetDocument))).Methods("GET").Name("get")
+	authRouter.Handle("/{id}", middleware.JSON(authentication.Middleware(config, s.audited(audit.DeleteDocument, actor, s.DeleteDocument)))).Methods("DELETE").Name("delete")
+	authRouter.Handle("/{id}/activity", middleware.JSON(authentication.Middleware(config, s.audited(audit.ReadActivity, actor, s.DocumentActivity)))).Methods("GET").Name("documentActivity")
 	authRouter.Use(logMiddleware.Middleware)
 	authRouter.Use(handlers.CompressHandler)
+
+	accountRouter := s.Handler.PathPrefix("/account").Subrouter()
+	accountRouter.Handle("", middleware.JSON(authentication.Middleware(config, s.audited(audit.DeleteAccount, actor, s.DeleteAccount)))).Methods("DELETE").Name("deleteAccount")
+	accountRouter.Handle("/activity", middleware.JSON(authentication.Middleware(config, s.audited(audit.ReadActivity, actor, s.AccountActivity)))).Methods("GET").Name("accountActivity")
+	accountRouter.Use(logMiddleware.Middleware)
+
+	auditRouter := s.Handler.PathPrefix("/audit").Subrouter()
+	auditRouter.Handle("", middleware.JSON(authentication.Middleware(config, s.audited(audit.ReadAudit, actor, s.GetAudit)))).Methods("GET").Name("audit")
+	auditRouter.Use(logMiddleware.Middleware)
+
+	// These requests require the user to be an administrator.
+	adminRouter := s.Handler.PathPrefix("/admin").Subrouter()
+	adminRouter.Handle("/account/{userid}", middleware.JSON(authentication.Admin(config, s.audited(audit.ReadDeletion, targetUser, s.AdminGetAccountDeletion)))).Methods("GET").Name("adminGetAccountDeletion")
+	adminRouter.Handle("/account/{userid}", middleware.JSON(authentication.Admin(config, s.audited(audit.DeleteAccount, targetUser, s.AdminDeleteAccount)))).Methods("DELETE").Name("adminDeleteAccount")
+	adminRouter.Handle("/audit/verify", middleware.JSON(authentication.Admin(config, s.AdminVerifyAudit))).Methods("GET").Name("adminVerifyAudit")
+	adminRouter.Handle("/keycache/flush", middleware.JSON(authentication.Admin(config, s.AdminFlushKeyCache))).Methods("POST").Name("adminFlushKeyCache")
+	adminRouter.Handle("/config/rollback", middleware.JSON(authentication.Admin(config, s.AdminRollbackConfig))).Methods("POST").Name("adminRollbackConfig")
+	adminRouter.Use(logMiddleware.Middleware)
+
+	// Finish removing data for any accounts whose deletion was interrupted, and keep the key cache in sync with
+	// deletions made by other replicas.
+	go s.resumeDeletions(ctx)
+	go metadata.WatchDeletions(ctx, s.spanner, s.settings().Account.DeletionPollInterval)
+	go metadata.SweepKeyCache(ctx, keyCacheSweepInterval)
 	return s, nil
 }
 
@@ -110,8 +247,8 @@ func (s *DocumentService) ListDocuments(w http.ResponseWriter, r *http.Request)
 
 	rows, err := metadata.ListForUser(ctx, s.spanner, userid)
 	if err != nil {
-		log.Print(err)
-		swagger.Errorf(w, http.StatusInternalServerError, err.Error())
+		logger.Errorf(reqCtx, "Error listing documents: %v", err)
+		swagger.Errorf(w, http.StatusInternalServerError, "%v", err)
 		return
 	}
 	stats.Record(ctx, s.metrics.documentCount.M(int64(len(rows))))
@@ -138,7 +275,7 @@ func (s *DocumentService) GetDocument(w http.ResponseWriter, r *http.Request) {
 		trace.StringAttribute("id", vars["id"]),
 	)
 
-	ctx, cancel := context.WithTimeout(reqCtx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
 	defer cancel()
 	mr, err := metadata.Get(ctx, s.spanner, userid, vars["id"])
 	if err != nil {
@@ -146,45 +283,85 @@ func (s *DocumentService) GetDocument(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	bucket := s.storage.Bucket(s.config.Get("storage.bucket"))
-	obj := bucket.Object(mr.ID)
-	reader, err := obj.NewReader(reqCtx)
+	// Documents uploaded with a customer-supplied key can only be read with the same key.
+	ek, _, err := encryption.CustomerKey(r.Header)
 	if err != nil {
-		log.Print(err)
-		swagger.Errorf(w, http.StatusInternalServerError, "Error reading blob")
+		swagger.Errorf(w, http.StatusBadRequest, "Invalid encryption key: %v", err)
 		return
 	}
-	defer reader.Close()
+	if mr.KeyFingerprint == "" && ek != nil {
+		swagger.Errorf(w, http.StatusBadRequest, "Document is not encrypted with a customer-supplied key")
+		return
+	}
+	if mr.KeyFingerprint != "" {
+		if ek == nil {
+			swagger.Errorf(w, http.StatusBadRequest, "Document requires a customer-supplied encryption key")
+			return
+		}
+		if !encryption.MatchFingerprint(ek, mr.KeyFingerprint) {
+			swagger.Errorf(w, http.StatusForbidden, "Encryption key does not match")
+			return
+		}
+	}
 
-	// Decrypt the Data Encryption Key using the Key Encryption Key (KMS).
-	ctx, cancel = context.WithTimeout(reqCtx, 10*time.Second)
+	ctx, cancel = context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
 	defer cancel()
-	ek, err := metadata.GetEncryptionKey(ctx, s.spanner, s.encryption, userid)
+	if ek == nil && !mr.ClientEncrypted {
+		// Decrypt the Data Encryption Key using the Key Encryption Key (KMS).
+		ek, err = metadata.GetEncryptionKey(ctx, s.spanner, s.encryption, userid)
+		if err == metadata.ErrAccountDeleted {
+			swagger.Errorf(w, http.StatusGone, "Account has been deleted")
+			return
+		}
+		if err != nil {
+			logger.Errorf(reqCtx, "Error getting encryption key: %v", err)
+			swagger.Errorf(w, http.StatusInternalServerError, "Error getting encryption key")
+			return
+		}
+	} else if !s.checkAccount(ctx, w, userid) {
+		return
+	}
+
+	bucket := s.storage.Bucket(s.settings().Storage.Bucket)
+	obj := bucket.Object(mr.ID)
+	reader, err := obj.NewReader(reqCtx)
 	if err != nil {
-		log.Print(err)
-		swagger.Errorf(w, http.StatusInternalServerError, "Error getting encryption key")
+		logger.Errorf(reqCtx, "Error reading blob %q: %v", mr.ID, err)
+		swagger.Errorf(w, http.StatusInternalServerError, "Error reading blob")
 		return
 	}
+	defer reader.Close()
 
 	// Send the file to the client.
 	w.Header().Set("Content-Type", mr.MimeType)
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", mr.Size))
+	if mr.ClientEncrypted {
+		w.Header().Set(clientEncryptedHeader, "true")
+	}
 	w.WriteHeader(http.StatusOK)
 
 	// Record the document age in the retrieval age distribution.
 	stats.Record(ctx, s.metrics.retrieveAge.M(time.Since(mr.Uploaded).Seconds()))
-	log.Printf("Recoring retrievel age of %s (%f seconds)", time.Since(mr.Uploaded), time.Since(mr.Uploaded).Seconds())
+	logger.Debugf(reqCtx, "Recording retrieval age of %s (%f seconds)", time.Since(mr.Uploaded), time.Since(mr.Uploaded).Seconds())
 
 	// Create an io.MultWriter to split off data as it streams. This is not necessary in this case but this can be used to
 	// do other operations on the streaming data in parallel with the decryption, such as hash verification.
 	mw := io.MultiWriter(w)
 
+	if mr.ClientEncrypted {
+		// The client encrypted the data itself, so send it back exactly as it was uploaded.
+		if _, err := io.Copy(mw, reader); err != nil {
+			logger.Errorf(reqCtx, "Error reading body: %v", err)
+		}
+		return
+	}
+
 	// Decrypt the Data using the Data Encryption Key. This uses streaming decryption so the whole body doesn't have to be
 	// read into RAM first.
 	_, span := trace.StartSpan(reqCtx, "Decrypt Data")
 	defer span.End()
 	if err := s.encryption.Decrypt(ek, reader, mw); err != nil {
-		log.Printf("Error reading body: %v", err)
+		logger.Errorf(reqCtx, "Error reading body: %v", err)
 		swagger.Errorf(w, http.StatusInternalServerError, "Error reading body")
 		return
 	}
@@ -208,11 +385,13 @@ func (s *DocumentService) UploadDocument(w http.ResponseWriter, r *http.Request)
 	// Create the bucket handle before parsing the request, just in case it doesn't work.
 	filename, err := uuid.NewRandom()
 	if err != nil {
-		log.Printf("Error creating UUID: %v", err)
+		logger.Errorf(reqCtx, "Error creating UUID: %v", err)
 		swagger.Errorf(w, http.StatusInternalServerError, "Error writing to backend storage")
 		return
 	}
-	bucket := s.storage.Bucket(s.config.Get("storage.bucket"))
+	logging.SetDocumentID(r.Context(), filename.String())
+	setAuditDocument(r.Context(), filename.String())
+	bucket := s.storage.Bucket(s.settings().Storage.Bucket)
 	obj := bucket.Object(filename.String())
 
 	// JSON decode the request.
@@ -226,12 +405,36 @@ func (s *DocumentService) UploadDocument(w http.ResponseWriter, r *http.Request)
 		swagger.Errorf(w, http.StatusBadRequest, "Invalid request, missing field")
 		return
 	}
+	// Encrypted names are longer than the original, and may not fit.
+	if utf8.RuneCountInString(req["name"]) > maxNameLength {
+		swagger.Errorf(w, http.StatusBadRequest, "Invalid request, name is longer than %d characters", maxNameLength)
+		return
+	}
 
-	// Get the data encryption key for the user. One will be created if none exist.
-	ek, err := metadata.GetEncryptionKey(ctx, s.spanner, s.encryption, userid)
+	// Use the customer-supplied key if there is one. Only the fingerprint of the key is stored.
+	ek, fingerprint, err := encryption.CustomerKey(r.Header)
 	if err != nil {
-		log.Print(err)
-		swagger.Errorf(w, http.StatusInternalServerError, "Error getting encryption key")
+		swagger.Errorf(w, http.StatusBadRequest, "Invalid encryption key: %v", err)
+		return
+	}
+	clientEncrypted := req["client_encrypted"] == "true"
+	if clientEncrypted && ek != nil {
+		swagger.Errorf(w, http.StatusBadRequest, "Client-encrypted documents cannot use a customer-supplied key")
+		return
+	}
+	if ek == nil && !clientEncrypted {
+		// Get the data encryption key for the user. One will be created if none exist.
+		ek, err = metadata.GetEncryptionKey(ctx, s.spanner, s.encryption, userid)
+		if err == metadata.ErrAccountDeleted {
+			swagger.Errorf(w, http.StatusGone, "Account has been deleted")
+			return
+		}
+		if err != nil {
+			logger.Errorf(reqCtx, "Error getting encryption key: %v", err)
+			swagger.Errorf(w, http.StatusInternalServerError, "Error getting encryption key")
+			return
+		}
+	} else if !s.checkAccount(ctx, w, userid) {
 		return
 	}
 
@@ -260,33 +463,55 @@ func (s *DocumentService) UploadDocument(w http.ResponseWriter, r *http.Request)
 		// This must be done in a goroutine because there is not yet anything ready to receive the data.
 		size, err = io.Copy(mw, decoder)
 		if err != nil {
-			log.Printf("Error base64 decoding body: %v", err)
+			logger.Warningf(reqCtx, "Error base64 decoding body: %v", err)
 		}
 		pw.Close()
 	}()
 
 	// Encrypt the Data using the Data Encryption Key. The data is streamed from the io.Pipe created above.
+	// Data that has already been encrypted by the client is stored as-is.
 	_, span := trace.StartSpan(reqCtx, "Encrypt Data")
-	if err := s.encryption.Encrypt(ek, pr, blobWriter); err != nil {
-		log.Printf("Error encrypting body: %v", err)
+	if clientEncrypted {
+		// The flag isn't taken on trust. Data that doesn't have the client-side encryption format is rejected before
+		// it is written, and the object is abandoned if the stream turns out to be truncated.
+		checker := &encryption.ClientChecker{}
+		_, err := io.Copy(io.MultiWriter(checker, blobWriter), pr)
+		if cerr := checker.Close(); cerr != nil && (err == nil || err == cerr) {
+			pr.CloseWithError(cerr)
+			swagger.Errorf(w, http.StatusBadRequest, "Invalid client-encrypted body: %v", cerr)
+			return
+		}
+		if err != nil {
+			logger.Errorf(reqCtx, "Error writing body: %v", err)
+			pr.CloseWithError(err)
+			swagger.Errorf(w, http.StatusInternalServerError, "Error writing to backend storage")
+			return
+		}
+	} else if err := s.encryption.Encrypt(ek, pr, blobWriter); err != nil {
+		logger.Errorf(reqCtx, "Error encrypting body: %v", err)
+		// Unblock the decoding goroutine, which may still be writing to the pipe.
+		pr.CloseWithError(err)
 		swagger.Errorf(w, http.StatusInternalServerError, "Error writing to backend storage")
 		return
 	}
 
 	if err := blobWriter.Close(); err != nil {
-		log.Printf("Error writing to storage file: %v", err)
+		logger.Errorf(reqCtx, "Error writing to storage file: %v", err)
 		swagger.Errorf(w, http.StatusInternalServerError, "Error writing to backend storage")
 		return
 	}
 	span.End()
 
 	mr := &metadata.Row{
-		ID:       filename.String(),
-		UserID:   userid,
-		Name:     req["name"],
-		MimeType: req["mime_type"],
-		Uploaded: time.Now(),
-		Size:     size,
+		ID:              filename.String(),
+		UserID:          userid,
+		Name:            req["name"],
+		MimeType:        req["mime_type"],
+		Uploaded:        time.Now(),
+		Size:            size,
+		KeyFingerprint:  fingerprint,
+		ClientEncrypted: clientEncrypted,
+		NameEncrypted:   req["name_encrypted"] == "true",
 	}
 	a := trace.StringAttribute("filename", "foobar")
 	reqSpan.Annotate([]trace.Attribute{
@@ -296,10 +521,10 @@ func (s *DocumentService) UploadDocument(w http.ResponseWriter, r *http.Request)
 		trace.Int64Attribute("size", size),
 	}, "Metadata row")
 
-	ctx, cancel := context.WithTimeout(reqCtx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
 	defer cancel()
 	if err := metadata.Add(ctx, s.spanner, mr); err != nil {
-		log.Printf("Error writing metadata: %v", err)
+		logger.Errorf(reqCtx, "Error writing metadata: %v", err)
 		swagger.Errorf(w, http.StatusInternalServerError, "Error writing to backend storage")
 		return
 	}
@@ -327,27 +552,27 @@ func (s *DocumentService) DeleteDocument(w http.ResponseWriter, r *http.Request)
 		trace.StringAttribute("id", vars["id"]),
 	)
 
-	ctx, cancel := context.WithTimeout(reqCtx, 10*time.Second)
+	ctx, cancel := context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
 	defer cancel()
 	mr, err := metadata.Get(ctx, s.spanner, userid, vars["id"])
 	if err != nil {
-		log.Print(err)
+		logger.Infof(reqCtx, "Error getting metadata for %q: %v", vars["id"], err)
 		swagger.Errorf(w, http.StatusNotFound, "Invalid object ID")
 		return
 	}
 
 	if err := metadata.Delete(ctx, s.spanner, vars["id"]); err != nil {
-		log.Print(err)
+		logger.Errorf(reqCtx, "Error deleting metadata for %q: %v", vars["id"], err)
 		swagger.Errorf(w, http.StatusNotFound, "Error deleting metadata")
 		return
 	}
 
-	bucket := s.storage.Bucket(s.config.Get("storage.bucket"))
+	bucket := s.storage.Bucket(s.settings().Storage.Bucket)
 	obj := bucket.Object(mr.ID)
-	ctx, cancel = context.WithTimeout(reqCtx, 10*time.Second)
+	ctx, cancel = context.WithTimeout(reqCtx, s.settings().Spanner.Timeout)
 	defer cancel()
 	if err := obj.Delete(reqCtx); err != nil {
-		log.Print(err)
+		logger.Errorf(reqCtx, "Error deleting blob %q: %v", mr.ID, err)
 		swagger.Errorf(w, http.StatusNotFound, "Error deleting metadata")
 		return
 	}
@@ -361,14 +586,87 @@ func main() {
 	flag.Parse()
 	ctx := context.Background()
 
-	log.Printf("Starting Document Storage API service v1.0.0")
+	// Libraries that use the standard log package write through the same logger as everything else.
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer(logger.Default(), logger.Info))
 
-	config, err := autoconfig.Load(ctx, *configFile)
+	logger.Infof(ctx, "Starting Document Storage API service v1.0.0")
+
+	if *secretStore != "" {
+		client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+		if err != nil {
+			logger.Fatalf(ctx, "Could not create secret store client: %v", err)
+		}
+		autoconfig.RegisterSecretResolver("gcp", &autoconfig.HTTPSecretResolver{BaseURL: *secretStore, Client: client})
+	}
+
+	// Configuration layers, from lowest to highest priority.
+	var sources []autoconfig.Source
+	for _, filename := range configFiles {
+		sources = append(sources, autoconfig.File(filename))
+	}
+	if *configDir != "" {
+		sources = append(sources, autoconfig.Directory(*configDir))
+	}
+	if *configURL != "" {
+		sources = append(sources, autoconfig.HTTP(*configURL))
+	}
+	if *configEnv != "" {
+		sources = append(sources, autoconfig.Env(*configEnv))
+	}
+	set, err := autoconfig.Set(configSet)
 	if err != nil {
-		log.Fatalf("Could not load config file %q: %v", *configFile, err)
+		logger.Fatalf(ctx, "Invalid --set flag: %v", err)
+	}
+	sources = append(sources, set)
+
+	body, err := ioutil.ReadFile(*configSchema)
+	if err != nil {
+		logger.Fatalf(ctx, "Could not read config schema: %v", err)
+	}
+	schema, err := autoconfig.ParseSchema(body)
+	if err != nil {
+		logger.Fatalf(ctx, "Invalid config schema %q: %v", *configSchema, err)
+	}
+	if *checkConfig {
+		// Secrets are usually only available where the service runs, so the references are checked rather than
+		// resolved.
+		config, err := autoconfig.CheckWithSchema(ctx, schema, sources...)
+		if err == nil {
+			// The schema doesn't cover the defaults and limits in Settings.
+			err = config.Bind("", &Settings{})
+		}
+		if verr, ok := err.(*autoconfig.ValidationError); ok {
+			for _, problem := range verr.Problems {
+				fmt.Fprintln(os.Stderr, problem)
+			}
+			os.Exit(1)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("Configuration %q is valid\n", configFiles)
+		return
+	}
+	config, err := autoconfig.LoadWithSchema(ctx, schema, sources...)
+	if err != nil {
+		logger.Fatalf(ctx, "Could not load config files %q: %v", configFiles, err)
+	}
+	if *printConfig {
+		origins := config.Origins()
+		paths := make([]string, 0, len(origins))
+		for path := range origins {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			fmt.Printf("%s = %s (%s)\n", path, config.Display(path), origins[path])
+		}
+		return
 	}
 	if err := config.Watch(ctx); err != nil {
-		log.Fatalf("Could not watch config file %q: %v", *configFile, err)
+		logger.Fatalf(ctx, "Could not watch config files %q: %v", configFiles, err)
 	}
 	config.AddValidator(func(old, new *autoconfig.Config) error {
 		for _, key := range []string{"project", "spanner.instance", "spanner.database"} {
@@ -381,22 +679,45 @@ func main() {
 
 	// Check that required environment variables are set.
 	if os.Getenv("PORT") == "" {
-		log.Fatalf("Missing required environment variable \"PORT\"")
-	}
-
-	// Check that required configuration options are set.
-	for _, v := range []string{"project", "spanner.instance", "spanner.database"} {
-		if config.Get(v) == "" {
-			log.Fatalf("Missing required configuration option %q", v)
-		}
+		logger.Fatalf(ctx, "Missing required environment variable \"PORT\"")
 	}
 
 	s, err := NewDocumentService(config, ctx)
 	if err != nil {
-		log.Fatal(err)
+		logger.Fatalf(ctx, "Could not create document service: %v", err)
 	}
 
 	listenAddr := fmt.Sprintf("[::]:%s", os.Getenv("PORT"))
-	log.Printf("Listening on %s", listenAddr)
-	log.Fatal(http.ListenAndServe(listenAddr, s.Handler))
+	server := &http.Server{Addr: listenAddr, Handler: s.Handler}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		logger.Infof(ctx, "Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Warningf(ctx, "Error waiting for requests to finish: %v", err)
+		}
+		if err := s.Close(ctx); err != nil {
+			logger.Errorf(ctx, "%v", err)
+		}
+	}()
+
+	logger.Infof(ctx, "Listening on %s", listenAddr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalf(ctx, "%v", err)
+	}
+	<-done
+}
+
+// Close flushes anything that is buffered by the DocumentService. It must be called after the server has stopped
+// accepting requests.
+func (s *DocumentService) Close(ctx context.Context) error {
+	if err := s.accessLog.Shipper.Close(ctx); err != nil {
+		return err
+	}
+	return s.accessLog.Close()
 }
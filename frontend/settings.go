@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/logging"
+	"github.com/dparrish/build-web-application-demo/swagger"
+
+	gcontext "github.com/gorilla/context"
+)
+
+// Settings contains the configuration used by the DocumentService. It is bound from the configuration file at startup
+// and re-bound whenever the file is reloaded, so it should be fetched using DocumentService.settings() for each
+// request rather than being kept.
+type Settings struct {
+	Project string `config:"project" required:"true"`
+
+	Spanner struct {
+		Instance string        `config:"instance" required:"true"`
+		Database string        `config:"database" required:"true"`
+		Timeout  time.Duration `config:"timeout" default:"10s" min:"100ms"`
+	} `config:"spanner"`
+
+	Storage struct {
+		Bucket string `config:"bucket" required:"true"`
+	} `config:"storage"`
+
+	Encryption struct {
+		KMSTimeout time.Duration `config:"kms_timeout" default:"10s" min:"100ms"`
+		KeyCache   struct {
+			Size int           `config:"size" default:"512" min:"1"`
+			TTL  time.Duration `config:"ttl" default:"0s" min:"0s"`
+		} `config:"key_cache"`
+	} `config:"encryption"`
+
+	BigQuery struct {
+		Dataset  string        `config:"dataset" required:"true"`
+		LogTable string        `config:"log_table" required:"true"`
+		Timeout  time.Duration `config:"timeout" default:"5s" min:"100ms"`
+	} `config:"bigquery"`
+
+	// AccessLog controls how access log entries are buffered before being written. It is only read at startup.
+	AccessLog struct {
+		QueueSize     int           `config:"queue_size" default:"10000" min:"1"`
+		BatchSize     int           `config:"batch_size" default:"500" min:"1"`
+		FlushInterval time.Duration `config:"flush_interval" default:"1s" min:"10ms"`
+		Workers       int           `config:"workers" default:"2" min:"1"`
+		Overflow      string        `config:"overflow" default:"drop_oldest"`
+
+		// Batches that can't be written are kept in SpoolDir and retried, if it is set.
+		SpoolDir      string        `config:"spool_dir"`
+		SpoolMaxBytes int64         `config:"spool_max_bytes" default:"268435456" min:"1048576"`
+		RetryInterval time.Duration `config:"retry_interval" default:"10s" min:"100ms"`
+
+		// Redaction and Sampling can be changed while the server is running.
+		Redaction logging.Redaction `config:"redaction"`
+		Sampling  logging.Sampling  `config:"sampling"`
+
+		// Activity controls the access history shown to users. Store is "bigquery" to query the log table in the
+		// bigquery section, or "memory" to keep the most recent MaxEntries entries in memory, for local development.
+		// Each user may make UserRate activity requests per second, and up to UserBurst at once.
+		Activity struct {
+			Store      string        `config:"store" default:"bigquery"`
+			MaxEntries int           `config:"max_entries" default:"100000" min:"1"`
+			MaxRange   time.Duration `config:"max_range" default:"2160h" min:"1h"`
+			Timeout    time.Duration `config:"timeout" default:"30s" min:"1s"`
+			UserRate   float64       `config:"user_rate" default:"0.1" min:"0"`
+			UserBurst  int           `config:"user_burst" default:"10" min:"1"`
+		} `config:"activity"`
+	} `config:"access_log"`
+
+	// Audit.HMACKey is the key used to hash audit events, so that the audit trail can't be rewritten by someone who can
+	// only change the database. It must be kept outside Spanner, and is only read at startup. Events are hashed
+	// without a key if it is unset.
+	Audit struct {
+		HMACKey string `config:"hmac_key"`
+	} `config:"audit"`
+
+	Account struct {
+		DeletionPollInterval time.Duration `config:"deletion_poll_interval" default:"10s" min:"1s"`
+	} `config:"account"`
+
+	Log struct {
+		// Level is the lowest level of application log lines that are written. It can be changed while the server is
+		// running.
+		Level string `config:"level" default:"info"`
+	} `config:"log"`
+}
+
+// settings returns the current settings.
+func (s *DocumentService) settings() *Settings {
+	return s.boundSettings.Get().(*Settings)
+}
+
+// AdminRollbackConfig restores a previous configuration version on this replica.
+func (s *DocumentService) AdminRollbackConfig(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Version int `json:"version"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version == 0 {
+		swagger.Errorf(w, http.StatusBadRequest, "Request must contain the version to roll back to")
+		return
+	}
+	if err := s.config.Rollback(req.Version); err != nil {
+		logger.Warningf(r.Context(), "Config rollback to version %d failed: %v", req.Version, err)
+		swagger.Errorf(w, http.StatusConflict, "Rollback failed: %v", err)
+		return
+	}
+	logger.Infof(r.Context(), "Config rolled back to version %d, requested by %q", req.Version, gcontext.Get(r, "userid"))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "ok", "version": s.config.Version()})
+}
@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
-	"log"
 	"sync"
 	"time"
 
+	"github.com/dparrish/build-web-application-demo/autoconfig"
 	"github.com/dparrish/build-web-application-demo/encryption"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/logging"
+	"github.com/dparrish/build-web-application-demo/metadata"
 
 	"cloud.google.com/go/bigquery"
 	"cloud.google.com/go/spanner"
@@ -40,7 +43,7 @@ func (s *DocumentService) createClients(ctx context.Context) {
 		defer wg.Done()
 		s.bigquery, err = bigquery.NewClient(ctx, s.config.Get("project"))
 		if err != nil {
-			log.Fatalf("Error creating BigQuery client: %v", err)
+			logger.Fatalf(ctx, "Error creating BigQuery client: %v", err)
 		}
 	}()
 
@@ -50,7 +53,7 @@ func (s *DocumentService) createClients(ctx context.Context) {
 		// Create Cloud Storage client.
 		s.storage, err = storage.NewClient(ctx)
 		if err != nil {
-			log.Fatalf("Error creating Cloud Storage client: %v", err)
+			logger.Fatalf(ctx, "Error creating Cloud Storage client: %v", err)
 		}
 	}()
 
@@ -58,16 +61,17 @@ func (s *DocumentService) createClients(ctx context.Context) {
 	go func() {
 		// Create Cloud Spanner client.
 		defer wg.Done()
-		dbName := fmt.Sprintf("projects/%s/instances/%s/databases/%s", s.config.Get("project"), s.config.Get("spanner.instance"), s.config.Get("spanner.database"))
+		settings := s.settings()
+		dbName := fmt.Sprintf("projects/%s/instances/%s/databases/%s", settings.Project, settings.Spanner.Instance, settings.Spanner.Database)
 		s.spanner, err = spanner.NewClient(ctx, dbName)
 		if err != nil {
-			log.Fatalf("Error creating Cloud Spanner client: %v", err)
+			logger.Fatalf(ctx, "Error creating Cloud Spanner client: %v", err)
 		}
 		if *warmSpanner {
 			// Perform a warming query to force the Spanner client to connect.
 			func() {
 				stmt := spanner.NewStatement(`SELECT 1`)
-				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				ctx, cancel := context.WithTimeout(ctx, s.settings().Spanner.Timeout)
 				defer cancel()
 				iter := s.spanner.Single().Query(ctx, stmt)
 				defer iter.Stop()
@@ -83,7 +87,7 @@ func (s *DocumentService) createClients(ctx context.Context) {
 		// Export to Stackdriver Monitoring.
 		s.exporter, err = stackdriver.NewExporter(stackdriver.Options{ProjectID: s.config.Get("project")})
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatalf(ctx, "Error creating Stackdriver exporter: %v", err)
 		}
 		view.RegisterExporter(s.exporter)
 		view.SetReportingPeriod(1 * time.Second)
@@ -118,7 +122,64 @@ func (s *DocumentService) createClients(ctx context.Context) {
 			Measure:     s.metrics.requests,
 			Aggregation: view.Count(),
 		})
+
+		view.Register(&view.View{
+			Name:        "frontend/views/audit_failures",
+			Description: "audit events that couldn't be written over time",
+			Measure:     auditFailures,
+			Aggregation: view.Count(),
+		})
+
+		view.Register(metadata.KeyCacheViews...)
+		view.Register(autoconfig.Views...)
+		view.Register(logging.Views...)
 	}()
 
 	wg.Wait()
 }
+
+// loadSettings binds the Settings struct to the configuration, which validates that everything required is set.
+// The timeouts used by the metadata package and the log level are updated whenever the configuration changes.
+func (s *DocumentService) loadSettings() error {
+	var err error
+	s.boundSettings, err = s.config.BindWatch("", func() interface{} { return &Settings{} })
+	if err != nil {
+		return err
+	}
+	apply := func(v interface{}) {
+		settings := v.(*Settings)
+		metadata.SetTimeouts(settings.Spanner.Timeout, settings.Encryption.KMSTimeout)
+		level, err := logger.ParseLevel(settings.Log.Level)
+		if err != nil {
+			logger.Errorf(context.Background(), "Keeping existing log level: %v", err)
+			return
+		}
+		logger.Default().SetLevel(level)
+		logger.Default().SetProject(settings.Project)
+	}
+	apply(s.settings())
+	s.boundSettings.Subscribe(apply)
+	return nil
+}
+
+// createKeyCache replaces the default data encryption key cache with one sized according to the configuration. The
+// cache is replaced again whenever its configuration changes.
+func (s *DocumentService) createKeyCache() error {
+	s.config.OnChange("encryption.key_cache", func(old, new *autoconfig.Config, changed []string) {
+		logger.Infof(context.Background(), "Key cache configuration changed (%v), replacing key cache", changed)
+		if err := s.newKeyCache(); err != nil {
+			logger.Errorf(context.Background(), "%v", err)
+		}
+	})
+	return s.newKeyCache()
+}
+
+func (s *DocumentService) newKeyCache() error {
+	settings := s.settings()
+	c, err := metadata.NewKeyCache(settings.Encryption.KeyCache.Size, settings.Encryption.KeyCache.TTL)
+	if err != nil {
+		return fmt.Errorf("error creating key cache: %v", err)
+	}
+	metadata.SetKeyCache(c)
+	return nil
+}
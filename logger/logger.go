@@ -0,0 +1,230 @@
+// Package logger writes leveled application logs as lines of JSON, in the format understood by Cloud Logging.
+//
+// A Logger is carried in a context.Context, so that every line logged while handling a request includes fields such
+// as the request ID and user that were added to it earlier. The trace and span of the context are added to each line
+// as it is written.
+package logger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+// Level is the severity of a log line. Lines below the level of a Logger are discarded.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warning
+	Error
+	Critical
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARNING", "ERROR", "CRITICAL"}
+
+// String returns the Cloud Logging severity of the level.
+func (l Level) String() string {
+	if l < Debug || l > Critical {
+		return "DEFAULT"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with a name such as "info" or "WARNING".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// output is shared by a Logger and every Logger derived from it.
+type output struct {
+	mu      sync.Mutex
+	w       io.Writer
+	level   int32 // Level, accessed atomically.
+	project atomic.Value
+}
+
+// Logger writes log lines with a set of fields.
+type Logger struct {
+	out    *output
+	fields map[string]interface{}
+}
+
+// New returns a Logger that writes to w, at Info level.
+func New(w io.Writer) *Logger {
+	l := &Logger{out: &output{w: w, level: int32(Info)}}
+	l.out.project.Store("")
+	return l
+}
+
+var std = New(os.Stderr)
+
+// Default returns the Logger used when a context doesn't contain one.
+func Default() *Logger {
+	return std
+}
+
+// SetLevel changes the lowest level that is written by the Logger, and every Logger that shares its output.
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.out.level, int32(level))
+}
+
+// Enabled returns whether lines at level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= Level(atomic.LoadInt32(&l.out.level))
+}
+
+// SetProject sets the Google Cloud project that traces are recorded in, which Cloud Logging needs to link log lines
+// to their traces.
+func (l *Logger) SetProject(project string) {
+	l.out.project.Store(project)
+}
+
+// With returns a Logger that adds a field to every line, sharing the output and level of l.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	fields[key] = value
+	return &Logger{out: l.out, fields: fields}
+}
+
+type loggerKey struct{}
+
+// NewContext returns a copy of ctx carrying l.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the Logger in ctx, or the default Logger.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return std
+}
+
+// With returns a copy of ctx whose Logger adds a field to every line.
+func With(ctx context.Context, key string, value interface{}) context.Context {
+	return NewContext(ctx, FromContext(ctx).With(key, value))
+}
+
+// log writes a line. depth is the number of stack frames between log and the code that is logging.
+func (l *Logger) log(ctx context.Context, depth int, level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	entry := make(map[string]interface{}, len(l.fields)+6)
+	for k, v := range l.fields {
+		entry[k] = v
+	}
+	entry["severity"] = level.String()
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["message"] = fmt.Sprintf(format, args...)
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		entry["logging.googleapis.com/sourceLocation"] = map[string]interface{}{"file": file, "line": line}
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		traceID := sc.TraceID.String()
+		if project := l.out.project.Load().(string); project != "" {
+			traceID = fmt.Sprintf("projects/%s/traces/%s", project, traceID)
+		}
+		entry["logging.googleapis.com/trace"] = traceID
+		entry["logging.googleapis.com/spanId"] = sc.SpanID.String()
+		entry["logging.googleapis.com/trace_sampled"] = sc.IsSampled()
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]interface{}{
+			"severity": Error.String(),
+			"message":  fmt.Sprintf("Couldn't encode log line %q: %v", entry["message"], err),
+		})
+	}
+	b = append(b, '\n')
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(b)
+}
+
+func (l *Logger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, 1, Debug, format, args...)
+}
+
+func (l *Logger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, 1, Info, format, args...)
+}
+
+func (l *Logger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, 1, Warning, format, args...)
+}
+
+func (l *Logger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, 1, Error, format, args...)
+}
+
+// Fatalf writes a line at Critical level and exits.
+func (l *Logger) Fatalf(ctx context.Context, format string, args ...interface{}) {
+	l.log(ctx, 1, Critical, format, args...)
+	os.Exit(1)
+}
+
+// Debugf logs with the Logger in ctx.
+func Debugf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).log(ctx, 1, Debug, format, args...)
+}
+
+// Infof logs with the Logger in ctx.
+func Infof(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).log(ctx, 1, Info, format, args...)
+}
+
+// Warningf logs with the Logger in ctx.
+func Warningf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).log(ctx, 1, Warning, format, args...)
+}
+
+// Errorf logs with the Logger in ctx.
+func Errorf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).log(ctx, 1, Error, format, args...)
+}
+
+// Fatalf logs with the Logger in ctx at Critical level, and exits.
+func Fatalf(ctx context.Context, format string, args ...interface{}) {
+	FromContext(ctx).log(ctx, 1, Critical, format, args...)
+	os.Exit(1)
+}
+
+// stdWriter turns lines written by the standard log package into log lines.
+type stdWriter struct {
+	l     *Logger
+	level Level
+}
+
+// Writer returns a Writer for log.SetOutput, so that packages using the standard log package write lines at level
+// through l. The log flags should be 0, as the time and source are added by l.
+func Writer(l *Logger, level Level) io.Writer {
+	return &stdWriter{l: l, level: level}
+}
+
+func (w *stdWriter) Write(b []byte) (int, error) {
+	// The caller is the function calling log.Printf, above Output and Write.
+	w.l.log(context.Background(), 3, w.level, "%s", strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
@@ -0,0 +1,103 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+
+	"go.opencensus.io/trace"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decode(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("Invalid log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range []string{"debug", "INFO", "Warning", "error", "critical"} {
+		level, err := ParseLevel(name)
+		assert.NoError(t, err)
+		assert.Equal(t, strings.ToUpper(name), level.String())
+	}
+	_, err := ParseLevel("verbose")
+	assert.Error(t, err)
+}
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	ctx := context.Background()
+	l.Debugf(ctx, "hidden")
+	l.Infof(ctx, "info")
+	l.SetLevel(Error)
+	l.Warningf(ctx, "hidden")
+	l.Errorf(ctx, "error")
+
+	lines := decode(t, &buf)
+	if assert.Len(t, lines, 2) {
+		assert.Equal(t, "INFO", lines[0]["severity"])
+		assert.Equal(t, "info", lines[0]["message"])
+		assert.Equal(t, "ERROR", lines[1]["severity"])
+	}
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf)
+	l.SetProject("my-project")
+	ctx := With(NewContext(context.Background(), l), "request_id", "abc")
+	ctx, span := trace.StartSpan(ctx, "test", trace.WithSampler(trace.AlwaysSample()))
+	defer span.End()
+	Infof(ctx, "hello %s", "world")
+
+	lines := decode(t, &buf)
+	if assert.Len(t, lines, 1) {
+		entry := lines[0]
+		sc := span.SpanContext()
+		assert.Equal(t, "hello world", entry["message"])
+		assert.Equal(t, "abc", entry["request_id"])
+		assert.Equal(t, "projects/my-project/traces/"+sc.TraceID.String(), entry["logging.googleapis.com/trace"])
+		assert.Equal(t, sc.SpanID.String(), entry["logging.googleapis.com/spanId"])
+		assert.Equal(t, true, entry["logging.googleapis.com/trace_sampled"])
+		source := entry["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+		assert.True(t, strings.HasSuffix(source["file"].(string), "logger_test.go"), source["file"])
+	}
+
+	// Fields added to a derived Logger don't change the original.
+	buf.Reset()
+	l.Infof(context.Background(), "plain")
+	lines = decode(t, &buf)
+	if assert.Len(t, lines, 1) {
+		assert.NotContains(t, lines[0], "request_id")
+		assert.NotContains(t, lines[0], "logging.googleapis.com/trace")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	std := log.New(Writer(New(&buf), Warning), "", 0)
+	std.Printf("from the log package")
+
+	lines := decode(t, &buf)
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "WARNING", lines[0]["severity"])
+		assert.Equal(t, "from the log package", lines[0]["message"])
+		source := lines[0]["logging.googleapis.com/sourceLocation"].(map[string]interface{})
+		assert.True(t, strings.HasSuffix(source["file"].(string), "logger_test.go"), source["file"])
+	}
+}
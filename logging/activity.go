@@ -0,0 +1,314 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/iterator"
+)
+
+// ActivityQuery selects access log entries to show to a user. UserID and DocumentID are optional, but the caller is
+// responsible for making sure that the user is allowed to see every entry that they select.
+type ActivityQuery struct {
+	UserID     string
+	DocumentID string
+	// Entries from Since up to, but not including, Until are selected.
+	Since, Until time.Time
+	// Interval is the length of each period in the summary, either an hour or a day.
+	Interval time.Duration
+	// Offset and Limit select a page of entries, newest first. The summary always covers every selected entry.
+	Offset, Limit int
+}
+
+func (q *ActivityQuery) validate() error {
+	if !q.Until.After(q.Since) {
+		return fmt.Errorf("activity query must end after it starts")
+	}
+	if q.Interval != time.Hour && q.Interval != 24*time.Hour {
+		return fmt.Errorf("activity interval must be an hour or a day, not %s", q.Interval)
+	}
+	if q.Offset < 0 || q.Limit < 1 {
+		return fmt.Errorf("invalid activity page offset %d, limit %d", q.Offset, q.Limit)
+	}
+	return nil
+}
+
+// ActivityEntry is the part of an access log entry that is shown to users.
+type ActivityEntry struct {
+	Timestamp    time.Time `bigquery:"timestamp" json:"timestamp"`
+	Method       string    `bigquery:"method" json:"method"`
+	URI          string    `bigquery:"uri" json:"uri"`
+	ResponseCode int64     `bigquery:"response_code" json:"response_code"`
+	UserID       string    `bigquery:"user_id" json:"user_id,omitempty"`
+	DocumentID   string    `bigquery:"document_id" json:"document_id,omitempty"`
+	RequestID    string    `bigquery:"request_id" json:"request_id,omitempty"`
+	RemoteIP     string    `bigquery:"remote_ip" json:"remote_ip,omitempty"`
+	UserAgent    string    `bigquery:"user_agent" json:"user_agent,omitempty"`
+	// SampleRate is the fraction of requests like this one that were logged, 1 if every one was.
+	SampleRate float64 `bigquery:"sample_rate" json:"sample_rate"`
+}
+
+// ActivityPeriod counts the requests in one period of an activity summary. Successful GET and HEAD requests are
+// reads, other successful requests that change anything are writes, and every request with an error status is a
+// failure. Counts are estimates where reads have been sampled, as each entry stands for 1/SampleRate requests.
+type ActivityPeriod struct {
+	Start    time.Time `bigquery:"start" json:"start"`
+	Reads    int64     `bigquery:"reads" json:"reads"`
+	Writes   int64     `bigquery:"writes" json:"writes"`
+	Failures int64     `bigquery:"failures" json:"failures"`
+	// Estimated is true if some of the period's requests were sampled, so that its counts are estimates.
+	Estimated bool `bigquery:"estimated" json:"estimated,omitempty"`
+}
+
+// Activity is the result of an ActivityQuery.
+type Activity struct {
+	Entries []*ActivityEntry `json:"entries"`
+	// Summary has a period for every interval containing at least one request, oldest first.
+	Summary []*ActivityPeriod `json:"summary"`
+	// Next is the offset of the next page of entries, or 0 if this is the last page.
+	Next int `json:"next,omitempty"`
+}
+
+// ActivityStore answers activity queries from the access log.
+type ActivityStore interface {
+	Activity(ctx context.Context, q *ActivityQuery) (*Activity, error)
+}
+
+// sampleRate returns the sample rate of an entry. Entries written before sampling have no rate.
+func sampleRate(rate float64) float64 {
+	if rate > 0 {
+		return rate
+	}
+	return 1
+}
+
+// periodCounts accumulates the weighted counts of a period, which are rounded once every entry has been counted.
+type periodCounts struct {
+	reads, writes, failures float64
+	estimated               bool
+}
+
+func (c *periodCounts) add(method string, code int, rate float64) {
+	w := 1 / rate
+	if rate < 1 {
+		c.estimated = true
+	}
+	switch {
+	case code >= 400:
+		c.failures += w
+	case method == http.MethodGet || method == http.MethodHead:
+		c.reads += w
+	case isWrite(method):
+		c.writes += w
+	}
+}
+
+func (c *periodCounts) period(start time.Time) *ActivityPeriod {
+	round := func(f float64) int64 { return int64(math.Floor(f + 0.5)) }
+	return &ActivityPeriod{Start: start, Reads: round(c.reads), Writes: round(c.writes), Failures: round(c.failures), Estimated: c.estimated}
+}
+
+// writeMethods are the methods of requests that change something.
+var writeMethods = []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+func isWrite(method string) bool {
+	for _, m := range writeMethods {
+		if method == m {
+			return true
+		}
+	}
+	return false
+}
+
+// MemoryActivity keeps the most recent access log entries in memory and answers activity queries from them, for tests
+// and local development where there is no BigQuery table. It is also a Sink.
+type MemoryActivity struct {
+	max     int
+	mu      sync.Mutex
+	entries []*RequestLog // Oldest first.
+}
+
+// NewMemoryActivity returns a MemoryActivity that keeps up to max entries.
+func NewMemoryActivity(max int) *MemoryActivity {
+	return &MemoryActivity{max: max}
+}
+
+func (m *MemoryActivity) Write(ctx context.Context, entries []*RequestLog) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, entry := range entries {
+		e := *entry
+		m.entries = append(m.entries, &e)
+	}
+	if n := len(m.entries) - m.max; n > 0 {
+		m.entries = append([]*RequestLog(nil), m.entries[n:]...)
+	}
+	return nil
+}
+
+func (m *MemoryActivity) Close() error {
+	return nil
+}
+
+func (m *MemoryActivity) Activity(ctx context.Context, q *ActivityQuery) (*Activity, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	var selected []*RequestLog
+	for _, e := range m.entries {
+		if e.Timestamp.Before(q.Since) || !e.Timestamp.Before(q.Until) ||
+			(q.UserID != "" && e.UserID != q.UserID) || (q.DocumentID != "" && e.DocumentID != q.DocumentID) {
+			continue
+		}
+		selected = append(selected, e)
+	}
+	m.mu.Unlock()
+	// Entries may be written out of order by concurrent shipper workers.
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].Timestamp.After(selected[j].Timestamp) })
+
+	activity := &Activity{Entries: []*ActivityEntry{}, Summary: []*ActivityPeriod{}}
+	counts := make(map[time.Time]*periodCounts)
+	for _, e := range selected {
+		start := e.Timestamp.UTC().Truncate(q.Interval)
+		c, ok := counts[start]
+		if !ok {
+			c = &periodCounts{}
+			counts[start] = c
+		}
+		c.add(e.Method, e.ResponseCode, sampleRate(e.SampleRate))
+	}
+	for start, c := range counts {
+		activity.Summary = append(activity.Summary, c.period(start))
+	}
+	sort.Slice(activity.Summary, func(i, j int) bool { return activity.Summary[i].Start.Before(activity.Summary[j].Start) })
+
+	for i := q.Offset; i < len(selected) && i < q.Offset+q.Limit; i++ {
+		e := selected[i]
+		activity.Entries = append(activity.Entries, &ActivityEntry{
+			Timestamp: e.Timestamp, Method: e.Method, URI: e.URI, ResponseCode: int64(e.ResponseCode), UserID: e.UserID,
+			DocumentID: e.DocumentID, RequestID: e.RequestID, RemoteIP: e.RemoteIP, UserAgent: e.UserAgent,
+			SampleRate: sampleRate(e.SampleRate),
+		})
+	}
+	if q.Offset+q.Limit < len(selected) {
+		activity.Next = q.Offset + q.Limit
+	}
+	return activity, nil
+}
+
+// BigQueryActivity answers activity queries from the access log table in BigQuery.
+type BigQueryActivity struct {
+	Client  *bigquery.Client
+	Table   *bigquery.Table
+	Timeout time.Duration // Deadline for each query, 30 seconds if unset.
+}
+
+// activityColumns are the columns read into an ActivityEntry. Every column of the access log table is nullable, and
+// NULLs can't be read into the fields of ActivityEntry.
+var activityColumns = []string{
+	"timestamp", "IFNULL(method, '') AS method", "IFNULL(uri, '') AS uri", "IFNULL(response_code, 0) AS response_code",
+	"IFNULL(user_id, '') AS user_id", "IFNULL(document_id, '') AS document_id", "IFNULL(request_id, '') AS request_id",
+	"IFNULL(remote_ip, '') AS remote_ip", "IFNULL(user_agent, '') AS user_agent",
+	"IF(sample_rate > 0, sample_rate, 1) AS sample_rate",
+}
+
+// bigQueryIntervals are the TIMESTAMP_TRUNC parts for each summary interval.
+var bigQueryIntervals = map[time.Duration]string{time.Hour: "HOUR", 24 * time.Hour: "DAY"}
+
+func (b *BigQueryActivity) Activity(ctx context.Context, q *ActivityQuery) (*Activity, error) {
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	timeout := b.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	table := fmt.Sprintf("`%s.%s.%s`", b.Table.ProjectID, b.Table.DatasetID, b.Table.TableID)
+	where := []string{"timestamp >= @since", "timestamp < @until"}
+	params := []bigquery.QueryParameter{{Name: "since", Value: q.Since}, {Name: "until", Value: q.Until}}
+	if q.UserID != "" {
+		where = append(where, "user_id = @user_id")
+		params = append(params, bigquery.QueryParameter{Name: "user_id", Value: q.UserID})
+	}
+	if q.DocumentID != "" {
+		where = append(where, "document_id = @document_id")
+		params = append(params, bigquery.QueryParameter{Name: "document_id", Value: q.DocumentID})
+	}
+	filter := strings.Join(where, " AND ")
+
+	activity := &Activity{Entries: []*ActivityEntry{}, Summary: []*ActivityPeriod{}}
+	// One more entry than the page is read, to find out whether there is another page.
+	entries := b.Client.Query(fmt.Sprintf(`SELECT %s FROM %s WHERE %s ORDER BY timestamp DESC LIMIT @limit OFFSET @offset`,
+		strings.Join(activityColumns, ", "), table, filter))
+	entries.Parameters = append(params,
+		bigquery.QueryParameter{Name: "limit", Value: int64(q.Limit + 1)},
+		bigquery.QueryParameter{Name: "offset", Value: int64(q.Offset)})
+	err := read(ctx, entries, func(it *bigquery.RowIterator) error {
+		var e ActivityEntry
+		if err := it.Next(&e); err != nil {
+			return err
+		}
+		activity.Entries = append(activity.Entries, &e)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read activity from %s: %v", table, err)
+	}
+	if len(activity.Entries) > q.Limit {
+		activity.Entries = activity.Entries[:q.Limit]
+		activity.Next = q.Offset + q.Limit
+	}
+
+	// The same classification as periodCounts.add.
+	summary := b.Client.Query(fmt.Sprintf(`
+		SELECT start,
+			CAST(ROUND(SUM(IF(response_code >= 400, w, 0))) AS INT64) AS failures,
+			CAST(ROUND(SUM(IF(response_code < 400 AND method IN ('GET', 'HEAD'), w, 0))) AS INT64) AS reads,
+			CAST(ROUND(SUM(IF(response_code < 400 AND method IN ('%s'), w, 0))) AS INT64) AS writes,
+			LOGICAL_OR(w > 1) AS estimated
+		FROM (
+			SELECT TIMESTAMP_TRUNC(timestamp, %s) AS start, method, response_code,
+				IF(sample_rate > 0, 1 / sample_rate, 1) AS w
+			FROM %s WHERE %s
+		)
+		GROUP BY start ORDER BY start`, strings.Join(writeMethods, "', '"), bigQueryIntervals[q.Interval], table, filter))
+	summary.Parameters = params
+	err = read(ctx, summary, func(it *bigquery.RowIterator) error {
+		var p ActivityPeriod
+		if err := it.Next(&p); err != nil {
+			return err
+		}
+		activity.Summary = append(activity.Summary, &p)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't summarise activity from %s: %v", table, err)
+	}
+	return activity, nil
+}
+
+// read runs a query and calls next for each row until it returns iterator.Done.
+func read(ctx context.Context, q *bigquery.Query, next func(it *bigquery.RowIterator) error) error {
+	it, err := q.Read(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		if err := next(it); err == iterator.Done {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
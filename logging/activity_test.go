@@ -0,0 +1,98 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryActivity(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	entry := func(minutes int, method, user, doc string, code int, rate float64) *RequestLog {
+		return &RequestLog{
+			Timestamp:    start.Add(time.Duration(minutes) * time.Minute),
+			Method:       method,
+			URI:          "/document/" + doc,
+			UserID:       user,
+			DocumentID:   doc,
+			ResponseCode: code,
+			SampleRate:   rate,
+			RequestID:    fmt.Sprintf("req-%d", minutes),
+		}
+	}
+	m := NewMemoryActivity(100)
+	assert.Nil(t, m.Write(ctx, []*RequestLog{
+		entry(0, "POST", "alice", "doc1", 200, 1),
+		entry(10, "GET", "alice", "doc1", 200, 0.5), // Stands for two reads.
+		entry(20, "GET", "alice", "doc1", 404, 1),
+		entry(70, "GET", "alice", "doc1", 200, 0), // Written before sampling.
+		entry(80, "DELETE", "alice", "doc2", 200, 1),
+		entry(90, "GET", "bob", "doc3", 200, 1),
+	}))
+
+	q := &ActivityQuery{UserID: "alice", Since: start, Until: start.Add(24 * time.Hour), Interval: time.Hour, Limit: 2}
+	activity, err := m.Activity(ctx, q)
+	assert.Nil(t, err)
+	// Newest first.
+	if assert.Len(t, activity.Entries, 2) {
+		assert.Equal(t, "req-80", activity.Entries[0].RequestID)
+		assert.Equal(t, "req-70", activity.Entries[1].RequestID)
+		assert.Equal(t, 1.0, activity.Entries[1].SampleRate)
+	}
+	assert.Equal(t, 2, activity.Next)
+	assert.Equal(t, []*ActivityPeriod{
+		{Start: start, Reads: 2, Writes: 1, Failures: 1, Estimated: true},
+		{Start: start.Add(time.Hour), Reads: 1, Writes: 1},
+	}, activity.Summary)
+
+	// The last page.
+	q.Offset = activity.Next
+	q.Limit = 10
+	activity, err = m.Activity(ctx, q)
+	assert.Nil(t, err)
+	assert.Len(t, activity.Entries, 3)
+	assert.Equal(t, 0, activity.Next)
+
+	// A document, summarised by day.
+	activity, err = m.Activity(ctx, &ActivityQuery{DocumentID: "doc1", Since: start, Until: start.Add(time.Hour), Interval: 24 * time.Hour, Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, activity.Entries, 3) {
+		assert.Equal(t, 0.5, activity.Entries[1].SampleRate)
+	}
+	assert.Equal(t, []*ActivityPeriod{{Start: start, Reads: 2, Writes: 1, Failures: 1, Estimated: true}}, activity.Summary)
+
+	// Nothing matches.
+	activity, err = m.Activity(ctx, &ActivityQuery{UserID: "carol", Since: start, Until: start.Add(time.Hour), Interval: time.Hour, Limit: 10})
+	assert.Nil(t, err)
+	assert.Empty(t, activity.Entries)
+	assert.Empty(t, activity.Summary)
+
+	for _, q := range []*ActivityQuery{
+		{Since: start, Until: start, Interval: time.Hour, Limit: 1},
+		{Since: start, Until: start.Add(time.Hour), Interval: time.Minute, Limit: 1},
+		{Since: start, Until: start.Add(time.Hour), Interval: time.Hour},
+	} {
+		_, err := m.Activity(ctx, q)
+		assert.Error(t, err, "%+v", q)
+	}
+}
+
+func TestMemoryActivityLimit(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	m := NewMemoryActivity(3)
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, m.Write(ctx, []*RequestLog{{Timestamp: start.Add(time.Duration(i) * time.Second), Method: "GET", UserID: "alice", ResponseCode: 200}}))
+	}
+	activity, err := m.Activity(ctx, &ActivityQuery{UserID: "alice", Since: start, Until: start.Add(time.Hour), Interval: time.Hour, Limit: 10})
+	assert.Nil(t, err)
+	// Only the most recent entries are kept.
+	if assert.Len(t, activity.Entries, 3) {
+		assert.Equal(t, start.Add(4*time.Second), activity.Entries[0].Timestamp)
+		assert.Equal(t, start.Add(2*time.Second), activity.Entries[2].Timestamp)
+	}
+}
@@ -0,0 +1,175 @@
+package logging
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+)
+
+// FileSink writes entries as lines of JSON to a local file, and rotates the file when it grows too large or too old.
+// Rotated files are renamed with the time of rotation added to the name, and are optionally compressed with gzip in the
+// background.
+type FileSink struct {
+	Path     string
+	MaxBytes int64         // The file is rotated once it reaches this size, 100 MiB if unset.
+	MaxAge   time.Duration // The file is rotated by the first write after it is this old. No limit if unset.
+	MaxFiles int           // Number of rotated files to keep, the oldest are removed. All are kept if unset.
+	Compress bool          // Compress rotated files with gzip.
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+	closed bool
+
+	rotated sync.Mutex     // Held while compressing and pruning rotated files.
+	pending sync.WaitGroup // Rotated files being compressed and pruned.
+}
+
+func (s *FileSink) Write(ctx context.Context, entries []*RequestLog) error {
+	body, err := encodeLines(entries)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return fmt.Errorf("access log file %q has been closed", s.Path)
+	}
+	if s.f != nil && s.MaxAge > 0 && time.Since(s.opened) >= s.MaxAge {
+		s.rotate(ctx)
+	}
+	if s.f == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(body)
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("couldn't write access log file: %v", err)
+	}
+	maxBytes := s.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = 100 << 20
+	}
+	if s.size >= maxBytes {
+		s.rotate(ctx)
+	}
+	return nil
+}
+
+// Close closes the file, and waits for any rotated files to be compressed.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	s.mu.Unlock()
+	s.pending.Wait()
+	return err
+}
+
+// open opens the file for appending. s.mu must be held.
+func (s *FileSink) open() error {
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return fmt.Errorf("couldn't create access log directory: %v", err)
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open access log file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't open access log file: %v", err)
+	}
+	s.f = f
+	s.size = info.Size()
+	// An existing file is treated as new, its age is not known.
+	s.opened = time.Now()
+	return nil
+}
+
+// rotate closes the file and renames it, and compresses and prunes the rotated files in the background. The next write
+// opens a new file. Errors are logged rather than returned, because the entries that caused the rotation have already
+// been written. s.mu must be held.
+func (s *FileSink) rotate(ctx context.Context) {
+	if err := s.f.Close(); err != nil {
+		logger.Errorf(ctx, "Error closing access log file: %v", err)
+	}
+	s.f = nil
+	rotated := s.Path + "." + time.Now().UTC().Format("20060102-150405.000000")
+	if err := os.Rename(s.Path, rotated); err != nil {
+		logger.Errorf(ctx, "Error rotating access log file: %v", err)
+		return
+	}
+	s.pending.Add(1)
+	go func() {
+		defer s.pending.Done()
+		s.rotated.Lock()
+		defer s.rotated.Unlock()
+		if s.Compress {
+			if err := compress(rotated); err != nil {
+				logger.Errorf(ctx, "Error compressing access log file: %v", err)
+			}
+		}
+		if s.MaxFiles > 0 {
+			s.prune(ctx)
+		}
+	}()
+}
+
+// compress replaces filename with a gzipped copy.
+func compress(filename string) error {
+	in, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(filename+".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(filename + ".gz")
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// prune removes the oldest rotated files, keeping MaxFiles. s.rotated must be held.
+func (s *FileSink) prune(ctx context.Context) {
+	matches, err := filepath.Glob(s.Path + ".*")
+	if err != nil {
+		logger.Errorf(ctx, "Error listing rotated access log files: %v", err)
+		return
+	}
+	// The rotation time in the name sorts in the order the files were rotated.
+	sort.Strings(matches)
+	for len(matches) > s.MaxFiles {
+		if err := os.Remove(matches[0]); err != nil {
+			logger.Errorf(ctx, "Error removing rotated access log file: %v", err)
+		}
+		matches = matches[1:]
+	}
+}
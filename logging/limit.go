@@ -0,0 +1,81 @@
+package logging
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// maxUserBuckets is the number of users that are tracked before idle users are forgotten.
+const maxUserBuckets = 10000
+
+// UserLimiter limits the rate of something for each user, with a token bucket per user.
+type UserLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+// bucket is the token bucket of one user.
+type bucket struct {
+	tokens float64
+	last   time.Time
+	denied int // Events refused since the last one that was allowed.
+}
+
+// NewUserLimiter returns a UserLimiter that allows rate events per second for each user, and up to burst at once.
+// There is no limit if rate is 0.
+func NewUserLimiter(rate float64, burst int) *UserLimiter {
+	return &UserLimiter{
+		rate:    rate,
+		burst:   math.Max(1, float64(burst)),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// Allow takes a token from the user's bucket, if there is one. Events without a user are not limited.
+func (l *UserLimiter) Allow(userid string) bool {
+	ok, _ := l.Take(userid)
+	return ok
+}
+
+// Take is like Allow, but when the event is allowed it also returns the number of the user's events that were refused
+// since the last one that was allowed.
+func (l *UserLimiter) Take(userid string) (bool, int) {
+	if l.rate == 0 || userid == "" {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[userid]
+	if !ok {
+		if len(l.buckets) >= maxUserBuckets {
+			l.forgetIdle(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[userid] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		b.denied++
+		return false, 0
+	}
+	b.tokens--
+	denied := b.denied
+	b.denied = 0
+	return true, denied
+}
+
+// forgetIdle removes the buckets of users who have been idle long enough for their bucket to refill, which are the
+// same as a new bucket. l.mu must be held.
+func (l *UserLimiter) forgetIdle(now time.Time) {
+	for userid, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, userid)
+		}
+	}
+}
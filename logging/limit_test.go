@@ -0,0 +1,32 @@
+package logging
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserLimiter(t *testing.T) {
+	l := NewUserLimiter(0.001, 2)
+	assert.True(t, l.Allow("a"))
+	assert.True(t, l.Allow("a"))
+	assert.False(t, l.Allow("a"))
+	assert.True(t, l.Allow("b"))
+	assert.True(t, l.Allow(""))
+
+	// Take counts the events that were refused since the last one allowed.
+	l.buckets["a"].last = time.Now().Add(-time.Hour)
+	ok, denied := l.Take("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, denied)
+	ok, denied = l.Take("a")
+	assert.True(t, ok)
+	assert.Equal(t, 0, denied)
+
+	// Without a rate, nothing is limited.
+	l = NewUserLimiter(0, 1)
+	for i := 0; i < 10; i++ {
+		assert.True(t, l.Allow("a"))
+	}
+}
@@ -1,95 +1,335 @@
 package logging
 
 import (
-	"bytes"
 	"context"
-	"crypto/sha1"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"hash"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
+	"sync"
 	"time"
 
-	"cloud.google.com/go/bigquery"
-	"cloud.google.com/go/civil"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/middleware"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
 	wrap "gopkg.in/go-on/wrap.v2"
 )
 
+// RequestLog is an access log entry. The BigQuery table schema is in Schema.
 type RequestLog struct {
-	Timestamp      civil.DateTime `bigquery:"timestamp"`
-	URI            string         `bigquery:"uri"`
-	Method         string         `bigquery:"method"`
-	Proto          string         `bigquery:"proto"`
-	Host           string         `bigquery:"source"`
-	RequestHeader  []string       `bigquery:"request_header"`
-	RequestLength  int            `bigquery:"request_length"`
-	RequestHash    string         `bigquery:"request_hash"`
-	ResponseCode   int            `bigquery:"response_code"`
-	ResponseHeader []string       `bigquery:"response_header"`
+	Timestamp      time.Time `bigquery:"timestamp" json:"timestamp"` // Always UTC.
+	URI            string    `bigquery:"uri" json:"uri"`
+	Method         string    `bigquery:"method" json:"method"`
+	Proto          string    `bigquery:"proto" json:"proto"`
+	Host           string    `bigquery:"source" json:"source"`
+	RequestHeader  []string  `bigquery:"request_header" json:"request_header,omitempty"`
+	RequestLength  int64     `bigquery:"request_length" json:"request_length"`
+	RequestHash    string    `bigquery:"request_hash" json:"request_hash,omitempty"`
+	ResponseCode   int       `bigquery:"response_code" json:"response_code"`
+	ResponseHeader []string  `bigquery:"response_header" json:"response_header,omitempty"`
+	ResponseLength int64     `bigquery:"response_length" json:"response_length"`
+	LatencyMs      float64   `bigquery:"latency_ms" json:"latency_ms"`
+	UserID         string    `bigquery:"user_id" json:"user_id,omitempty"`
+	DocumentID     string    `bigquery:"document_id" json:"document_id,omitempty"`
+	TraceID        string    `bigquery:"trace_id" json:"trace_id,omitempty"`
+	SpanID         string    `bigquery:"span_id" json:"span_id,omitempty"`
+	RemoteIP       string    `bigquery:"remote_ip" json:"remote_ip,omitempty"` // Truncated by the redaction policy.
+	UserAgent      string    `bigquery:"user_agent" json:"user_agent,omitempty"`
+	// SampleRate is the fraction of requests like this one that are logged. Each entry stands for 1/SampleRate
+	// requests.
+	SampleRate float64 `bigquery:"sample_rate" json:"sample_rate"`
+	RequestID  string  `bigquery:"request_id" json:"request_id,omitempty"`
+
+	// InsertID is used by BigQuery to discard an entry that is written more than once.
+	InsertID string `bigquery:"-" json:"insert_id"`
+}
+
+// legacyTimestamp is the layout of timestamps in entries that were spooled before timestamps were stored in UTC. They
+// were a civil.DateTime in the server's local time, with no zone.
+const legacyTimestamp = "2006-01-02T15:04:05.999999999"
+
+// legacyLocation is the time zone of legacy timestamps, both in spooled entries and in the BigQuery table.
+var legacyLocation = time.Local
+
+// legacyZone returns legacyLocation in a form that BigQuery accepts. The local zone is only named when it comes from
+// $TZ, so otherwise its current offset from UTC is used.
+func legacyZone() string {
+	if name := legacyLocation.String(); name != "" && name != "Local" {
+		if _, err := time.LoadLocation(name); err == nil {
+			return name
+		}
+	}
+	_, offset := time.Now().In(legacyLocation).Zone()
+	sign := "+"
+	if offset < 0 {
+		sign, offset = "-", -offset
+	}
+	return fmt.Sprintf("%s%02d:%02d", sign, offset/3600, offset%3600/60)
+}
+
+// UnmarshalJSON decodes an entry, including one that was spooled with a legacy timestamp.
+func (l *RequestLog) UnmarshalJSON(b []byte) error {
+	type entry RequestLog
+	v := struct {
+		*entry
+		Timestamp string `json:"timestamp"`
+	}{entry: (*entry)(l)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.Timestamp == "" {
+		l.Timestamp = time.Time{}
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v.Timestamp)
+	if err != nil {
+		if t, err = time.ParseInLocation(legacyTimestamp, v.Timestamp, legacyLocation); err != nil {
+			return fmt.Errorf("invalid access log timestamp %q", v.Timestamp)
+		}
+	}
+	l.Timestamp = t.UTC()
+	return nil
 }
 
 type LogMiddleware struct {
-	Table *bigquery.Table
+	// mu protects sink, redactor and sampler, which may be replaced while requests are being served.
+	mu       sync.RWMutex
+	sink     Sink
+	redactor *Redactor
+	sampler  *Sampler
+
+	// Shipper queues entries to be written with Write in the background. If nil, each entry is written before the
+	// request completes.
+	Shipper *Shipper
+}
+
+// SetSink changes the sink used for entries that are written after it returns. The previous sink is returned, and
+// should be closed by the caller.
+func (m *LogMiddleware) SetSink(sink Sink) Sink {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.sink
+	m.sink = sink
+	return old
 }
 
+// SetRedaction changes the policy for removing sensitive data from entries. Until it is called, cookies, credentials
+// and encryption keys are removed, IP addresses are truncated and request bodies are not hashed.
+func (m *LogMiddleware) SetRedaction(r Redaction) error {
+	redactor, err := NewRedactor(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.redactor = redactor
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *LogMiddleware) getRedactor() *Redactor {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.redactor == nil {
+		return defaultRedactor
+	}
+	return m.redactor
+}
+
+// SetSampling changes the policy for choosing which requests are logged. Until it is called, every request is logged.
+func (m *LogMiddleware) SetSampling(s Sampling) error {
+	sampler, err := NewSampler(s)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.sampler = sampler
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *LogMiddleware) getSampler() *Sampler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.sampler
+}
+
+// Write writes entries to the current sink.
+func (m *LogMiddleware) Write(ctx context.Context, entries []*RequestLog) error {
+	m.mu.RLock()
+	sink := m.sink
+	m.mu.RUnlock()
+	if sink == nil {
+		return fmt.Errorf("no access log sink has been set")
+	}
+	return sink.Write(ctx, entries)
+}
+
+// Close closes the current sink. It should be called after the Shipper has been closed.
+func (m *LogMiddleware) Close() error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.sink == nil {
+		return nil
+	}
+	return m.sink.Close()
+}
+
+type entryKey struct{}
+
+// SetUserID records the authenticated user in the access log entry for the request that ctx belongs to. It does
+// nothing if the request isn't being logged.
+func SetUserID(ctx context.Context, userid string) {
+	if entry, ok := ctx.Value(entryKey{}).(*RequestLog); ok {
+		entry.UserID = userid
+	}
+}
+
+// SetDocumentID records the document that a request acts on in its access log entry, for requests that don't have
+// the document ID in the URL. It does nothing if the request isn't being logged.
+func SetDocumentID(ctx context.Context, id string) {
+	if entry, ok := ctx.Value(entryKey{}).(*RequestLog); ok {
+		entry.DocumentID = id
+	}
+}
+
+// countingWriter counts the bytes written in the response body.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// maxDrain is the most of a request body that is read after the handler returns, if the handler didn't read all of
+// it. The HTTP server reads the same amount to reuse the connection, so this costs nothing extra.
+const maxDrain = 256 << 10
+
+// bodyReader counts, and optionally hashes, a request body as the handler reads it, so that the body doesn't have to
+// be held in memory.
+type bodyReader struct {
+	io.ReadCloser
+	hash hash.Hash // nil if the body isn't hashed.
+	n    int64
+	eof  bool
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	if r.hash != nil {
+		r.hash.Write(p[:n])
+	}
+	if err == io.EOF {
+		r.eof = true
+	}
+	return n, err
+}
+
+// finish reads whatever is left of a short body, and returns the length and hash of the body. If the handler left
+// more of the body unread than maxDrain, the hash is empty and the length is the Content-Length, if there was one.
+func (r *bodyReader) finish(contentLength int64) (int64, string) {
+	if !r.eof {
+		io.CopyN(ioutil.Discard, r, maxDrain)
+	}
+	if !r.eof {
+		if contentLength > r.n {
+			return contentLength, ""
+		}
+		return r.n, ""
+	}
+	if r.hash == nil || r.n == 0 {
+		return r.n, ""
+	}
+	return r.n, encodeHash(r.hash)
+}
+
+// Middleware logs every request. Each request is traced, with the trace and span IDs recorded in the entry so that
+// it can be correlated with the spans of the handler, and with the application logs by its request ID.
 func (m *LogMiddleware) Middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		// Read the body, then re-inject it back into the request for the next middleware.
-		body, _ := ioutil.ReadAll(req.Body)
-		req.Body.Close()
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		start := time.Now()
+		redactor := m.getRedactor()
+		// Don't store the entire request body, just its length and a keyed hash of it, worked out as the handler
+		// reads it.
+		body := &bodyReader{ReadCloser: req.Body, hash: redactor.bodyHash()}
+		req.Body = body
 
 		entry := &RequestLog{
-			Timestamp:     civil.DateTimeOf(time.Now()),
-			URI:           req.RequestURI,
+			Timestamp:     start.UTC(),
+			URI:           redactor.URI(req.URL),
 			Method:        req.Method,
 			Proto:         req.Proto,
 			Host:          req.Host,
-			RequestLength: len(body),
-		}
-
-		for k, values := range req.Header {
-			for _, v := range values {
-				entry.RequestHeader = append(entry.RequestHeader, fmt.Sprintf("%s=%s", k, v))
-			}
+			RequestHeader: redactor.Headers(req.Header),
+			InsertID:      uuid.New().String(),
+			RequestID:     middleware.GetRequestID(req.Context()),
+			RemoteIP:      remoteIP(redactor, req.RemoteAddr),
+			UserAgent:     req.UserAgent(),
+			DocumentID:    mux.Vars(req)["id"],
 		}
 
-		if len(body) > 0 {
-			// Don't store the entire request body, just a SHA-1 hash of it.
-			hash := sha1.New()
-			hash.Write(body)
-			entry.RequestHash = base64.URLEncoding.EncodeToString(hash.Sum(nil))
+		// The span is normally started by middleware.RequestID.
+		ctx := req.Context()
+		span := trace.FromContext(ctx)
+		if span == nil {
+			ctx, span = trace.StartSpan(ctx, "HTTP "+req.Method)
+			defer span.End()
 		}
+		sc := span.SpanContext()
+		entry.TraceID = sc.TraceID.String()
+		entry.SpanID = sc.SpanID.String()
+		ctx = context.WithValue(ctx, entryKey{}, entry)
 
-		peek := wrap.NewPeek(w, func(p *wrap.Peek) bool {
+		counter := &countingWriter{ResponseWriter: w}
+		peek := wrap.NewPeek(counter, func(p *wrap.Peek) bool {
 			p.FlushMissing()
 			return true
 		})
-		next.ServeHTTP(peek, req)
+		next.ServeHTTP(peek, req.WithContext(ctx))
+
+		entry.RequestLength, entry.RequestHash = body.finish(req.ContentLength)
+		entry.ResponseLength = counter.n
+		entry.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
 
 		entry.ResponseCode = peek.Code
 		if entry.ResponseCode == 0 {
 			// If the handler doesn't explicitly set a response code, 200 is assumed.
 			entry.ResponseCode = http.StatusOK
 		}
-		for k, values := range peek.ResponseWriter.Header() {
-			for _, v := range values {
-				entry.ResponseHeader = append(entry.ResponseHeader, fmt.Sprintf("%s=%s", k, v))
+		entry.ResponseHeader = redactor.Headers(peek.ResponseWriter.Header())
+
+		entry.SampleRate = 1
+		if sampler := m.getSampler(); sampler != nil {
+			var keep bool
+			if entry.SampleRate, keep = sampler.Sample(entry, sc.TraceID); !keep {
+				return
 			}
 		}
 
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		u := m.Table.Uploader()
-		// Write the log entry to BigQuery.
-		if err := u.Put(ctx, entry); err != nil {
-			log.Printf("Error writing access log to BigQuery: %v", err)
-			if m, ok := err.(bigquery.PutMultiError); ok {
-				for _, err := range m {
-					log.Print(err)
-				}
-			}
+		if m.Shipper != nil {
+			m.Shipper.Add(entry)
+			return
+		}
+		if err := m.Write(context.Background(), []*RequestLog{entry}); err != nil {
+			logger.Errorf(req.Context(), "Error writing access log: %v", err)
 		}
 	})
 }
+
+// remoteIP returns the truncated IP address of the client, without the port.
+func remoteIP(redactor *Redactor, addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return redactor.TruncateIP(addr)
+}
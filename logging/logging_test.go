@@ -0,0 +1,184 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func TestMiddleware(t *testing.T) {
+	r := &recorder{}
+	m := &LogMiddleware{}
+	m.SetSink(r)
+	var traceID string
+	router := mux.NewRouter()
+	router.Use(m.Middleware)
+	router.HandleFunc("/document/{id}", func(w http.ResponseWriter, req *http.Request) {
+		// Handler spans are part of the request's trace.
+		_, span := trace.StartSpan(req.Context(), "handler")
+		traceID = span.SpanContext().TraceID.String()
+		span.End()
+		SetUserID(req.Context(), "user-1")
+		w.Write([]byte("hello "))
+		w.Write([]byte("world"))
+	})
+
+	req := httptest.NewRequest("GET", "/document/doc-1", nil)
+	req.RemoteAddr = "203.0.113.57:1234"
+	req.Header.Set("User-Agent", "test-agent")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	if assert.Len(t, r.batches, 1) {
+		entry := r.batches[0][0]
+		assert.Equal(t, time.UTC, entry.Timestamp.Location())
+		assert.Equal(t, int64(11), entry.ResponseLength)
+		assert.True(t, entry.LatencyMs > 0)
+		assert.Equal(t, "user-1", entry.UserID)
+		assert.Equal(t, "doc-1", entry.DocumentID)
+		assert.Equal(t, traceID, entry.TraceID)
+		assert.Len(t, entry.SpanID, 16)
+		assert.Equal(t, "203.0.113.0", entry.RemoteIP)
+		assert.Equal(t, "test-agent", entry.UserAgent)
+	}
+
+	// Setting fields outside of a logged request does nothing.
+	SetUserID(req.Context(), "user-2")
+	SetDocumentID(req.Context(), "doc-2")
+}
+
+func TestMiddlewareBody(t *testing.T) {
+	r := &recorder{}
+	m := &LogMiddleware{}
+	m.SetSink(r)
+	assert.Nil(t, m.SetRedaction(Redaction{HMACKey: "key"}))
+	var read int
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/json":
+			// The decoder stops at the end of the value, leaving the trailing newline unread.
+			var v map[string]string
+			assert.Nil(t, json.NewDecoder(req.Body).Decode(&v))
+		case "/prefix":
+			buf := make([]byte, 10)
+			read, _ = io.ReadFull(req.Body, buf)
+		}
+	}))
+
+	short := []byte(`{"name":"a"}` + "\n")
+	long := bytes.Repeat([]byte("x"), maxDrain*2)
+	for _, path := range []string{"/json", "/unread"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", path, bytes.NewReader(short)))
+	}
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/prefix", bytes.NewReader(long)))
+
+	redactor := m.getRedactor()
+	if assert.Len(t, r.batches, 3) {
+		for _, batch := range r.batches[:2] {
+			assert.Equal(t, int64(len(short)), batch[0].RequestLength, batch[0].URI)
+			assert.Equal(t, redactor.BodyHash(short), batch[0].RequestHash, batch[0].URI)
+		}
+		// Too much of the body was left unread to hash it.
+		assert.Equal(t, 10, read)
+		assert.Equal(t, int64(len(long)), r.batches[2][0].RequestLength)
+		assert.Equal(t, "", r.batches[2][0].RequestHash)
+	}
+}
+
+// zeros is an endless request body that doesn't use any memory.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// BenchmarkMiddlewareUpload streams uploads of increasing size through the middleware. The memory used per
+// operation should be the same for every size.
+func BenchmarkMiddlewareUpload(b *testing.B) {
+	m := &LogMiddleware{}
+	m.SetSink(failingSink{})
+	if err := m.SetRedaction(Redaction{HMACKey: "key"}); err != nil {
+		b.Fatal(err)
+	}
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.Copy(ioutil.Discard, req.Body)
+	}))
+	log.SetOutput(ioutil.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for _, size := range []int64{1 << 20, 64 << 20, 1 << 30} {
+		b.Run(fmt.Sprintf("%dMiB", size>>20), func(b *testing.B) {
+			b.SetBytes(size)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/document/", io.LimitReader(zeros{}, size))
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+// TestSchema checks that Schema, access_log_schema.json and the fields saved from RequestLog all agree.
+func TestSchema(t *testing.T) {
+	body, err := ioutil.ReadFile("../access_log_schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields []struct{ Name, Mode, Type string }
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, f := range fields {
+		want = append(want, strings.Join([]string{f.Name, f.Mode, f.Type}, " "))
+	}
+	var got []string
+	for _, f := range Schema {
+		mode := "NULLABLE"
+		if f.Required {
+			mode = "REQUIRED"
+		} else if f.Repeated {
+			mode = "REPEATED"
+		}
+		got = append(got, strings.Join([]string{f.Name, mode, string(f.Type)}, " "))
+	}
+	assert.Equal(t, want, got)
+
+	inferred, err := bigquery.InferSchema(RequestLog{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, inferred, len(Schema)) {
+		for i, f := range inferred {
+			assert.Equal(t, Schema[i].Name, f.Name)
+			assert.Equal(t, Schema[i].Type, f.Type, f.Name)
+		}
+	}
+}
+
+func TestLegacyZone(t *testing.T) {
+	defer func(loc *time.Location) { legacyLocation = loc }(legacyLocation)
+
+	legacyLocation = time.UTC
+	assert.Equal(t, "UTC", legacyZone())
+	legacyLocation = time.FixedZone("Local", -(5*3600 + 1800))
+	assert.Equal(t, "-05:30", legacyZone())
+	legacyLocation = time.FixedZone("", 10*3600)
+	assert.Equal(t, "+10:00", legacyZone())
+}
@@ -0,0 +1,235 @@
+package logging
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Redacted replaces values that must not be logged.
+const Redacted = "[REDACTED]"
+
+// alwaysDeny contains headers that are never logged, whatever the redaction policy.
+var alwaysDeny = []string{
+	"Cookie",
+	"Proxy-Authorization",
+	"Set-Cookie",
+	"X-Encryption-Key",
+}
+
+// Redaction is the policy for removing sensitive data from access log entries, as found in the access_log.redaction
+// section of the configuration.
+type Redaction struct {
+	// DenyHeaders are never logged, in addition to cookies and encryption keys.
+	DenyHeaders []string `config:"deny_headers"`
+	// AllowHeaders, if set, are the only headers that are logged.
+	AllowHeaders []string `config:"allow_headers"`
+	// JWTClaims are kept from a bearer token in the Authorization header, which is otherwise replaced. The token is
+	// not verified.
+	JWTClaims []string `config:"jwt_claims" default:"sub,jti"`
+	// IPHeaders contain client IP addresses, which are truncated to IPv4Prefix or IPv6Prefix bits.
+	IPHeaders  []string `config:"ip_headers" default:"X-Forwarded-For,X-Real-Ip"`
+	IPv4Prefix int      `config:"ipv4_prefix" default:"24" min:"0" max:"32"`
+	IPv6Prefix int      `config:"ipv6_prefix" default:"48" min:"0" max:"128"`
+	// QueryParams are removed from the logged URI.
+	QueryParams []string `config:"query_params" default:"access_token,id_token,token"`
+	// HMACKey is used to hash request bodies. If unset, no hash is recorded.
+	HMACKey string `config:"hmac_key"`
+}
+
+// Redactor applies a Redaction policy.
+type Redactor struct {
+	deny      map[string]bool
+	allow     map[string]bool
+	ipHeaders map[string]bool
+	claims    []string
+	params    []string
+	ipv4      net.IPMask
+	ipv6      net.IPMask
+	key       []byte
+}
+
+// NewRedactor returns a Redactor for the policy.
+func NewRedactor(r Redaction) (*Redactor, error) {
+	if r.IPv4Prefix < 0 || r.IPv4Prefix > 32 || r.IPv6Prefix < 0 || r.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("IP prefix lengths must be between 0 and 32 for IPv4, and 0 and 128 for IPv6")
+	}
+	return &Redactor{
+		deny:      headerSet(append(append([]string{}, alwaysDeny...), r.DenyHeaders...)),
+		allow:     headerSet(r.AllowHeaders),
+		ipHeaders: headerSet(r.IPHeaders),
+		claims:    r.JWTClaims,
+		params:    r.QueryParams,
+		ipv4:      net.CIDRMask(r.IPv4Prefix, 32),
+		ipv6:      net.CIDRMask(r.IPv6Prefix, 128),
+		key:       []byte(r.HMACKey),
+	}, nil
+}
+
+// defaultRedactor is used until a policy is set. It keeps nothing from the Authorization header and doesn't hash
+// request bodies.
+var defaultRedactor, _ = NewRedactor(Redaction{
+	IPHeaders:   []string{"X-Forwarded-For", "X-Real-Ip"},
+	IPv4Prefix:  24,
+	IPv6Prefix:  48,
+	QueryParams: []string{"access_token", "id_token", "token"},
+})
+
+func headerSet(headers []string) map[string]bool {
+	m := make(map[string]bool, len(headers))
+	for _, h := range headers {
+		m[http.CanonicalHeaderKey(strings.TrimSpace(h))] = true
+	}
+	return m
+}
+
+// URI returns the request URI with the values of any redacted query parameters replaced.
+func (r *Redactor) URI(u *url.URL) string {
+	if u.RawQuery == "" || len(r.params) == 0 {
+		return u.RequestURI()
+	}
+	query := u.Query()
+	changed := false
+	for _, p := range r.params {
+		if values, ok := query[p]; ok {
+			for i := range values {
+				values[i] = Redacted
+			}
+			changed = true
+		}
+	}
+	if !changed {
+		return u.RequestURI()
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.RequestURI()
+}
+
+// Headers returns the headers that may be logged, as sorted key=value strings.
+func (r *Redactor) Headers(header http.Header) []string {
+	var l []string
+	for k, values := range header {
+		k = http.CanonicalHeaderKey(k)
+		if r.deny[k] || (len(r.allow) > 0 && !r.allow[k]) {
+			continue
+		}
+		for _, v := range values {
+			switch {
+			case k == "Authorization":
+				v = r.authorization(v)
+			case r.ipHeaders[k]:
+				v = r.ipList(v)
+			}
+			l = append(l, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+// authorization replaces the credentials in an Authorization header. Only the configured claims are kept from a JWT
+// bearer token.
+func (r *Redactor) authorization(v string) string {
+	parts := strings.SplitN(v, " ", 2)
+	scheme := parts[0]
+	if len(parts) != 2 || !strings.EqualFold(scheme, "Bearer") || len(r.claims) == 0 {
+		if len(parts) != 2 {
+			return Redacted
+		}
+		return scheme + " " + Redacted
+	}
+	claims, err := jwtClaims(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return scheme + " " + Redacted
+	}
+	var kept []string
+	for _, name := range r.claims {
+		if value, ok := claims[name]; ok {
+			kept = append(kept, fmt.Sprintf("%s=%v", name, value))
+		}
+	}
+	if len(kept) == 0 {
+		return scheme + " " + Redacted
+	}
+	return scheme + " " + strings.Join(kept, " ")
+}
+
+// jwtClaims decodes the claims of a JWT without verifying it.
+func jwtClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ipList truncates every address in a comma separated list, such as X-Forwarded-For. Anything that isn't an IP
+// address is redacted.
+func (r *Redactor) ipList(v string) string {
+	parts := strings.Split(v, ",")
+	for i, p := range parts {
+		parts[i] = r.TruncateIP(strings.TrimSpace(p))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// TruncateIP removes the host part of an IP address, which may include a port. Anything that isn't an IP address is
+// redacted.
+func (r *Redactor) TruncateIP(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Redacted
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		host = ip4.Mask(r.ipv4).String()
+	} else {
+		host = ip.Mask(r.ipv6).String()
+	}
+	if port != "" {
+		return net.JoinHostPort(host, port)
+	}
+	return host
+}
+
+// BodyHash returns a keyed hash of a request body, or an empty string if there is no key or no body.
+func (r *Redactor) BodyHash(body []byte) string {
+	h := r.bodyHash()
+	if h == nil || len(body) == 0 {
+		return ""
+	}
+	h.Write(body)
+	return encodeHash(h)
+}
+
+// bodyHash returns a keyed hash for request bodies, or nil if there is no key.
+func (r *Redactor) bodyHash() hash.Hash {
+	if len(r.key) == 0 {
+		return nil
+	}
+	return hmac.New(sha256.New, r.key)
+}
+
+func encodeHash(h hash.Hash) string {
+	return base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,146 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testJWT returns an unsigned token with the given claims, and a signature that must never be logged.
+func testJWT(claims string) string {
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString([]byte(`{"alg":"RS256"}`)) + "." + enc.EncodeToString([]byte(claims)) + ".c2lnbmF0dXJlLXNlY3JldA"
+}
+
+func redactor(t *testing.T, r Redaction) *Redactor {
+	redactor, err := NewRedactor(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return redactor
+}
+
+func TestRedactHeaders(t *testing.T) {
+	r := redactor(t, Redaction{DenyHeaders: []string{"x-api-key"}, JWTClaims: []string{"sub", "jti"}, IPv4Prefix: 24, IPv6Prefix: 48})
+	header := http.Header{
+		"Authorization":    {"Bearer " + testJWT(`{"sub":"auth0|user-1","jti":"token-1","email":"user@example.com"}`)},
+		"Cookie":           {"session=secret"},
+		"X-Api-Key":        {"secret"},
+		"X-Encryption-Key": {"secret"},
+		"Accept":           {"application/json"},
+	}
+	assert.Equal(t, []string{
+		"Accept=application/json",
+		"Authorization=Bearer sub=auth0|user-1 jti=token-1",
+	}, r.Headers(header))
+
+	// Only allowed headers are logged, and the deny list still applies.
+	r = redactor(t, Redaction{AllowHeaders: []string{"Accept", "Cookie"}})
+	assert.Equal(t, []string{"Accept=application/json"}, r.Headers(header))
+}
+
+func TestRedactAuthorization(t *testing.T) {
+	r := redactor(t, Redaction{JWTClaims: []string{"sub"}})
+	for header, want := range map[string]string{
+		"Bearer " + testJWT(`{"sub":"user-1"}`): "Bearer sub=user-1",
+		"Bearer " + testJWT(`{"iss":"auth0"}`):  "Bearer " + Redacted,
+		"Bearer opaque-token":                   "Bearer " + Redacted,
+		"Basic dXNlcjpwYXNzd29yZA==":            "Basic " + Redacted,
+		"secret":                                Redacted,
+	} {
+		assert.Equal(t, want, r.authorization(header), header)
+	}
+
+	// No claims are kept by default.
+	assert.Equal(t, "Bearer "+Redacted, defaultRedactor.authorization("Bearer "+testJWT(`{"sub":"user-1"}`)))
+}
+
+func TestTruncateIP(t *testing.T) {
+	r := redactor(t, Redaction{IPHeaders: []string{"X-Forwarded-For"}, IPv4Prefix: 24, IPv6Prefix: 48})
+	assert.Equal(t, "203.0.113.0", r.TruncateIP("203.0.113.57"))
+	assert.Equal(t, "203.0.113.0:443", r.TruncateIP("203.0.113.57:443"))
+	assert.Equal(t, "2001:db8:85a3::", r.TruncateIP("2001:db8:85a3:8d3:1319:8a2e:370:7348"))
+	assert.Equal(t, "[2001:db8:85a3::]:443", r.TruncateIP("[2001:db8:85a3::1]:443"))
+	assert.Equal(t, Redacted, r.TruncateIP("unknown"))
+	assert.Equal(t, []string{"X-Forwarded-For=203.0.113.0, 10.0.0.0"}, r.Headers(http.Header{"X-Forwarded-For": {"203.0.113.57, 10.0.0.1"}}))
+
+	// Prefixes covering the whole address keep it unchanged.
+	r = redactor(t, Redaction{IPv4Prefix: 32, IPv6Prefix: 128})
+	assert.Equal(t, "203.0.113.57", r.TruncateIP("203.0.113.57"))
+
+	_, err := NewRedactor(Redaction{IPv4Prefix: 33})
+	assert.NotNil(t, err)
+}
+
+func TestBodyHash(t *testing.T) {
+	body := []byte(`{"password":"hunter2"}`)
+	assert.Equal(t, "", defaultRedactor.BodyHash(body))
+	a := redactor(t, Redaction{HMACKey: "key-a"})
+	b := redactor(t, Redaction{HMACKey: "key-b"})
+	assert.NotEqual(t, "", a.BodyHash(body))
+	assert.Equal(t, a.BodyHash(body), a.BodyHash(body))
+	assert.NotEqual(t, a.BodyHash(body), b.BodyHash(body))
+	assert.Equal(t, "", a.BodyHash(nil))
+}
+
+// TestSecretsNeverReachSink sends requests full of secrets through the middleware, and checks that none of them are
+// in anything written to the sink.
+func TestSecretsNeverReachSink(t *testing.T) {
+	secrets := []string{
+		"c2lnbmF0dXJlLXNlY3JldA", // JWT signature.
+		"user@example.com",       // JWT claim that isn't kept.
+		"session-secret",
+		"encryption-key-secret",
+		"proxy-secret",
+		"hunter2",
+		"dXNlcjpwYXNzd29yZA",
+		"query-token-secret",
+		"203.0.113.57",
+		"response-cookie-secret",
+	}
+
+	for _, policy := range []*Redaction{
+		nil,
+		{JWTClaims: []string{"sub", "jti"}, HMACKey: "0123456789abcdef", IPHeaders: []string{"X-Forwarded-For"}, IPv4Prefix: 24, IPv6Prefix: 48, QueryParams: []string{"token"}},
+		{AllowHeaders: []string{"Authorization", "Cookie", "Set-Cookie", "X-Forwarded-For"}, IPHeaders: []string{"X-Forwarded-For"}, QueryParams: []string{"token"}},
+	} {
+		r := &recorder{}
+		m := &LogMiddleware{}
+		m.SetSink(r)
+		if policy != nil {
+			assert.Nil(t, m.SetRedaction(*policy))
+		}
+		handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "response-cookie-secret"})
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		for _, auth := range []string{
+			"Bearer " + testJWT(`{"sub":"user-1","jti":"token-1","email":"user@example.com"}`),
+			"Basic dXNlcjpwYXNzd29yZA==",
+		} {
+			req := httptest.NewRequest("POST", "/document/?name=a&token=query-token-secret", strings.NewReader(`{"password":"hunter2"}`))
+			req.Header.Set("Authorization", auth)
+			req.Header.Set("Cookie", "session=session-secret")
+			req.Header.Set("X-Encryption-Key", "encryption-key-secret")
+			req.Header.Set("Proxy-Authorization", "proxy-secret")
+			req.Header.Set("X-Forwarded-For", "203.0.113.57")
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		var logged bytes.Buffer
+		for _, batch := range r.batches {
+			assert.Nil(t, json.NewEncoder(&logged).Encode(batch))
+		}
+		assert.Equal(t, 2, strings.Count(logged.String(), `"method":"POST"`))
+		for _, secret := range secrets {
+			assert.NotContains(t, logged.String(), secret, "policy %+v", policy)
+		}
+	}
+}
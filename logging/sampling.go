@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"go.opencensus.io/trace"
+)
+
+// Sampling is the policy for choosing which requests are logged, as found in the access_log.sampling section of the
+// configuration. Errors and requests that change anything are always logged. Only successful reads are sampled, and
+// capped per user.
+type Sampling struct {
+	// ReadRate is the fraction of successful GET, HEAD and OPTIONS requests that are logged.
+	ReadRate float64 `config:"read_rate" default:"1" min:"0" max:"1"`
+	// PathRates overrides ReadRate for reads of particular paths. A path matches exactly, or if it ends with "*", as a
+	// prefix. An exact match is used before the longest matching prefix. The query string isn't matched.
+	PathRates map[string]interface{} `config:"path_rates"`
+	// UserRate limits the number of reads logged per second for each authenticated user, after sampling. There is no
+	// limit if it is 0. The sample rate of the next read that is logged for the user is lowered to account for the
+	// reads that were dropped, so that it stands for them too.
+	UserRate float64 `config:"user_rate" min:"0"`
+	// UserBurst is the number of reads that may be logged at once for a user before UserRate applies.
+	UserBurst int `config:"user_burst" default:"10" min:"1"`
+}
+
+// Sampler applies a Sampling policy. The decision for a request depends only on its trace ID, in the same way as
+// trace.ProbabilitySampler, so a request that is logged at a rate is also traced if traces are sampled at the same or
+// a higher rate.
+type Sampler struct {
+	readRate float64
+	paths    []pathRate
+	users    *UserLimiter
+}
+
+type pathRate struct {
+	path   string
+	prefix bool // Whether path matches as a prefix, rather than exactly.
+	rate   float64
+}
+
+// NewSampler returns a Sampler for the policy.
+func NewSampler(s Sampling) (*Sampler, error) {
+	if s.ReadRate < 0 || s.ReadRate > 1 {
+		return nil, fmt.Errorf("sample rate %v must be between 0 and 1", s.ReadRate)
+	}
+	if s.UserRate < 0 {
+		return nil, fmt.Errorf("user rate %v must not be negative", s.UserRate)
+	}
+	sampler := &Sampler{
+		readRate: s.ReadRate,
+		users:    NewUserLimiter(s.UserRate, s.UserBurst),
+	}
+	for path, v := range s.PathRates {
+		rate, err := toRate(v)
+		if err != nil {
+			return nil, fmt.Errorf("sample rate for %q: %v", path, err)
+		}
+		p := pathRate{path: path, rate: rate}
+		if strings.HasSuffix(path, "*") {
+			p.path, p.prefix = strings.TrimSuffix(path, "*"), true
+		}
+		sampler.paths = append(sampler.paths, p)
+	}
+	return sampler, nil
+}
+
+func toRate(v interface{}) (float64, error) {
+	var rate float64
+	switch v := v.(type) {
+	case float64:
+		rate = v
+	case int:
+		rate = float64(v)
+	case string:
+		var err error
+		if rate, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("%v is not a number", v)
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("%v must be between 0 and 1", rate)
+	}
+	return rate, nil
+}
+
+// Sample decides whether a completed request is logged, and returns the rate at which requests like it are sampled.
+// If reads by the same user were dropped by the user limit since the last one that was logged, the rate of a logged
+// read is divided between it and them.
+func (s *Sampler) Sample(entry *RequestLog, traceID trace.TraceID) (float64, bool) {
+	if entry.ResponseCode >= 400 || !isRead(entry.Method) {
+		return 1, true
+	}
+	rate := s.rate(entry.URI)
+	// The same calculation as trace.ProbabilitySampler.
+	if rate < 1 && binary.BigEndian.Uint64(traceID[0:8])>>1 >= uint64(rate*(1<<63)) {
+		recordDropped("sampled", 1)
+		return rate, false
+	}
+	ok, denied := s.users.Take(entry.UserID)
+	if !ok {
+		recordDropped("user_limit", 1)
+		return rate, false
+	}
+	return rate / float64(1+denied), true
+}
+
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// rate returns the sample rate for reads of uri.
+func (s *Sampler) rate(uri string) float64 {
+	path := uri
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	rate, longest := s.readRate, -1
+	for _, p := range s.paths {
+		if !p.prefix && p.path == path {
+			return p.rate
+		}
+		if p.prefix && strings.HasPrefix(path, p.path) && len(p.path) > longest {
+			rate, longest = p.rate, len(p.path)
+		}
+	}
+	return rate
+}
@@ -0,0 +1,124 @@
+package logging
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.opencensus.io/trace"
+)
+
+func randomTraceID() trace.TraceID {
+	var id trace.TraceID
+	rand.Read(id[:])
+	return id
+}
+
+func TestSampler(t *testing.T) {
+	s, err := NewSampler(Sampling{ReadRate: 0.5, PathRates: map[string]interface{}{"/document/": 0.1, "/document/*": 0.2, "/document/a*": "0"}, UserBurst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := &RequestLog{Method: "GET", URI: "/document/", ResponseCode: 200}
+	kept := 0
+	for i := 0; i < 10000; i++ {
+		id := randomTraceID()
+		rate, keep := s.Sample(read, id)
+		assert.Equal(t, 0.1, rate)
+		// Requests are logged when they would be traced at the same rate.
+		assert.Equal(t, trace.ProbabilitySampler(rate)(trace.SamplingParameters{TraceID: id}).Sample, keep)
+		if keep {
+			kept++
+		}
+	}
+	assert.InDelta(t, 1000, kept, 200)
+
+	// Errors and changes are always logged.
+	for _, entry := range []*RequestLog{
+		{Method: "GET", URI: "/document/a", ResponseCode: 404},
+		{Method: "POST", URI: "/document/a", ResponseCode: 201},
+	} {
+		rate, keep := s.Sample(entry, randomTraceID())
+		assert.Equal(t, 1.0, rate)
+		assert.True(t, keep)
+	}
+
+	// Reads of a document are sampled like any other read.
+	rate, keep := s.Sample(&RequestLog{Method: "GET", URI: "/document/abc", DocumentID: "abc", ResponseCode: 200}, randomTraceID())
+	assert.Equal(t, 0.0, rate)
+	assert.False(t, keep)
+
+	// The longest prefix is used.
+	rate, keep = s.Sample(&RequestLog{Method: "GET", URI: "/document/abc", ResponseCode: 200}, randomTraceID())
+	assert.Equal(t, 0.0, rate)
+	assert.False(t, keep)
+	rate, _ = s.Sample(&RequestLog{Method: "GET", URI: "/document/xyz", ResponseCode: 200}, randomTraceID())
+	assert.Equal(t, 0.2, rate)
+	// An exact path is used before any prefix, whatever the query string.
+	rate, _ = s.Sample(&RequestLog{Method: "GET", URI: "/document/?limit=5", ResponseCode: 200}, randomTraceID())
+	assert.Equal(t, 0.1, rate)
+	rate, _ = s.Sample(&RequestLog{Method: "GET", URI: "/account/activity", ResponseCode: 200}, randomTraceID())
+	assert.Equal(t, 0.5, rate)
+
+	for _, bad := range []Sampling{
+		{ReadRate: 2},
+		{ReadRate: 1, UserRate: -1},
+		{ReadRate: 1, PathRates: map[string]interface{}{"/": 1.5}},
+		{ReadRate: 1, PathRates: map[string]interface{}{"/": "x"}},
+	} {
+		_, err := NewSampler(bad)
+		assert.NotNil(t, err, "%+v", bad)
+	}
+}
+
+func TestSamplerUserLimit(t *testing.T) {
+	s, err := NewSampler(Sampling{ReadRate: 1, UserRate: 0.001, UserBurst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := func(user string) bool {
+		_, keep := s.Sample(&RequestLog{Method: "GET", URI: "/document/", ResponseCode: 200, UserID: user}, randomTraceID())
+		return keep
+	}
+	assert.True(t, sample("a"))
+	assert.True(t, sample("a"))
+	assert.False(t, sample("a"))
+	// Other users, and requests without a user, have their own limits.
+	assert.True(t, sample("b"))
+	assert.True(t, sample(""))
+	assert.True(t, sample(""))
+	assert.True(t, sample(""))
+	// Changes aren't limited.
+	_, keep := s.Sample(&RequestLog{Method: "DELETE", URI: "/document/1", ResponseCode: 200, UserID: "a"}, randomTraceID())
+	assert.True(t, keep)
+
+	// Once the bucket refills, the next read logged stands for the ones that were dropped as well.
+	assert.False(t, sample("a"))
+	s.users.buckets["a"].last = time.Now().Add(-time.Hour)
+	rate, keep := s.Sample(&RequestLog{Method: "GET", URI: "/document/", ResponseCode: 200, UserID: "a"}, randomTraceID())
+	assert.True(t, keep)
+	assert.Equal(t, 1.0/3, rate)
+	rate, _ = s.Sample(&RequestLog{Method: "GET", URI: "/document/", ResponseCode: 200, UserID: "a"}, randomTraceID())
+	assert.Equal(t, 1.0, rate)
+}
+
+func TestMiddlewareSampling(t *testing.T) {
+	r := &recorder{}
+	m := &LogMiddleware{}
+	m.SetSink(r)
+	handler := m.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/document/", nil))
+
+	assert.Nil(t, m.SetSampling(Sampling{ReadRate: 0}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/document/", nil))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/document/", nil))
+
+	if assert.Len(t, r.batches, 2) {
+		assert.Equal(t, "GET", r.batches[0][0].Method)
+		assert.Equal(t, 1.0, r.batches[0][0].SampleRate)
+		assert.Equal(t, "POST", r.batches[1][0].Method)
+	}
+}
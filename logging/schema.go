@@ -0,0 +1,241 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// Schema is the schema of the BigQuery access log table. It must be kept in sync with RequestLog and
+// access_log_schema.json. Fields added after the table was first created are nullable, so that MigrateTable can add
+// them to an existing table.
+var Schema = bigquery.Schema{
+	{Name: "timestamp", Type: bigquery.TimestampFieldType, Required: true},
+	{Name: "uri", Type: bigquery.StringFieldType, Required: true},
+	{Name: "method", Type: bigquery.StringFieldType, Required: true},
+	{Name: "proto", Type: bigquery.StringFieldType, Required: true},
+	{Name: "source", Type: bigquery.StringFieldType, Required: true},
+	{Name: "request_header", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "request_length", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "request_hash", Type: bigquery.StringFieldType, Required: true},
+	{Name: "response_code", Type: bigquery.IntegerFieldType, Required: true},
+	{Name: "response_header", Type: bigquery.StringFieldType, Repeated: true},
+	{Name: "response_length", Type: bigquery.IntegerFieldType},
+	{Name: "latency_ms", Type: bigquery.FloatFieldType},
+	{Name: "user_id", Type: bigquery.StringFieldType},
+	{Name: "document_id", Type: bigquery.StringFieldType},
+	{Name: "trace_id", Type: bigquery.StringFieldType},
+	{Name: "span_id", Type: bigquery.StringFieldType},
+	{Name: "remote_ip", Type: bigquery.StringFieldType},
+	{Name: "user_agent", Type: bigquery.StringFieldType},
+	{Name: "sample_rate", Type: bigquery.FloatFieldType},
+	{Name: "request_id", Type: bigquery.StringFieldType},
+}
+
+// MigrateTable creates the access log table if it doesn't exist, or brings an existing table up to date with Schema.
+// It is safe to run more than once.
+//
+// The table is partitioned by day on the timestamp column, and queries must filter on the timestamp, so that they only
+// scan the days they need. Tables created before the timestamp was stored in UTC have a DATETIME timestamp column, and
+// older tables aren't partitioned. BigQuery can't change the type of a column or partition an existing table, so the
+// table is copied to a backup table, re-created with the same columns, modes, descriptions and expiry but with a
+// TIMESTAMP timestamp and partitioning, and the rows are copied back, treating DATETIME values as UTC. The backup is
+// removed once its rows have been restored. If the rebuild is interrupted, running MigrateTable again finishes it
+// from the backup. Rows still in the streaming buffer may be lost by the copy,
+// so nothing should be writing to the table while it runs; entries that can't be written in the meantime are kept in
+// the spool. Missing columns are then added.
+func MigrateTable(ctx context.Context, client *bigquery.Client, table *bigquery.Table) error {
+	name := tableName(table)
+	backup := client.DatasetInProject(table.ProjectID, table.DatasetID).Table(table.TableID + "_migration_backup")
+	backupMd, err := backup.Metadata(ctx)
+	if err != nil && !notFound(err) {
+		return fmt.Errorf("couldn't read access log backup table %s: %v", tableName(backup), err)
+	}
+
+	md, err := table.Metadata(ctx)
+	if notFound(err) {
+		if backupMd == nil {
+			logger.Infof(ctx, "Creating access log table %s", name)
+			md := &bigquery.TableMetadata{
+				Schema:                 Schema,
+				TimePartitioning:       &bigquery.TimePartitioning{Field: "timestamp"},
+				RequirePartitionFilter: true,
+			}
+			if err := table.Create(ctx, md); err != nil {
+				return fmt.Errorf("couldn't create access log table %s: %v", name, err)
+			}
+			return nil
+		}
+		// A rebuild was interrupted after the table was removed.
+		logger.Infof(ctx, "Restoring access log table %s from %s", name, tableName(backup))
+		if err := table.Create(ctx, rebuiltMetadata(backupMd)); err != nil {
+			return fmt.Errorf("couldn't re-create access log table %s: %v", name, err)
+		}
+		if err := restoreRows(ctx, client, table, backup, backupMd); err != nil {
+			return err
+		}
+		md, err = table.Metadata(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("couldn't read access log table %s: %v", name, err)
+	}
+
+	if f := field(md.Schema, "timestamp"); (f != nil && f.Type == bigquery.DateTimeFieldType) || md.TimePartitioning == nil {
+		if err := rebuildTable(ctx, client, table, backup, md); err != nil {
+			return err
+		}
+		if md, err = table.Metadata(ctx); err != nil {
+			return fmt.Errorf("couldn't read access log table %s: %v", name, err)
+		}
+	} else if backupMd != nil {
+		// A rebuild was interrupted after the table was re-created. If it has no rows, they weren't restored.
+		if md.NumRows == 0 {
+			err = restoreRows(ctx, client, table, backup, backupMd)
+		} else {
+			err = backup.Delete(ctx)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't finish rebuilding access log table %s: %v", name, err)
+		}
+	}
+
+	schema := md.Schema
+	for _, f := range Schema {
+		existing := field(schema, f.Name)
+		if existing == nil {
+			if f.Required {
+				return fmt.Errorf("access log table %s is missing required column %q, which can't be added", name, f.Name)
+			}
+			logger.Infof(ctx, "Adding column %q to %s", f.Name, name)
+			schema = append(schema, f)
+			continue
+		}
+		if existing.Type != f.Type {
+			return fmt.Errorf("column %q of access log table %s is a %s, not a %s", f.Name, name, existing.Type, f.Type)
+		}
+	}
+	if len(schema) == len(md.Schema) {
+		return nil
+	}
+	if _, err := table.Update(ctx, bigquery.TableMetadataToUpdate{Schema: schema}, md.ETag); err != nil {
+		return fmt.Errorf("couldn't add columns to access log table %s: %v", name, err)
+	}
+	return nil
+}
+
+func field(schema bigquery.Schema, name string) *bigquery.FieldSchema {
+	for _, f := range schema {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// rebuildTable converts the DATETIME timestamp column of a table to a TIMESTAMP and partitions the table, by way of a
+// backup table.
+func rebuildTable(ctx context.Context, client *bigquery.Client, table, backup *bigquery.Table, md *bigquery.TableMetadata) error {
+	name := tableName(table)
+	logger.Infof(ctx, "Rebuilding %s with a partitioned TIMESTAMP timestamp column", name)
+	copier := backup.CopierFrom(table)
+	copier.WriteDisposition = bigquery.WriteTruncate
+	if err := runJob(ctx, copier); err != nil {
+		return fmt.Errorf("couldn't back up access log table %s: %v", name, err)
+	}
+	// A copy doesn't keep the table's description or labels, which are needed if the table has to be restored from the
+	// backup later. The backup's rows are read back without a partition filter.
+	update := bigquery.TableMetadataToUpdate{Description: md.Description, RequirePartitionFilter: false}
+	for k, v := range md.Labels {
+		update.SetLabel(k, v)
+	}
+	if _, err := backup.Update(ctx, update, ""); err != nil {
+		return fmt.Errorf("couldn't back up access log table %s: %v", name, err)
+	}
+	if err := table.Delete(ctx); err != nil {
+		return fmt.Errorf("couldn't remove access log table %s: %v", name, err)
+	}
+	rebuilt := rebuiltMetadata(md)
+	rebuilt.ExpirationTime = md.ExpirationTime
+	if err := table.Create(ctx, rebuilt); err != nil {
+		return fmt.Errorf("couldn't re-create access log table %s, its rows are in %s: %v", name, tableName(backup), err)
+	}
+	return restoreRows(ctx, client, table, backup, md)
+}
+
+// rebuiltMetadata returns the metadata of a table like the one described by md, but with a TIMESTAMP timestamp column,
+// partitioned on it if it wasn't partitioned already, and requiring a partition filter.
+func rebuiltMetadata(md *bigquery.TableMetadata) *bigquery.TableMetadata {
+	var schema bigquery.Schema
+	for _, f := range md.Schema {
+		c := *f
+		if c.Name == "timestamp" {
+			c.Type = bigquery.TimestampFieldType
+		}
+		schema = append(schema, &c)
+	}
+	rebuilt := &bigquery.TableMetadata{
+		Schema:                 schema,
+		Description:            md.Description,
+		Labels:                 md.Labels,
+		TimePartitioning:       md.TimePartitioning,
+		Clustering:             md.Clustering,
+		RequirePartitionFilter: true,
+	}
+	if rebuilt.TimePartitioning == nil {
+		rebuilt.TimePartitioning = &bigquery.TimePartitioning{Field: "timestamp"}
+	}
+	return rebuilt
+}
+
+// restoreRows copies the rows of the backup into the rebuilt table, converting the timestamps from the server's local
+// time in the same way as legacy spooled entries, and then removes the backup. The rows are inserted into the existing table so that its schema is kept.
+func restoreRows(ctx context.Context, client *bigquery.Client, table, backup *bigquery.Table, md *bigquery.TableMetadata) error {
+	var columns, values []string
+	for _, f := range md.Schema {
+		columns = append(columns, f.Name)
+		if f.Name == "timestamp" && f.Type == bigquery.DateTimeFieldType {
+			values = append(values, fmt.Sprintf("TIMESTAMP(timestamp, %q)", legacyZone()))
+		} else {
+			values = append(values, f.Name)
+		}
+	}
+	q := client.Query(fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s",
+		tableName(table), strings.Join(columns, ", "), strings.Join(values, ", "), tableName(backup)))
+	if err := runJob(ctx, q); err != nil {
+		return fmt.Errorf("couldn't restore access log table %s from %s: %v", tableName(table), tableName(backup), err)
+	}
+	if err := backup.Delete(ctx); err != nil {
+		return fmt.Errorf("couldn't remove access log backup table %s: %v", tableName(backup), err)
+	}
+	return nil
+}
+
+// runJob runs a query or copy job and waits for it to finish.
+func runJob(ctx context.Context, r interface {
+	Run(context.Context) (*bigquery.Job, error)
+}) error {
+	job, err := r.Run(ctx)
+	if err != nil {
+		return err
+	}
+	status, err := job.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	return status.Err()
+}
+
+func tableName(table *bigquery.Table) string {
+	return fmt.Sprintf("`%s.%s.%s`", table.ProjectID, table.DatasetID, table.TableID)
+}
+
+func notFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
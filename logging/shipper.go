@@ -0,0 +1,364 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Overflow is the policy applied when an entry is added to a full queue.
+type Overflow string
+
+const (
+	// DropOldest removes the oldest queued entry to make room for the new one.
+	DropOldest Overflow = "drop_oldest"
+	// DropNewest discards the new entry.
+	DropNewest Overflow = "drop_newest"
+	// Block waits until there is room in the queue, delaying the request that is being logged.
+	Block Overflow = "block"
+)
+
+// ShipperOptions configures a Shipper. Zero values are replaced with the defaults.
+type ShipperOptions struct {
+	QueueSize     int           // Maximum number of queued entries, 10000 if unset.
+	BatchSize     int           // Maximum number of entries written at once, 500 if unset.
+	FlushInterval time.Duration // Maximum time an entry waits for a batch to fill, 1 second if unset.
+	Workers       int           // Number of batches that may be written concurrently, 2 if unset.
+	Overflow      Overflow      // DropOldest if unset.
+
+	// Spool stores batches that couldn't be written, to be replayed once writes succeed again. If nil, those entries
+	// are lost.
+	Spool *Spool
+	// RetryInterval is the time between attempts to replay the spool, 10 seconds if unset. It doubles after each
+	// failed attempt, up to maxRetryInterval.
+	RetryInterval time.Duration
+}
+
+// maxRetryInterval limits the backoff between attempts to replay the spool.
+const maxRetryInterval = 5 * time.Minute
+
+// Shipper buffers access log entries in a bounded queue, and writes them in batches from background workers. A batch
+// is written when it reaches BatchSize entries or FlushInterval after the previous write, whichever comes first.
+type Shipper struct {
+	write     func(ctx context.Context, entries []*RequestLog) error
+	queue     chan *RequestLog
+	batchSize int
+	interval  time.Duration
+	overflow  Overflow
+	spool     *Spool
+	retry     time.Duration
+
+	// mu guards closed. Add only holds it while checking closed and registering in adding, never while waiting for
+	// room in the queue, so that Close can't be held up by a full queue.
+	mu     sync.RWMutex
+	closed bool
+	adding sync.WaitGroup // Calls to Add in progress, which Close waits for before closing the queue.
+	wg     sync.WaitGroup
+
+	// stopReplay is closed once the workers have finished, to stop the replay goroutine.
+	stopReplay chan struct{}
+	replayDone chan struct{}
+}
+
+// NewShipper starts a Shipper that writes batches of entries with write. Close must be called to write any entries
+// that are still queued.
+func NewShipper(write func(ctx context.Context, entries []*RequestLog) error, opts ShipperOptions) (*Shipper, error) {
+	if opts.QueueSize == 0 {
+		opts.QueueSize = 10000
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = 500
+	}
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.Workers == 0 {
+		opts.Workers = 2
+	}
+	if opts.RetryInterval == 0 {
+		opts.RetryInterval = 10 * time.Second
+	}
+	switch opts.Overflow {
+	case "":
+		opts.Overflow = DropOldest
+	case DropOldest, DropNewest, Block:
+	default:
+		return nil, fmt.Errorf("unknown access log overflow policy %q", opts.Overflow)
+	}
+	if opts.QueueSize < 0 || opts.BatchSize < 0 || opts.FlushInterval < 0 || opts.Workers < 0 || opts.RetryInterval < 0 {
+		return nil, fmt.Errorf("access log queue options must not be negative")
+	}
+
+	s := &Shipper{
+		write:     write,
+		queue:     make(chan *RequestLog, opts.QueueSize),
+		batchSize: opts.BatchSize,
+		interval:  opts.FlushInterval,
+		overflow:  opts.Overflow,
+		spool:     opts.Spool,
+		retry:     opts.RetryInterval,
+
+		stopReplay: make(chan struct{}),
+		replayDone: make(chan struct{}),
+	}
+	s.wg.Add(opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		go s.worker()
+	}
+	if s.spool != nil {
+		go s.replay()
+	} else {
+		close(s.replayDone)
+	}
+	return s, nil
+}
+
+// Add queues an entry to be written. If the queue is full the overflow policy is applied. Entries added after Close
+// are dropped.
+func (s *Shipper) Add(entry *RequestLog) {
+	s.mu.RLock()
+	if s.closed {
+		s.mu.RUnlock()
+		recordDropped("closed", 1)
+		return
+	}
+	s.adding.Add(1)
+	s.mu.RUnlock()
+	defer s.adding.Done()
+	switch s.overflow {
+	case Block:
+		s.queue <- entry
+	case DropNewest:
+		select {
+		case s.queue <- entry:
+		default:
+			recordDropped(string(DropNewest), 1)
+		}
+	case DropOldest:
+		for queued := false; !queued; {
+			select {
+			case s.queue <- entry:
+				queued = true
+			default:
+				// Workers may empty the queue at the same time, so only count an entry that was actually removed.
+				select {
+				case <-s.queue:
+					recordDropped(string(DropOldest), 1)
+				default:
+				}
+			}
+		}
+	}
+	stats.Record(context.Background(), queueDepth.M(int64(len(s.queue))))
+}
+
+// Close stops accepting entries and waits for every queued entry to be written or spooled. The spool may be on storage
+// that doesn't outlive the process, so a last attempt is then made to replay it before it is closed. If ctx is done
+// first, an error is returned and any entries that haven't been written or spooled are lost.
+func (s *Shipper) Close(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		closing := !s.closed
+		s.closed = true
+		s.mu.Unlock()
+		if closing {
+			// Entries that were waiting for room in the queue are written too. The workers keep running until the
+			// queue is closed, so this doesn't wait for longer than it takes to write them.
+			s.adding.Wait()
+			close(s.queue)
+		}
+		s.wg.Wait()
+		close(s.stopReplay)
+		<-s.replayDone
+		if s.spool != nil {
+			if !s.spool.Empty() {
+				n, err := s.spool.Replay(ctx, s.write)
+				if err != nil {
+					logger.Errorf(ctx, "Error replaying access log spool before shutdown, %d entries were written: %v", n, err)
+				} else if n > 0 {
+					logger.Infof(ctx, "Replayed %d spooled access log entries before shutdown", n)
+				}
+			}
+			if err := s.spool.Close(); err != nil {
+				logger.Errorf(ctx, "Error closing access log spool: %v", err)
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("access log entries were not written before shutdown: %v", ctx.Err())
+	}
+}
+
+func (s *Shipper) worker() {
+	defer s.wg.Done()
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	batch := make([]*RequestLog, 0, s.batchSize)
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-t.C:
+		}
+		if len(batch) > 0 {
+			s.flush(batch)
+			batch = make([]*RequestLog, 0, s.batchSize)
+		}
+		stats.Record(context.Background(), queueDepth.M(int64(len(s.queue))))
+	}
+}
+
+func (s *Shipper) flush(batch []*RequestLog) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx := context.Background()
+	if err := s.write(ctx, batch); err != nil {
+		stats.Record(context.Background(), flushErrors.M(1))
+		if s.spool == nil {
+			logger.Errorf(ctx, "Error writing %d access log entries: %v", len(batch), err)
+			recordDropped("write_error", int64(len(batch)))
+			return
+		}
+		logger.Warningf(ctx, "Error writing %d access log entries, spooling them to be retried: %v", len(batch), err)
+		// If only some sinks failed, the batch is only retried for those.
+		var sinks []string
+		if errs, ok := err.(SinkErrors); ok {
+			sinks = errs.Failed()
+		}
+		if err := s.spool.Append(batch, sinks...); err != nil {
+			logger.Errorf(ctx, "Error spooling access log entries: %v", err)
+			recordDropped("write_error", int64(len(batch)))
+		}
+	}
+}
+
+// replay writes spooled entries until the shipper is closed. Attempts are made every retry interval while the spool
+// isn't empty, backing off while they keep failing.
+func (s *Shipper) replay() {
+	defer close(s.replayDone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Abandon any write in progress when the shipper is closed. Anything not written stays in the spool.
+		<-s.stopReplay
+		cancel()
+	}()
+
+	wait := s.retry
+	for {
+		select {
+		case <-s.stopReplay:
+			return
+		case <-time.After(wait):
+		}
+		if s.spool.Empty() {
+			wait = s.retry
+			continue
+		}
+		n, err := s.spool.Replay(ctx, s.write)
+		if n > 0 {
+			logger.Infof(ctx, "Replayed %d spooled access log entries", n)
+		}
+		if err != nil {
+			wait *= 2
+			if wait > maxRetryInterval {
+				wait = maxRetryInterval
+			}
+			logger.Warningf(ctx, "Error replaying access log spool, retrying in %s: %v", wait, err)
+			continue
+		}
+		wait = s.retry
+	}
+}
+
+func recordDropped(reason string, n int64) {
+	ctx, _ := tag.New(context.Background(), tag.Upsert(dropReasonKey, reason))
+	stats.Record(ctx, dropped.M(n))
+}
+
+var (
+	queueDepth  = stats.Int64("logging/measure/queue_depth", "Number of access log entries waiting to be written", "1")
+	dropped     = stats.Int64("logging/measure/dropped", "Number of access log entries dropped without being written", "1")
+	flushErrors = stats.Int64("logging/measure/flush_errors", "Number of access log batches that couldn't be written", "1")
+
+	spooled        = stats.Int64("logging/measure/spooled", "Number of access log entries written to the spool", "1")
+	replayed       = stats.Int64("logging/measure/replayed", "Number of spooled access log entries that have been replayed", "1")
+	spoolBytes     = stats.Int64("logging/measure/spool_bytes", "Size of the access log spool", "By")
+	corruptRecords = stats.Int64("logging/measure/spool_corrupt_records", "Number of damaged access log spool records", "1")
+	quarantined    = stats.Int64("logging/measure/quarantined", "Number of spooled access log entries that were rejected when replayed", "1")
+
+	dropReasonKey, _ = tag.NewKey("logging/keys/drop_reason")
+)
+
+// Views contains the views for the access log metrics. These must be registered to be exported.
+var Views = []*view.View{
+	{
+		Name:        "logging/views/queue_depth",
+		Description: "access log entries waiting to be written",
+		Measure:     queueDepth,
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "logging/views/dropped",
+		Description: "access log entries dropped over time, by reason",
+		TagKeys:     []tag.Key{dropReasonKey},
+		Measure:     dropped,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "logging/views/flush_errors",
+		Description: "access log batches that couldn't be written over time",
+		Measure:     flushErrors,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "logging/views/spooled",
+		Description: "access log entries written to the spool over time",
+		Measure:     spooled,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "logging/views/replayed",
+		Description: "spooled access log entries replayed over time",
+		Measure:     replayed,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "logging/views/spool_bytes",
+		Description: "size of the access log spool",
+		Measure:     spoolBytes,
+		Aggregation: view.LastValue(),
+	},
+	{
+		Name:        "logging/views/spool_corrupt_records",
+		Description: "damaged access log spool records skipped over time",
+		Measure:     corruptRecords,
+		Aggregation: view.Sum(),
+	},
+	{
+		Name:        "logging/views/quarantined",
+		Description: "spooled access log entries moved to the quarantine file over time",
+		Measure:     quarantined,
+		Aggregation: view.Sum(),
+	},
+}
@@ -0,0 +1,176 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recorder collects the batches written by a Shipper. Writes wait until release is closed, if it is set.
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]*RequestLog
+	release chan struct{}
+}
+
+func (r *recorder) write(ctx context.Context, entries []*RequestLog) error {
+	if r.release != nil {
+		<-r.release
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batches = append(r.batches, entries)
+	return nil
+}
+
+func (r *recorder) uris() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var uris []string
+	for _, b := range r.batches {
+		for _, e := range b {
+			uris = append(uris, e.URI)
+		}
+	}
+	return uris
+}
+
+func entry(i int) *RequestLog {
+	return &RequestLog{URI: fmt.Sprintf("/%d", i)}
+}
+
+func TestShipperBatchSize(t *testing.T) {
+	r := &recorder{}
+	s, err := NewShipper(r.write, ShipperOptions{BatchSize: 3, FlushInterval: time.Hour, Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		s.Add(entry(i))
+	}
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/0", "/1", "/2", "/3", "/4", "/5", "/6"}, r.uris())
+	if assert.Len(t, r.batches, 3) {
+		assert.Len(t, r.batches[0], 3)
+		assert.Len(t, r.batches[2], 1)
+	}
+
+	// Entries added after Close are dropped.
+	s.Add(entry(8))
+	assert.Len(t, r.uris(), 7)
+}
+
+func TestShipperInterval(t *testing.T) {
+	r := &recorder{}
+	s, err := NewShipper(r.write, ShipperOptions{BatchSize: 100, FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close(context.Background())
+	s.Add(entry(1))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.uris()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"/1"}, r.uris())
+}
+
+// fill adds entries to a shipper whose single worker is stuck writing the first one.
+func fill(t *testing.T, overflow Overflow) (*recorder, *Shipper) {
+	r := &recorder{release: make(chan struct{})}
+	s, err := NewShipper(r.write, ShipperOptions{QueueSize: 2, BatchSize: 1, Workers: 1, Overflow: overflow})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(entry(0))
+	// Wait for the worker to take the first entry.
+	for len(s.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	return r, s
+}
+
+func TestShipperDropOldest(t *testing.T) {
+	r, s := fill(t, DropOldest)
+	for i := 1; i <= 4; i++ {
+		s.Add(entry(i))
+	}
+	close(r.release)
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/0", "/3", "/4"}, r.uris())
+}
+
+func TestShipperDropNewest(t *testing.T) {
+	r, s := fill(t, DropNewest)
+	for i := 1; i <= 4; i++ {
+		s.Add(entry(i))
+	}
+	close(r.release)
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/0", "/1", "/2"}, r.uris())
+}
+
+func TestShipperBlock(t *testing.T) {
+	r, s := fill(t, Block)
+	s.Add(entry(1))
+	s.Add(entry(2))
+	added := make(chan struct{})
+	go func() {
+		s.Add(entry(3))
+		close(added)
+	}()
+	select {
+	case <-added:
+		t.Fatal("Add didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(r.release)
+	<-added
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/0", "/1", "/2", "/3"}, r.uris())
+}
+
+func TestShipperCloseBlocked(t *testing.T) {
+	r, s := fill(t, Block)
+	s.Add(entry(1))
+	s.Add(entry(2))
+	added := make(chan struct{})
+	go func() {
+		s.Add(entry(3))
+		close(added)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Close gives up when ctx is done, even though an Add is blocked on the full queue.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, s.Close(ctx))
+
+	// The blocked entry is still written once the queue drains.
+	close(r.release)
+	<-added
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r.uris()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, []string{"/0", "/1", "/2", "/3"}, r.uris())
+}
+
+func TestShipperCloseTimeout(t *testing.T) {
+	r, s := fill(t, DropNewest)
+	defer close(r.release)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NotNil(t, s.Close(ctx))
+}
+
+func TestShipperOptions(t *testing.T) {
+	_, err := NewShipper(nil, ShipperOptions{Overflow: "wait"})
+	assert.NotNil(t, err)
+	_, err = NewShipper(nil, ShipperOptions{QueueSize: -1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,369 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// Sink writes batches of access log entries. Write may be called from several goroutines at once.
+type Sink interface {
+	Write(ctx context.Context, entries []*RequestLog) error
+	// Close flushes anything buffered by the sink. Write must not be called afterwards.
+	Close() error
+}
+
+// BigQuerySink inserts entries into a BigQuery table. Each entry's insert ID is sent with it, which BigQuery uses to
+// discard an entry that is written again within about a minute. This is only best effort, and an entry that is
+// retried later, for example from the spool, may be stored twice; queries that must not count an entry twice should
+// deduplicate on request_id.
+type BigQuerySink struct {
+	Table   *bigquery.Table
+	Timeout time.Duration // Deadline for writing each batch, 5 seconds if unset.
+}
+
+func (s *BigQuerySink) Write(ctx context.Context, entries []*RequestLog) error {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	rows := make([]*bigquery.StructSaver, len(entries))
+	for i, entry := range entries {
+		rows[i] = &bigquery.StructSaver{Struct: entry, InsertID: entry.InsertID}
+	}
+	u := s.Table.Uploader()
+	if err := u.Put(ctx, rows); err != nil {
+		if m, ok := err.(bigquery.PutMultiError); ok {
+			for _, err := range m {
+				logger.Errorf(ctx, "Access log entry rejected by BigQuery: %v", err)
+			}
+			// The rows were rejected, and will be again however often they are retried.
+			return &PermanentError{err}
+		}
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusBadRequest {
+			return &PermanentError{err}
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *BigQuerySink) Close() error {
+	return nil
+}
+
+// PermanentError is returned by a Sink when entries can't be written and retrying them won't help, for example because
+// they were rejected as invalid.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// IsPermanent returns true if err is a PermanentError, or SinkErrors where every sink failed permanently.
+func IsPermanent(err error) bool {
+	switch err := err.(type) {
+	case *PermanentError:
+		return true
+	case SinkErrors:
+		permanent, failed := err.split()
+		return len(permanent) > 0 && len(failed) == 0
+	}
+	return false
+}
+
+// SinkErrors is returned by FanOut when some of its sinks fail, and holds the error from each by sink name.
+type SinkErrors map[string]error
+
+func (e SinkErrors) Error() string {
+	var errs []string
+	for _, name := range e.Failed() {
+		errs = append(errs, fmt.Sprintf("sink %q: %v", name, e[name]))
+	}
+	return strings.Join(errs, "; ")
+}
+
+// Failed returns the names of the sinks that failed, sorted.
+func (e SinkErrors) Failed() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// split returns the names of the sinks that failed permanently, and of those that may succeed if retried.
+func (e SinkErrors) split() (permanent, failed []string) {
+	for _, name := range e.Failed() {
+		if IsPermanent(e[name]) {
+			permanent = append(permanent, name)
+		} else {
+			failed = append(failed, name)
+		}
+	}
+	return permanent, failed
+}
+
+type sinksKey struct{}
+
+// WithSinks returns a context that restricts a FanOut to writing to the named sinks. ctx is returned unchanged if no
+// sinks are named.
+func WithSinks(ctx context.Context, sinks []string) context.Context {
+	if len(sinks) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, sinksKey{}, sinks)
+}
+
+// SinksFrom returns the sinks that ctx restricts writes to, and false if it doesn't restrict them.
+func SinksFrom(ctx context.Context) ([]string, bool) {
+	sinks, ok := ctx.Value(sinksKey{}).([]string)
+	return sinks, ok
+}
+
+// JSONSink writes each entry as a line of JSON, for example to os.Stdout.
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink that writes to w.
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+func (s *JSONSink) Write(ctx context.Context, entries []*RequestLog) error {
+	body, err := encodeLines(entries)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(body)
+	return err
+}
+
+func (s *JSONSink) Close() error {
+	return nil
+}
+
+// encodeLines returns entries as lines of JSON.
+func encodeLines(entries []*RequestLog) ([]byte, error) {
+	var body []byte
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't encode access log entry: %v", err)
+		}
+		body = append(append(body, line...), '\n')
+	}
+	return body, nil
+}
+
+// FanOut writes every batch to each of a set of named sinks. Every sink is written to even if some fail, and the
+// errors are returned as SinkErrors, so that the batch can be retried for only the sinks that failed. If ctx was
+// returned by WithSinks, only those sinks are written to. Names that are no longer in the FanOut, because the sink was
+// removed from the configuration, are ignored.
+type FanOut map[string]Sink
+
+func (f FanOut) Write(ctx context.Context, entries []*RequestLog) error {
+	names, ok := SinksFrom(ctx)
+	if !ok {
+		names = f.names()
+	}
+	errs := make(SinkErrors)
+	for _, name := range names {
+		if sink, ok := f[name]; ok {
+			if err := sink.Write(ctx, entries); err != nil {
+				errs[name] = err
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (f FanOut) Close() error {
+	errs := make(SinkErrors)
+	for _, name := range f.names() {
+		if err := f[name].Close(); err != nil {
+			errs[name] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+func (f FanOut) names() []string {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Filter selects access log entries. Unset fields match every entry.
+type Filter struct {
+	MinStatus    int      `config:"min_status" min:"0"`
+	MaxStatus    int      `config:"max_status" min:"0"`
+	Methods      []string `config:"methods"`
+	PathPrefixes []string `config:"path_prefixes"`
+}
+
+// Match returns true if entry is selected by the filter.
+func (f *Filter) Match(entry *RequestLog) bool {
+	if f.MinStatus > 0 && entry.ResponseCode < f.MinStatus {
+		return false
+	}
+	if f.MaxStatus > 0 && entry.ResponseCode > f.MaxStatus {
+		return false
+	}
+	if len(f.Methods) > 0 && !contains(f.Methods, entry.Method) {
+		return false
+	}
+	if len(f.PathPrefixes) > 0 {
+		for _, prefix := range f.PathPrefixes {
+			if strings.HasPrefix(entry.URI, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filtered passes only the entries selected by Filter to Sink.
+type Filtered struct {
+	Sink
+	Filter Filter
+}
+
+func (f *Filtered) Write(ctx context.Context, entries []*RequestLog) error {
+	var selected []*RequestLog
+	for _, entry := range entries {
+		if f.Filter.Match(entry) {
+			selected = append(selected, entry)
+		}
+	}
+	if len(selected) == 0 {
+		return nil
+	}
+	return f.Sink.Write(ctx, selected)
+}
+
+// SinkConfig is the configuration of a single sink, as found in the access_log.sinks section of the configuration:
+//
+//	"sinks": {
+//		"warehouse": {"type": "bigquery", "dataset": "was", "table": "access_log"},
+//		"errors": {"type": "file", "path": "/var/log/was/errors.log", "filter": {"min_status": 500}},
+//		"console": {"type": "stdout"}
+//	}
+type SinkConfig struct {
+	Type string `config:"type" required:"true"` // "bigquery", "file" or "stdout".
+
+	// BigQuery sinks.
+	Dataset string        `config:"dataset"`
+	Table   string        `config:"table"`
+	Timeout time.Duration `config:"timeout" default:"5s" min:"100ms"`
+
+	// File sinks.
+	Path     string        `config:"path"`
+	MaxBytes int64         `config:"max_bytes" default:"104857600" min:"1024"`
+	MaxAge   time.Duration `config:"max_age" default:"24h" min:"0s"`
+	MaxFiles int           `config:"max_files" default:"7" min:"0"`
+	Compress bool          `config:"compress" default:"true"`
+
+	Filter Filter `config:"filter"`
+}
+
+// ParseSinks reads the sink configurations in the section path of config, by name. It doesn't create the sinks.
+func ParseSinks(config *autoconfig.Config, path string) (map[string]*SinkConfig, error) {
+	sinks := make(map[string]*SinkConfig)
+	if !config.Has(path) {
+		return sinks, nil
+	}
+	m, err := config.GetMap(path)
+	if err != nil {
+		return nil, err
+	}
+	for name := range m {
+		var c SinkConfig
+		if err := config.Bind(path+"."+name, &c); err != nil {
+			return nil, err
+		}
+		if err := c.validate(); err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", path, name, err)
+		}
+		sinks[name] = &c
+	}
+	return sinks, nil
+}
+
+func (c *SinkConfig) validate() error {
+	switch c.Type {
+	case "bigquery", "stdout":
+	case "file":
+		if c.Path == "" {
+			return fmt.Errorf("file sinks require a path")
+		}
+	default:
+		return fmt.Errorf("unknown sink type %q", c.Type)
+	}
+	if c.Filter.MaxStatus > 0 && c.Filter.MaxStatus < c.Filter.MinStatus {
+		return fmt.Errorf("filter max_status is less than min_status")
+	}
+	return nil
+}
+
+// New creates the sink. BigQuery sinks use client, and must have their dataset and table set.
+func (c *SinkConfig) New(client *bigquery.Client, stdout io.Writer) (Sink, error) {
+	var sink Sink
+	switch c.Type {
+	case "bigquery":
+		if c.Dataset == "" || c.Table == "" {
+			return nil, fmt.Errorf("BigQuery sinks require a dataset and table")
+		}
+		sink = &BigQuerySink{Table: client.Dataset(c.Dataset).Table(c.Table), Timeout: c.Timeout}
+	case "stdout":
+		sink = NewJSONSink(stdout)
+	case "file":
+		sink = &FileSink{Path: c.Path, MaxBytes: c.MaxBytes, MaxAge: c.MaxAge, MaxFiles: c.MaxFiles, Compress: c.Compress}
+	default:
+		return nil, fmt.Errorf("unknown sink type %q", c.Type)
+	}
+	if c.Filter.MinStatus > 0 || c.Filter.MaxStatus > 0 || len(c.Filter.Methods) > 0 || len(c.Filter.PathPrefixes) > 0 {
+		sink = &Filtered{Sink: sink, Filter: c.Filter}
+	}
+	return sink, nil
+}
@@ -0,0 +1,190 @@
+package logging
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig/autoconfigtest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(ctx context.Context, entries []*RequestLog) error { return errors.New("unavailable") }
+func (failingSink) Close() error                                            { return nil }
+
+func (r *recorder) Close() error { return nil }
+
+func (r *recorder) Write(ctx context.Context, entries []*RequestLog) error {
+	return r.write(ctx, entries)
+}
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewJSONSink(&buf)
+	assert.Nil(t, s.Write(context.Background(), withIDs("a", "b")))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		var entry map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[1]), &entry))
+		assert.Equal(t, "/b", entry["uri"])
+		assert.Equal(t, "b", entry["insert_id"])
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	f := FanOut{"a": a, "b": b, "broken": failingSink{}}
+	err := f.Write(context.Background(), withIDs("1"))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `sink "broken"`)
+		if assert.IsType(t, SinkErrors{}, err) {
+			assert.Equal(t, []string{"broken"}, err.(SinkErrors).Failed())
+		}
+	}
+	// The other sinks are still written to.
+	assert.Equal(t, []string{"/1"}, a.uris())
+	assert.Equal(t, []string{"/1"}, b.uris())
+
+	// A retry is only written to the sinks it names.
+	assert.Nil(t, f.Write(WithSinks(context.Background(), []string{"b", "removed"}), withIDs("2")))
+	assert.Equal(t, []string{"/1"}, a.uris())
+	assert.Equal(t, []string{"/1", "/2"}, b.uris())
+}
+
+func TestFilter(t *testing.T) {
+	ok := &RequestLog{Method: "GET", URI: "/document/1", ResponseCode: 200}
+	failed := &RequestLog{Method: "POST", URI: "/document/", ResponseCode: 503}
+	admin := &RequestLog{Method: "DELETE", URI: "/admin/account/1", ResponseCode: 404}
+
+	for _, test := range []struct {
+		filter Filter
+		want   []bool
+	}{
+		{Filter{}, []bool{true, true, true}},
+		{Filter{MinStatus: 500}, []bool{false, true, false}},
+		{Filter{MinStatus: 400, MaxStatus: 499}, []bool{false, false, true}},
+		{Filter{Methods: []string{"post", "DELETE"}}, []bool{false, true, true}},
+		{Filter{PathPrefixes: []string{"/admin/"}}, []bool{false, false, true}},
+	} {
+		var got []bool
+		for _, entry := range []*RequestLog{ok, failed, admin} {
+			got = append(got, test.filter.Match(entry))
+		}
+		assert.Equal(t, test.want, got, "%+v", test.filter)
+	}
+
+	r := &recorder{}
+	f := &Filtered{Sink: r, Filter: Filter{MinStatus: 500}}
+	assert.Nil(t, f.Write(context.Background(), []*RequestLog{ok, failed, admin}))
+	assert.Equal(t, []string{"/document/"}, r.uris())
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "logs", "access.log")
+	s := &FileSink{Path: path, MaxBytes: 1, MaxFiles: 2, Compress: true}
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Write(context.Background(), withIDs(id)))
+		// Rotated files are named by time.
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, s.Close())
+
+	// Every write rotated the file, and only the newest two were kept.
+	rotated, _ := filepath.Glob(path + ".*.gz")
+	if assert.Len(t, rotated, 2) {
+		f, err := os.Open(rotated[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(gz)
+		assert.Contains(t, string(body), `"uri":"/c"`)
+	}
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	for _, id := range []string{"a", "b"} {
+		s := &FileSink{Path: path}
+		assert.Nil(t, s.Write(context.Background(), withIDs(id)))
+		assert.Nil(t, s.Close())
+	}
+	body, _ := ioutil.ReadFile(path)
+	assert.Equal(t, 2, strings.Count(string(body), "\n"))
+}
+
+func TestFileSinkClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesink")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+	s := &FileSink{Path: path}
+	assert.Nil(t, s.Write(context.Background(), withIDs("a")))
+	assert.Nil(t, s.Close())
+	// The file isn't reopened after the sink has been closed.
+	assert.NotNil(t, s.Write(context.Background(), withIDs("b")))
+	body, _ := ioutil.ReadFile(path)
+	assert.Equal(t, 1, strings.Count(string(body), "\n"))
+}
+
+func TestParseSinks(t *testing.T) {
+	config := autoconfigtest.Load(t, `{
+		"sinks": {
+			"errors": {"type": "file", "path": "/tmp/errors.log", "compress": false, "filter": {"min_status": 500}},
+			"console": {"type": "stdout"}
+		}
+	}`)
+	sinks, err := ParseSinks(config, "sinks")
+	assert.Nil(t, err)
+	if assert.Len(t, sinks, 2) {
+		assert.Equal(t, "/tmp/errors.log", sinks["errors"].Path)
+		assert.Equal(t, int64(100<<20), sinks["errors"].MaxBytes)
+		assert.False(t, sinks["errors"].Compress)
+		assert.Equal(t, 500, sinks["errors"].Filter.MinStatus)
+		sink, err := sinks["errors"].New(nil, nil)
+		assert.Nil(t, err)
+		assert.IsType(t, &Filtered{}, sink)
+		sink, err = sinks["console"].New(nil, nil)
+		assert.Nil(t, err)
+		assert.IsType(t, &JSONSink{}, sink)
+	}
+
+	for _, body := range []string{
+		`{"sinks": {"x": {"type": "syslog"}}}`,
+		`{"sinks": {"x": {"type": "file"}}}`,
+		`{"sinks": {"x": {"path": "/tmp/x"}}}`,
+		`{"sinks": {"x": {"type": "stdout", "filter": {"min_status": 500, "max_status": 400}}}}`,
+	} {
+		_, err := ParseSinks(autoconfigtest.Load(t, body), "sinks")
+		assert.NotNil(t, err, body)
+	}
+}
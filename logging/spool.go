@@ -0,0 +1,491 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"go.opencensus.io/stats"
+)
+
+const (
+	segmentSuffix = ".seg"
+	lockFile      = "LOCK"
+	// quarantineFile holds batches that were rejected when they were replayed, in the same format as a segment. They
+	// are never replayed again, but can be inspected with logspool, and should be removed once they have been dealt
+	// with.
+	quarantineFile = "quarantine" + segmentSuffix
+	// recordHeader is the size of the length and checksum before each record.
+	recordHeader = 8
+)
+
+// SpoolOptions configures a Spool. Zero values are replaced with the defaults.
+type SpoolOptions struct {
+	SegmentBytes int64 // Size at which a new segment is started, 4 MiB if unset.
+	MaxBytes     int64 // Total size of the spool, 256 MiB if unset. The oldest segments are removed to stay under this.
+}
+
+// Spool stores batches of access log entries on disk when they couldn't be written, so that they can be replayed
+// later.
+//
+// The spool is a directory of segment files, named by sequence number. Each batch is appended to the newest segment as
+// a record containing its length, a CRC-32 checksum and the JSON encoded entries, so that a record damaged by a crash
+// is detected and skipped rather than replayed. A record may name the sinks the batch is for, when others have already
+// written it. Segments are removed once every record in them has been replayed.
+// Batches that are rejected permanently when they are replayed are moved to a quarantine file.
+//
+// Only one process may open a spool directory at a time.
+type Spool struct {
+	dir          string
+	segmentBytes int64
+	maxBytes     int64
+
+	mu       sync.Mutex
+	lock     *os.File
+	current  *os.File // Newest segment, nil until the first Append after opening or rotating.
+	next     uint64   // Sequence number of the next segment.
+	segments map[uint64]int64
+	replayed map[uint64]int // Number of records in each segment that have already been replayed.
+}
+
+// SegmentInfo describes a segment file in a spool.
+type SegmentInfo struct {
+	Name    string
+	Bytes   int64
+	Records int
+	Entries int
+	Corrupt int // Number of damaged records, which will be skipped.
+}
+
+// OpenSpool opens or creates the spool in dir.
+func OpenSpool(dir string, opts SpoolOptions) (*Spool, error) {
+	if opts.SegmentBytes == 0 {
+		opts.SegmentBytes = 4 << 20
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = 256 << 20
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("couldn't create access log spool: %v", err)
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFile), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't lock access log spool: %v", err)
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("access log spool %q is in use by another process", dir)
+	}
+
+	s := &Spool{
+		dir:          dir,
+		segmentBytes: opts.SegmentBytes,
+		maxBytes:     opts.MaxBytes,
+		lock:         lock,
+		next:         1,
+		segments:     make(map[uint64]int64),
+		replayed:     make(map[uint64]int),
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("couldn't read access log spool: %v", err)
+	}
+	for _, info := range infos {
+		seq, ok := segmentSeq(info.Name())
+		if !ok {
+			continue
+		}
+		s.segments[seq] = info.Size()
+		if seq >= s.next {
+			s.next = seq + 1
+		}
+	}
+	s.recordSize()
+	return s, nil
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%020d%s", seq, segmentSuffix)
+}
+
+func segmentSeq(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+	return seq, err == nil
+}
+
+// Close closes the spool. Anything that has been appended is kept for the next time the spool is opened.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate()
+	return s.lock.Close()
+}
+
+// Append adds a batch of entries to the spool, to be replayed to the named sinks, or every sink if none are named. If
+// the spool is larger than MaxBytes afterwards, the oldest segments are removed and their entries are lost.
+func (s *Spool) Append(entries []*RequestLog, sinks ...string) error {
+	record, err := encodeRecord(&spooledBatch{Sinks: sinks, Entries: entries})
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current == nil {
+		seq := s.next
+		f, err := os.OpenFile(filepath.Join(s.dir, segmentName(seq)), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("couldn't create access log spool segment: %v", err)
+		}
+		s.next++
+		s.current = f
+		s.segments[seq] = 0
+	}
+	seq := s.next - 1
+	if _, err := s.current.Write(record); err != nil {
+		return fmt.Errorf("couldn't write access log spool: %v", err)
+	}
+	if err := s.current.Sync(); err != nil {
+		return fmt.Errorf("couldn't write access log spool: %v", err)
+	}
+	s.segments[seq] += int64(len(record))
+	stats.Record(context.Background(), spooled.M(int64(len(entries))))
+
+	if s.segments[seq] >= s.segmentBytes {
+		s.rotate()
+	}
+	s.trim()
+	s.recordSize()
+	return nil
+}
+
+// spooledBatch is the contents of a spool record.
+type spooledBatch struct {
+	Sinks   []string      `json:"sinks"` // Sinks the batch is for, every sink if empty.
+	Entries []*RequestLog `json:"entries"`
+}
+
+// encodeRecord returns a batch as a spool record. A batch for every sink is encoded as just the list of entries, as it
+// was before records named their sinks.
+func encodeRecord(batch *spooledBatch) ([]byte, error) {
+	var payload []byte
+	var err error
+	if len(batch.Sinks) == 0 {
+		payload, err = json.Marshal(batch.Entries)
+	} else {
+		payload, err = json.Marshal(batch)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't encode spooled access log entries: %v", err)
+	}
+	record := make([]byte, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeader:], payload)
+	return record, nil
+}
+
+// quarantine appends a batch that can't be written to the named sinks to the quarantine file.
+func (s *Spool) quarantine(entries []*RequestLog, sinks []string) error {
+	record, err := encodeRecord(&spooledBatch{Sinks: sinks, Entries: entries})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(s.dir, quarantineFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't open access log quarantine: %v", err)
+	}
+	if _, err := f.Write(record); err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't write access log quarantine: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't write access log quarantine: %v", err)
+	}
+	stats.Record(context.Background(), quarantined.M(int64(len(entries))))
+	return f.Close()
+}
+
+// rotate closes the current segment, so that the next Append starts a new one. s.mu must be held.
+func (s *Spool) rotate() {
+	if s.current == nil {
+		return
+	}
+	if err := s.current.Close(); err != nil {
+		logger.Errorf(context.Background(), "Error closing access log spool segment: %v", err)
+	}
+	s.current = nil
+}
+
+// trim removes the oldest segments until the spool is no larger than MaxBytes. The newest segment is always kept.
+// s.mu must be held.
+func (s *Spool) trim() {
+	seqs := s.sequences()
+	for i := 0; i < len(seqs)-1 && s.size() > s.maxBytes; i++ {
+		seq := seqs[i]
+		info, _ := readSegment(filepath.Join(s.dir, segmentName(seq)))
+		if err := os.Remove(filepath.Join(s.dir, segmentName(seq))); err != nil && !os.IsNotExist(err) {
+			logger.Errorf(context.Background(), "Error removing access log spool segment: %v", err)
+			return
+		}
+		logger.Warningf(context.Background(), "Access log spool is full, dropped %d entries from %s", info.Entries, segmentName(seq))
+		recordDropped("spool_full", int64(info.Entries))
+		delete(s.segments, seq)
+		delete(s.replayed, seq)
+	}
+}
+
+// sequences returns the sequence number of every segment, oldest first. s.mu must be held.
+func (s *Spool) sequences() []uint64 {
+	seqs := make([]uint64, 0, len(s.segments))
+	for seq := range s.segments {
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+func (s *Spool) size() int64 {
+	var total int64
+	for _, n := range s.segments {
+		total += n
+	}
+	return total
+}
+
+func (s *Spool) recordSize() {
+	stats.Record(context.Background(), spoolBytes.M(s.size()))
+}
+
+// Empty returns true if there is nothing in the spool.
+func (s *Spool) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size() == 0
+}
+
+// Replay writes every spooled entry with write, oldest first, and removes each segment once all of its records have
+// been written. A batch that was spooled for some sinks is written with a context returned by WithSinks, so that a
+// FanOut only writes it to those. If write returns a PermanentError the batch is moved to the quarantine file, and
+// replay carries on. Replay stops at any other error, and the next call carries on from the record that failed. If
+// write returns SinkErrors, the batch is only retried for the sinks that failed. The number of entries written is
+// returned.
+//
+// Entries that appear more than once in the spool are only written once. An entry may still be stored twice, for
+// example if a write timed out after the rows were inserted. Entries keep the insert ID they were given when they were
+// logged, but BigQuery only uses it to discard duplicates on a best effort basis, within about a minute.
+func (s *Spool) Replay(ctx context.Context, write func(ctx context.Context, entries []*RequestLog) error) (int, error) {
+	s.mu.Lock()
+	s.rotate()
+	seqs := s.sequences()
+	s.mu.Unlock()
+
+	written := 0
+	seen := make(map[string]bool)
+	for _, seq := range seqs {
+		filename := filepath.Join(s.dir, segmentName(seq))
+		batches, err := readBatches(ctx, filename)
+		if os.IsNotExist(err) {
+			// Removed by trim.
+			continue
+		}
+		if err != nil {
+			return written, err
+		}
+		s.mu.Lock()
+		start := s.replayed[seq]
+		s.mu.Unlock()
+		for i := start; i < len(batches); i++ {
+			var batch []*RequestLog
+			for _, entry := range batches[i].Entries {
+				if entry.InsertID != "" {
+					if seen[entry.InsertID] {
+						continue
+					}
+					seen[entry.InsertID] = true
+				}
+				batch = append(batch, entry)
+			}
+			if len(batch) > 0 {
+				err := write(WithSinks(ctx, batches[i].Sinks), batch)
+				if errs, ok := err.(SinkErrors); ok && len(errs) > 0 {
+					// Only the sinks that failed are retried, the others already have the batch.
+					permanent, failed := errs.split()
+					if len(permanent) > 0 {
+						logger.Warningf(ctx, "Access log entries were rejected by %s, moving %d of them to %s", strings.Join(permanent, ", "), len(batch), quarantineFile)
+						if err := s.quarantine(batch, permanent); err != nil {
+							return written, err
+						}
+					}
+					if len(failed) > 0 {
+						if err := s.Append(batch, failed...); err != nil {
+							return written, err
+						}
+						s.mu.Lock()
+						s.replayed[seq] = i + 1
+						s.mu.Unlock()
+						return written, err
+					}
+					batch = nil
+				} else if IsPermanent(err) {
+					logger.Warningf(ctx, "Access log entries were rejected, moving %d of them to %s: %v", len(batch), quarantineFile, err)
+					if err := s.quarantine(batch, batches[i].Sinks); err != nil {
+						return written, err
+					}
+					batch = nil
+				} else if err != nil {
+					return written, err
+				}
+			}
+			written += len(batch)
+			stats.Record(context.Background(), replayed.M(int64(len(batch))))
+			s.mu.Lock()
+			s.replayed[seq] = i + 1
+			s.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			s.mu.Unlock()
+			return written, fmt.Errorf("couldn't remove replayed access log spool segment: %v", err)
+		}
+		delete(s.segments, seq)
+		delete(s.replayed, seq)
+		s.recordSize()
+		s.mu.Unlock()
+	}
+	return written, nil
+}
+
+// InspectSpool describes every segment in the spool in dir, oldest first, followed by the quarantine file if there is
+// one. It doesn't need the spool to be opened, so it can be used while a server is running.
+func InspectSpool(dir string) ([]SegmentInfo, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read access log spool: %v", err)
+	}
+	var segments []SegmentInfo
+	for _, info := range infos {
+		if _, ok := segmentSeq(info.Name()); !ok {
+			continue
+		}
+		segment, err := readSegment(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	if segment, err := readSegment(filepath.Join(dir, quarantineFile)); err == nil {
+		segments = append(segments, segment)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return segments, nil
+}
+
+// ReadSegment returns every entry in a segment file, skipping damaged records.
+func ReadSegment(filename string) ([]*RequestLog, error) {
+	batches, err := readBatches(context.Background(), filename)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*RequestLog
+	for _, batch := range batches {
+		entries = append(entries, batch.Entries...)
+	}
+	return entries, nil
+}
+
+func readSegment(filename string) (SegmentInfo, error) {
+	info := SegmentInfo{Name: filepath.Base(filename)}
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return info, err
+	}
+	info.Bytes = int64(len(body))
+	batches, corrupt := decodeRecords(body)
+	info.Records = len(batches)
+	info.Corrupt = corrupt
+	for _, batch := range batches {
+		info.Entries += len(batch.Entries)
+	}
+	return info, nil
+}
+
+func readBatches(ctx context.Context, filename string) ([]*spooledBatch, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	batches, corrupt := decodeRecords(body)
+	if corrupt > 0 {
+		logger.Warningf(ctx, "Skipping %d damaged records in access log spool segment %q", corrupt, filename)
+		stats.Record(ctx, corruptRecords.M(int64(corrupt)))
+	}
+	return batches, nil
+}
+
+// decodeRecords returns the batches in a segment, and the number of records that were damaged. A record with a bad
+// checksum is skipped. A record whose length runs past the end of the segment was only partly written, and ends the
+// segment.
+func decodeRecords(body []byte) ([]*spooledBatch, int) {
+	var batches []*spooledBatch
+	corrupt := 0
+	r := bytes.NewReader(body)
+	for r.Len() > 0 {
+		if r.Len() < recordHeader {
+			corrupt++
+			break
+		}
+		var header [recordHeader]byte
+		r.Read(header[:])
+		length := binary.BigEndian.Uint32(header[:])
+		if int64(length) > int64(r.Len()) {
+			corrupt++
+			break
+		}
+		payload := make([]byte, length)
+		r.Read(payload)
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			corrupt++
+			continue
+		}
+		batch, err := decodeBatch(payload)
+		if err != nil {
+			corrupt++
+			continue
+		}
+		batches = append(batches, batch)
+	}
+	return batches, corrupt
+}
+
+// decodeBatch decodes a record's payload, which is either a batch for some sinks or just a list of entries for every
+// sink.
+func decodeBatch(payload []byte) (*spooledBatch, error) {
+	batch := &spooledBatch{}
+	if bytes.HasPrefix(bytes.TrimSpace(payload), []byte("[")) {
+		err := json.Unmarshal(payload, &batch.Entries)
+		return batch, err
+	}
+	err := json.Unmarshal(payload, batch)
+	return batch, err
+}
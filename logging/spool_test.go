@@ -0,0 +1,320 @@
+package logging
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpool(t *testing.T, opts SpoolOptions) (string, *Spool) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := OpenSpool(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, s
+}
+
+func withIDs(ids ...string) []*RequestLog {
+	var entries []*RequestLog
+	for _, id := range ids {
+		entries = append(entries, &RequestLog{Timestamp: time.Now().UTC(), URI: "/" + id, InsertID: id})
+	}
+	return entries
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	assert.True(t, s.Empty())
+	assert.Nil(t, s.Append(withIDs("a", "b")))
+	assert.Nil(t, s.Append(withIDs("c")))
+	// An entry spooled twice is only replayed once.
+	assert.Nil(t, s.Append(withIDs("b", "d")))
+	assert.False(t, s.Empty())
+
+	// The spool survives being reopened.
+	assert.Nil(t, s.Close())
+	s, err := OpenSpool(dir, SpoolOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := &recorder{}
+	n, err := s.Replay(context.Background(), r.write)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+	assert.Equal(t, []string{"/a", "/b", "/c", "/d"}, r.uris())
+	assert.True(t, s.Empty())
+	segments, err := InspectSpool(dir)
+	assert.Nil(t, err)
+	assert.Len(t, segments, 0)
+}
+
+func TestSpoolReplayFailure(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Append(withIDs(id)))
+	}
+
+	calls := 0
+	failing := func(ctx context.Context, entries []*RequestLog) error {
+		calls++
+		if calls == 2 {
+			return errors.New("unavailable")
+		}
+		return nil
+	}
+	n, err := s.Replay(context.Background(), failing)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, n)
+
+	// The next replay carries on from the batch that failed.
+	r := &recorder{}
+	n, err = s.Replay(context.Background(), r.write)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"/b", "/c"}, r.uris())
+}
+
+func TestSpoolReplayQuarantine(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	for _, id := range []string{"a", "b", "c"} {
+		assert.Nil(t, s.Append(withIDs(id)))
+	}
+
+	r := &recorder{}
+	rejecting := func(ctx context.Context, entries []*RequestLog) error {
+		if entries[0].URI == "/b" {
+			return &PermanentError{errors.New("invalid row")}
+		}
+		return r.write(ctx, entries)
+	}
+	// A rejected batch doesn't stop the rest from being written.
+	n, err := s.Replay(context.Background(), rejecting)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"/a", "/c"}, r.uris())
+	assert.True(t, s.Empty())
+
+	segments, err := InspectSpool(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, quarantineFile, segments[0].Name)
+	}
+	entries, err := ReadSegment(filepath.Join(dir, quarantineFile))
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "/b", entries[0].URI)
+	}
+
+	// The quarantine isn't replayed.
+	n, err = s.Replay(context.Background(), r.write)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+}
+
+// flakySink fails every write until it is fixed.
+type flakySink struct {
+	recorder
+	broken bool
+}
+
+func (s *flakySink) Write(ctx context.Context, entries []*RequestLog) error {
+	if s.broken {
+		return errors.New("unavailable")
+	}
+	return s.write(ctx, entries)
+}
+
+func TestSpoolReplaySinks(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	good, flaky := &recorder{}, &flakySink{broken: true}
+	f := FanOut{"good": good, "flaky": flaky}
+
+	// The batch is only spooled for the sink that failed.
+	err := f.Write(context.Background(), withIDs("a"))
+	if assert.IsType(t, SinkErrors{}, err) {
+		assert.Nil(t, s.Append(withIDs("a"), err.(SinkErrors).Failed()...))
+	}
+	assert.Equal(t, []string{"/a"}, good.uris())
+
+	// A replay that fails again keeps the batch.
+	_, err = s.Replay(context.Background(), f.Write)
+	assert.NotNil(t, err)
+	assert.False(t, s.Empty())
+
+	flaky.broken = false
+	n, err := s.Replay(context.Background(), f.Write)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, s.Empty())
+	assert.Equal(t, []string{"/a"}, good.uris())
+	assert.Equal(t, []string{"/a"}, flaky.uris())
+}
+
+func TestSpoolLocked(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	_, err := OpenSpool(dir, SpoolOptions{})
+	assert.NotNil(t, err)
+	s.Close()
+	s, err = OpenSpool(dir, SpoolOptions{})
+	assert.Nil(t, err)
+	s.Close()
+}
+
+func TestSpoolSizeLimit(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{SegmentBytes: 1, MaxBytes: 500})
+	defer os.RemoveAll(dir)
+	defer s.Close()
+	// Each batch is in its own segment, so the oldest are removed once the spool is full.
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		assert.Nil(t, s.Append(withIDs(id)))
+	}
+	segments, err := InspectSpool(dir)
+	assert.Nil(t, err)
+	var total int64
+	for _, segment := range segments {
+		total += segment.Bytes
+	}
+	assert.True(t, total <= 500, "spool is %d bytes", total)
+	if assert.True(t, len(segments) < 6) {
+		assert.Equal(t, segmentName(6), segments[len(segments)-1].Name)
+	}
+
+}
+
+func TestSpoolCorruption(t *testing.T) {
+	dir, s := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	assert.Nil(t, s.Append(withIDs("a")))
+	assert.Nil(t, s.Append(withIDs("b")))
+	assert.Nil(t, s.Append(withIDs("c")))
+	s.Close()
+
+	// Damage the second record, and leave a partly written record at the end.
+	filename := filepath.Join(dir, segmentName(1))
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordLen := len(body) / 3
+	body[recordLen+recordHeader+2] ^= 0xff
+	body = append(body, body[:recordLen-1]...)
+	ioutil.WriteFile(filename, body, 0600)
+
+	segments, err := InspectSpool(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, 2, segments[0].Records)
+		assert.Equal(t, 2, segments[0].Corrupt)
+	}
+	entries, err := ReadSegment(filename)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestSpoolLegacyTimestamp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A record spooled before timestamps were stored in UTC.
+	payload := []byte(`[{"timestamp":"2018-06-01T12:30:00.25","uri":"/a","method":"GET","response_code":200,"insert_id":"a"}]`)
+	record := make([]byte, recordHeader+len(payload))
+	binary.BigEndian.PutUint32(record, uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeader:], payload)
+	filename := filepath.Join(dir, segmentName(1))
+	ioutil.WriteFile(filename, record, 0600)
+
+	entries, err := ReadSegment(filename)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, time.Date(2018, 6, 1, 12, 30, 0, 250000000, time.Local).UTC(), entries[0].Timestamp)
+		assert.Equal(t, "a", entries[0].InsertID)
+	}
+	segments, err := InspectSpool(dir)
+	assert.Nil(t, err)
+	if assert.Len(t, segments, 1) {
+		assert.Equal(t, 0, segments[0].Corrupt)
+	}
+
+	// Current entries round trip unchanged.
+	want := &RequestLog{Timestamp: time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC), URI: "/b", InsertID: "b"}
+	b, err := json.Marshal(want)
+	assert.Nil(t, err)
+	var got RequestLog
+	assert.Nil(t, json.Unmarshal(b, &got))
+	assert.Equal(t, want, &got)
+}
+
+func TestShipperSpool(t *testing.T) {
+	dir, spool := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+
+	r := &recorder{}
+	down := int32(1)
+	write := func(ctx context.Context, entries []*RequestLog) error {
+		if atomic.LoadInt32(&down) == 1 {
+			return errors.New("unavailable")
+		}
+		return r.write(ctx, entries)
+	}
+	s, err := NewShipper(write, ShipperOptions{BatchSize: 1, Workers: 1, Spool: spool, RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Add(withIDs("1")[0])
+	deadline := time.Now().Add(5 * time.Second)
+	for spool.Empty() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.False(t, spool.Empty())
+
+	atomic.StoreInt32(&down, 0)
+	for len(r.uris()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/1"}, r.uris())
+	assert.True(t, spool.Empty())
+}
+
+func TestShipperCloseReplaysSpool(t *testing.T) {
+	dir, spool := tempSpool(t, SpoolOptions{})
+	defer os.RemoveAll(dir)
+	assert.Nil(t, spool.Append(withIDs("1")))
+
+	r := &recorder{}
+	// The retry interval is too long for the spool to be replayed before Close.
+	s, err := NewShipper(r.write, ShipperOptions{Spool: spool, RetryInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, s.Close(context.Background()))
+	assert.Equal(t, []string{"/1"}, r.uris())
+	assert.True(t, spool.Empty())
+}
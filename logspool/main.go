@@ -0,0 +1,186 @@
+// logspool inspects and drains the access log spool written by the frontend when BigQuery is unavailable, and migrates
+// the BigQuery access log table to the current schema.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logging"
+
+	"cloud.google.com/go/bigquery"
+	cli "gopkg.in/urfave/cli.v1"
+)
+
+var spoolDir string
+
+func cmdInspect(c *cli.Context) error {
+	segments, err := logging.InspectSpool(spoolDir)
+	if err != nil {
+		return err
+	}
+	if len(segments) == 0 {
+		fmt.Println("The spool is empty")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+	fmt.Fprintln(w, "Segment\tBytes\tRecords\tEntries\tDamaged\t")
+	var bytes int64
+	var entries int
+	for _, s := range segments {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t\n", s.Name, s.Bytes, s.Records, s.Entries, s.Corrupt)
+		bytes += s.Bytes
+		entries += s.Entries
+	}
+	fmt.Fprintf(w, "Total\t%d\t\t%d\t\t\n", bytes, entries)
+	w.Flush()
+	return nil
+}
+
+func cmdDump(c *cli.Context) error {
+	if c.NArg() != 1 {
+		cli.ShowCommandHelpAndExit(c, "dump", 1)
+	}
+	entries, err := logging.ReadSegment(filepath.Join(spoolDir, c.Args().Get(0)))
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bigqueryClient creates a client for the project given on the command line.
+func bigqueryClient(ctx context.Context, c *cli.Context) (*bigquery.Client, error) {
+	for _, name := range []string{"project", "dataset", "table"} {
+		if c.String(name) == "" {
+			return nil, fmt.Errorf("--%s is required", name)
+		}
+	}
+	client, err := bigquery.NewClient(ctx, c.String("project"))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create BigQuery client: %v", err)
+	}
+	return client, nil
+}
+
+func cmdDrain(c *cli.Context) error {
+	ctx := context.Background()
+	client, err := bigqueryClient(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// This fails if a server is using the spool, in which case it will replay the spool itself.
+	spool, err := logging.OpenSpool(spoolDir, logging.SpoolOptions{})
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+	sink := &logging.BigQuerySink{
+		Table:   client.Dataset(c.String("dataset")).Table(c.String("table")),
+		Timeout: c.Duration("timeout"),
+	}
+	// Batches that were only spooled for other sinks, such as files on the server, are dropped.
+	name := c.String("sink")
+	skipped := 0
+	write := func(ctx context.Context, entries []*logging.RequestLog) error {
+		if sinks, ok := logging.SinksFrom(ctx); ok && !containsString(sinks, name) {
+			skipped += len(entries)
+			return nil
+		}
+		return sink.Write(ctx, entries)
+	}
+	n, err := spool.Replay(ctx, write)
+	fmt.Printf("Wrote %d entries to BigQuery, skipped %d entries for other sinks\n", n-skipped, skipped)
+	if err != nil {
+		return fmt.Errorf("couldn't drain the spool, the remaining entries have been kept: %v", err)
+	}
+	return nil
+}
+
+func cmdMigrate(c *cli.Context) error {
+	ctx := context.Background()
+	client, err := bigqueryClient(ctx, c)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := logging.MigrateTable(ctx, client, client.Dataset(c.String("dataset")).Table(c.String("table"))); err != nil {
+		return err
+	}
+	fmt.Println("The access log table is up to date")
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// bigqueryFlags select the access log table.
+var bigqueryFlags = []cli.Flag{
+	cli.StringFlag{Name: "project", Usage: "Google Cloud project", EnvVar: "PROJECT"},
+	cli.StringFlag{Name: "dataset", Usage: "BigQuery dataset"},
+	cli.StringFlag{Name: "table", Usage: "BigQuery table", Value: "access_log"},
+}
+
+func main() {
+	app := cli.NewApp()
+	app.Name = "logspool"
+	app.Usage = "Inspect and drain the access log spool, and migrate the access log table"
+	app.Version = "1.0.0"
+	app.Flags = []cli.Flag{
+		cli.StringFlag{Name: "dir, d", Usage: "Spool directory", Value: "/var/spool/access_log", Destination: &spoolDir},
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "inspect",
+			Usage:  "List the spool segments and the number of entries in each",
+			Action: cmdInspect,
+		},
+		{
+			Name:      "dump",
+			Usage:     "Print every entry in a segment as JSON",
+			Action:    cmdDump,
+			ArgsUsage: "<segment>",
+		},
+		{
+			Name:   "drain",
+			Usage:  "Write every spooled entry to BigQuery, and remove them from the spool",
+			Action: cmdDrain,
+			Flags: append([]cli.Flag{
+				cli.DurationFlag{Name: "timeout", Usage: "Deadline for writing each batch", Value: 30 * time.Second},
+				cli.StringFlag{Name: "sink", Usage: "Name of the BigQuery sink in the server's access_log.sinks configuration", Value: "bigquery"},
+			}, bigqueryFlags...),
+		},
+		{
+			Name:   "migrate",
+			Usage:  "Create the access log table, or update it to the current schema. Stop writing to the table first",
+			Action: cmdMigrate,
+			Flags:  bigqueryFlags,
+		},
+	}
+	sort.Sort(cli.FlagsByName(app.Flags))
+	sort.Sort(cli.CommandsByName(app.Commands))
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
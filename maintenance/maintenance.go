@@ -0,0 +1,161 @@
+// Package maintenance rejects requests while the service is in maintenance, as set in the "maintenance" section of the
+// configuration:
+//
+//	"maintenance": {
+//		"mode": "read_only",       // "off", "read_only" or "drain".
+//		"message": "Uploads are paused for a database migration",
+//		"retry_after": "10m",
+//		"routes": ["upload"]       // Route names that are blocked in any mode, unless they are exempt.
+//	}
+//
+// Each route is marked with the Access it needs when the Maintenance is created. In read_only mode every request to a
+// route that writes data is rejected, and in drain mode every request is rejected, except to exempt routes. Rejected
+// requests get a 503 response with a Retry-After header.
+//
+// The configuration may be changed at any time, and takes effect as soon as it has been reloaded.
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/logger"
+	"github.com/dparrish/build-web-application-demo/swagger"
+
+	"github.com/gorilla/mux"
+)
+
+// Mode is the maintenance mode.
+type Mode string
+
+const (
+	Off      Mode = "off"
+	ReadOnly Mode = "read_only"
+	Drain    Mode = "drain"
+)
+
+// Access is what a route does, which decides the modes that block it.
+type Access int
+
+const (
+	// Writes routes may modify data. They are blocked in read_only and drain modes. Routes that haven't been marked
+	// are treated as Writes, so that a new route isn't left open by mistake.
+	Writes Access = iota
+	// Reads routes only read data. They are only blocked in drain mode.
+	Reads
+	// Exempt routes are never blocked, such as health checks and the endpoints needed to manage maintenance.
+	Exempt
+)
+
+// Header is set on every response with the current mode, while the mode is not Off.
+const Header = "X-Maintenance-Mode"
+
+// State is the maintenance configuration.
+type State struct {
+	Mode       Mode          `config:"mode" default:"off"`
+	Message    string        `config:"message" default:"The service is undergoing maintenance, please try again later"`
+	RetryAfter time.Duration `config:"retry_after" default:"5m" min:"1s"`
+	Routes     []string      `config:"routes"`
+}
+
+// Maintenance tracks the maintenance state from a configuration.
+type Maintenance struct {
+	binding *autoconfig.Binding
+	routes  map[string]Access
+}
+
+// New reads the maintenance state from config and keeps it up to date. routes gives the Access of each route, by
+// name.
+func New(config *autoconfig.Config, routes map[string]Access) (*Maintenance, error) {
+	binding, err := config.BindWatch("maintenance", func() interface{} { return &State{} })
+	if err != nil {
+		return nil, err
+	}
+	m := &Maintenance{binding: binding, routes: make(map[string]Access)}
+	if err := m.State().validate(); err != nil {
+		return nil, err
+	}
+	for name, access := range routes {
+		m.routes[name] = access
+	}
+	config.AddValidator(func(old, new *autoconfig.Config) error {
+		var s State
+		if err := new.Bind("maintenance", &s); err != nil {
+			return err
+		}
+		return s.validate()
+	})
+	binding.Subscribe(func(v interface{}) {
+		s := v.(*State)
+		logger.Infof(context.Background(), "Maintenance mode is %q, blocked routes: %q", s.Mode, s.Routes)
+	})
+	return m, nil
+}
+
+func (s *State) validate() error {
+	switch s.Mode {
+	case Off, ReadOnly, Drain:
+		return nil
+	}
+	return fmt.Errorf("maintenance.mode must be one of %q, %q or %q", Off, ReadOnly, Drain)
+}
+
+// State returns the current maintenance state. It must not be modified.
+func (m *Maintenance) State() *State {
+	return m.binding.Get().(*State)
+}
+
+// Blocked returns true if a request to the named route should be rejected.
+func (m *Maintenance) Blocked(route string) bool {
+	access := m.routes[route]
+	if access == Exempt {
+		return false
+	}
+	s := m.State()
+	switch s.Mode {
+	case Drain:
+		return true
+	case ReadOnly:
+		if access == Writes {
+			return true
+		}
+	}
+	for _, r := range s.Routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware rejects requests that are blocked by the maintenance state. Routes are identified by their mux route
+// name.
+func (m *Maintenance) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		if route := mux.CurrentRoute(r); route != nil {
+			name = route.GetName()
+		}
+		if m.Blocked(name) {
+			m.Reject(w)
+			return
+		}
+		if mode := m.State().Mode; mode != Off {
+			w.Header().Set(Header, string(mode))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reject writes a 503 response with the maintenance message.
+func (m *Maintenance) Reject(w http.ResponseWriter) {
+	s := m.State()
+	w.Header().Set(Header, string(s.Mode))
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.RetryAfter.Seconds()))))
+	swagger.Errorf(w, http.StatusServiceUnavailable, "%s", s.Message)
+}
@@ -0,0 +1,138 @@
+package maintenance
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/autoconfig"
+	"github.com/dparrish/build-web-application-demo/autoconfig/autoconfigtest"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/assert"
+)
+
+func load(t *testing.T, body string) *Maintenance {
+	m, err := New(autoconfigtest.Load(t, body), testRoutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// testRoutes marks the routes created by router. The delete route isn't marked, so it is treated as Writes.
+var testRoutes = map[string]Access{"health": Exempt, "list": Reads, "search": Reads, "upload": Writes}
+
+func router(m *Maintenance) *mux.Router {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	r := mux.NewRouter()
+	r.HandleFunc("/health", ok).Methods("GET").Name("health")
+	r.HandleFunc("/document", ok).Methods("GET").Name("list")
+	r.HandleFunc("/search", ok).Methods("POST").Name("search")
+	r.HandleFunc("/document", ok).Methods("POST").Name("upload")
+	r.HandleFunc("/document/{id}", ok).Methods("DELETE").Name("delete")
+	r.Use(m.Middleware)
+	return r
+}
+
+func request(r *mux.Router, method, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+func TestOff(t *testing.T) {
+	r := router(load(t, `{}`))
+	for _, method := range []string{"GET", "POST"} {
+		w := request(r, method, "/document")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "", w.Header().Get(Header))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	r := router(load(t, `{"maintenance": {"mode": "read_only", "message": "Database migration", "retry_after": "90s"}}`))
+	w := request(r, "GET", "/document")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "read_only", w.Header().Get(Header))
+
+	for _, path := range []string{"/document", "/document/1"} {
+		method := "POST"
+		if path != "/document" {
+			method = "DELETE"
+		}
+		w := request(r, method, path)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "90", w.Header().Get("Retry-After"))
+		assert.Contains(t, w.Body.String(), "Database migration")
+	}
+
+	// A route that only reads data isn't blocked, whatever its method.
+	assert.Equal(t, http.StatusOK, request(r, "POST", "/search").Code)
+}
+
+func TestDrain(t *testing.T) {
+	r := router(load(t, `{"maintenance": {"mode": "drain"}}`))
+	w := request(r, "GET", "/document")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "300", w.Header().Get("Retry-After"))
+	assert.Equal(t, "drain", w.Header().Get(Header))
+
+	// Exempt routes are never blocked.
+	w = request(r, "GET", "/health")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "drain", w.Header().Get(Header))
+}
+
+func TestRoutes(t *testing.T) {
+	r := router(load(t, `{"maintenance": {"routes": ["upload", "health"]}}`))
+	assert.Equal(t, http.StatusServiceUnavailable, request(r, "POST", "/document").Code)
+	assert.Equal(t, http.StatusOK, request(r, "DELETE", "/document/1").Code)
+	assert.Equal(t, http.StatusOK, request(r, "GET", "/document").Code)
+	assert.Equal(t, http.StatusOK, request(r, "GET", "/health").Code)
+}
+
+func TestInvalidMode(t *testing.T) {
+	_, err := New(autoconfigtest.Load(t, `{"maintenance": {"mode": "closed"}}`), testRoutes)
+	assert.NotNil(t, err)
+}
+
+func TestReload(t *testing.T) {
+	autoconfig.Fs = afero.NewOsFs()
+	dir, err := ioutil.TempDir("", "maintenance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(filename, []byte(`{}`), 0644)
+	config, err := autoconfig.Load(context.Background(), autoconfig.File(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(config, testRoutes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config.Watch(ctx)
+	r := router(m)
+	assert.Equal(t, http.StatusOK, request(r, "POST", "/document").Code)
+
+	// An invalid mode is rejected, then maintenance is turned on and off again.
+	ioutil.WriteFile(filename, []byte(`{"maintenance": {"mode": "closed"}}`), 0644)
+	autoconfigtest.WaitForReload(config, 1)
+	assert.Equal(t, Off, m.State().Mode)
+	ioutil.WriteFile(filename, []byte(`{"maintenance": {"mode": "read_only"}}`), 0644)
+	autoconfigtest.WaitForReload(config, 2)
+	assert.Equal(t, http.StatusServiceUnavailable, request(r, "POST", "/document").Code)
+	ioutil.WriteFile(filename, []byte(`{"maintenance": {"mode": "off"}}`), 0644)
+	autoconfigtest.WaitForReload(config, 3)
+	assert.Equal(t, http.StatusOK, request(r, "POST", "/document").Code)
+}
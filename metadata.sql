@@ -1,10 +1,13 @@
 CREATE TABLE Metadata (
-	Id            STRING(255) NOT NULL,
-	UserId        STRING(255) NOT NULL,
-	Name          STRING(255) NOT NULL,
-	Uploaded      TIMESTAMP NOT NULL,
-	MimeType      STRING(32),
-	Size          INT64,
+	Id              STRING(255) NOT NULL,
+	UserId          STRING(255) NOT NULL,
+	Name            STRING(255) NOT NULL,
+	Uploaded        TIMESTAMP NOT NULL,
+	MimeType        STRING(32),
+	Size            INT64,
+	KeyFingerprint  STRING(64),
+	ClientEncrypted BOOL,
+	NameEncrypted   BOOL,
 ) PRIMARY KEY (Id);
 
 CREATE INDEX Metadata_UserId ON Metadata (UserId);
@@ -12,4 +15,30 @@ CREATE INDEX Metadata_UserId ON Metadata (UserId);
 CREATE TABLE Users (
 	Id STRING(255) NOT NULL,
 	EncryptionKey STRING(MAX),
+	Deleted TIMESTAMP,
 ) PRIMARY KEY (Id);
+
+CREATE TABLE Deletions (
+	UserId         STRING(255) NOT NULL,
+	RequestedBy    STRING(255) NOT NULL,
+	Requested      TIMESTAMP NOT NULL,
+	KeyDestroyed   TIMESTAMP NOT NULL,
+	Completed      TIMESTAMP,
+	ObjectsDeleted INT64,
+	Digest         STRING(64),
+) PRIMARY KEY (UserId);
+
+CREATE INDEX Deletions_KeyDestroyed ON Deletions (KeyDestroyed);
+
+CREATE TABLE AuditEvents (
+	UserId     STRING(255) NOT NULL,
+	Sequence   INT64 NOT NULL,
+	Timestamp  TIMESTAMP NOT NULL,
+	Actor      STRING(255) NOT NULL,
+	Action     STRING(32) NOT NULL,
+	DocumentId STRING(255),
+	Outcome    STRING(32) NOT NULL,
+	RequestId  STRING(64),
+	PrevHash   STRING(64) NOT NULL,
+	Hash       STRING(64) NOT NULL,
+) PRIMARY KEY (UserId, Sequence);
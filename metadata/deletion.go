@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"cloud.google.com/go/spanner"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+)
+
+// Deletion is the permanent record of an account deletion request.
+// The record is kept after all the user data has been removed so that the deletion can be verified later.
+type Deletion struct {
+	UserID         string           `json:"user_id" spanner:"UserId"`
+	RequestedBy    string           `json:"requested_by" spanner:"RequestedBy"`
+	Requested      time.Time        `json:"requested" spanner:"Requested"`
+	KeyDestroyed   time.Time        `json:"key_destroyed" spanner:"KeyDestroyed"`
+	Completed      spanner.NullTime `json:"completed" spanner:"Completed"`
+	ObjectsDeleted int64            `json:"objects_deleted" spanner:"ObjectsDeleted"`
+	Digest         string           `json:"digest,omitempty" spanner:"Digest"`
+}
+
+// errDeletionExists is returned by deletionStore.shred when the account has been deleted before.
+var errDeletionExists = errors.New("account has already been deleted")
+
+// deletionStore records account deletions. It is an interface so that ShredUser can be tested without Spanner.
+type deletionStore interface {
+	// shred writes the Users tombstone and inserts d in the same transaction. If the account has been deleted before,
+	// only the tombstone is written and errDeletionExists is returned, so the existing record is kept.
+	shred(ctx context.Context, d *Deletion) error
+	// get returns the deletion record for a user.
+	get(ctx context.Context, userid string) (*Deletion, error)
+}
+
+// spannerDeletionStore keeps deletion records in the Deletions table.
+type spannerDeletionStore struct {
+	client *spanner.Client
+}
+
+func (s *spannerDeletionStore) shred(ctx context.Context, d *Deletion) error {
+	tombstone := spanner.InsertOrUpdate("Users", []string{"Id", "EncryptionKey", "Deleted"},
+		[]interface{}{d.UserID, nil, d.KeyDestroyed})
+	deletion, err := spanner.InsertStruct("Deletions", d)
+	if err != nil {
+		return fmt.Errorf("error creating deletion mutation: %v", err)
+	}
+	_, err = s.client.Apply(ctx, []*spanner.Mutation{tombstone, deletion})
+	if spanner.ErrCode(err) == codes.AlreadyExists {
+		if _, err := s.client.Apply(ctx, []*spanner.Mutation{tombstone}); err != nil {
+			return fmt.Errorf("error shredding encryption key: %v", err)
+		}
+		return errDeletionExists
+	}
+	if err != nil {
+		return fmt.Errorf("error shredding encryption key: %v", err)
+	}
+	return nil
+}
+
+func (s *spannerDeletionStore) get(ctx context.Context, userid string) (*Deletion, error) {
+	return GetDeletion(ctx, s.client, userid)
+}
+
+// ShredUser destroys the data encryption key for a user, which makes every blob stored for that user unrecoverable.
+// The Users row is kept as a tombstone without a key so that a new key is never created in its place, and a Deletions
+// record is written in the same transaction. If the account was deleted before, the existing record is returned
+// unchanged, including whether its purge completed.
+// Removing the blobs and metadata rows is left to the caller, which should call CompleteDeletion when done.
+//
+// Only this replica's cached copy of the key is dropped immediately. Other replicas drop theirs when WatchDeletions
+// next polls, so they may keep decrypting the user's documents for up to one poll interval.
+func ShredUser(ctx context.Context, client *spanner.Client, userid, requestedBy string) (*Deletion, error) {
+	return shredUser(ctx, &spannerDeletionStore{client}, userid, requestedBy)
+}
+
+func shredUser(ctx context.Context, store deletionStore, userid, requestedBy string) (*Deletion, error) {
+	now := time.Now()
+	d := &Deletion{
+		UserID:       userid,
+		RequestedBy:  requestedBy,
+		Requested:    now,
+		KeyDestroyed: now,
+	}
+	err := store.shred(ctx, d)
+	if err == errDeletionExists {
+		d, err = store.get(ctx, userid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the local copy of the key immediately, other replicas will pick it up from WatchDeletions.
+	PurgeEncryptionKey(userid)
+	return d, nil
+}
+
+// CompleteDeletion marks a deletion as complete once all blobs and metadata rows have been removed.
+// digest should identify the set of objects that were removed.
+func CompleteDeletion(ctx context.Context, client *spanner.Client, userid string, objects int64, digest string) error {
+	mut := spanner.Update("Deletions", []string{"UserId", "Completed", "ObjectsDeleted", "Digest"},
+		[]interface{}{userid, time.Now(), objects, digest})
+	if _, err := client.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		return fmt.Errorf("error updating deletion row: %v", err)
+	}
+	return nil
+}
+
+// GetDeletion returns the deletion record for a user.
+func GetDeletion(ctx context.Context, client *spanner.Client, userid string) (*Deletion, error) {
+	stmt := spanner.NewStatement(`SELECT UserId, RequestedBy, Requested, KeyDestroyed, Completed, ObjectsDeleted, Digest
+	                              FROM Deletions WHERE UserId = @userid`)
+	stmt.Params["userid"] = userid
+	deletions, err := queryDeletions(ctx, client, stmt)
+	if err != nil {
+		return nil, err
+	}
+	if len(deletions) == 0 {
+		return nil, errors.New("no rows found")
+	}
+	return deletions[0], nil
+}
+
+// PendingDeletions returns all the deletions that have not yet been completed.
+func PendingDeletions(ctx context.Context, client *spanner.Client) ([]*Deletion, error) {
+	stmt := spanner.NewStatement(`SELECT UserId, RequestedBy, Requested, KeyDestroyed, Completed, ObjectsDeleted, Digest
+	                              FROM Deletions WHERE Completed IS NULL`)
+	return queryDeletions(ctx, client, stmt)
+}
+
+// WatchDeletions polls for keys that have been destroyed by any replica and removes them from the local key cache.
+// A key destroyed by another replica stays usable here until the next poll, so interval bounds how long a deleted
+// account's documents can still be read. This blocks until the context is cancelled.
+func WatchDeletions(ctx context.Context, client *spanner.Client, interval time.Duration) {
+	since := time.Now()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		stmt := spanner.NewStatement(`SELECT UserId, RequestedBy, Requested, KeyDestroyed, Completed, ObjectsDeleted, Digest
+		                              FROM Deletions WHERE KeyDestroyed >= @since`)
+		// Overlap the previous poll slightly so that clock skew between replicas can't hide a deletion.
+		stmt.Params["since"] = since.Add(-interval)
+		polled := time.Now()
+		deletions, err := queryDeletions(ctx, client, stmt)
+		if err != nil {
+			logger.Warningf(ctx, "Error polling for account deletions: %v", err)
+			continue
+		}
+		since = polled
+		for _, d := range deletions {
+			PurgeEncryptionKey(d.UserID)
+		}
+	}
+}
+
+// PurgeEncryptionKey removes a user's data encryption key from the local in-memory cache.
+func PurgeEncryptionKey(userid string) {
+	getKeyCache().Remove(userid)
+}
+
+func queryDeletions(ctx context.Context, client *spanner.Client, stmt spanner.Statement) ([]*Deletion, error) {
+	var response []*Deletion
+
+	// Set a timeout for the metadata query.
+	ctx, cancel := context.WithTimeout(ctx, Timeout())
+	defer cancel()
+
+	iter := client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	for {
+		row, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error fetching deletions: %v", err)
+		}
+
+		var d Deletion
+		var digest spanner.NullString
+		if err := row.Columns(&d.UserID, &d.RequestedBy, &d.Requested, &d.KeyDestroyed, &d.Completed, &d.ObjectsDeleted, &digest); err != nil {
+			return nil, fmt.Errorf("error fetching deletion row: %v", err)
+		}
+		d.Digest = digest.StringVal
+		response = append(response, &d)
+	}
+	return response, nil
+}
@@ -0,0 +1,60 @@
+package metadata
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/spanner"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDeletionStore keeps deletion records in memory.
+type fakeDeletionStore struct {
+	deletions  map[string]*Deletion
+	tombstones map[string]time.Time
+}
+
+func (s *fakeDeletionStore) shred(ctx context.Context, d *Deletion) error {
+	s.tombstones[d.UserID] = d.KeyDestroyed
+	if _, ok := s.deletions[d.UserID]; ok {
+		return errDeletionExists
+	}
+	stored := *d
+	s.deletions[d.UserID] = &stored
+	return nil
+}
+
+func (s *fakeDeletionStore) get(ctx context.Context, userid string) (*Deletion, error) {
+	d := *s.deletions[userid]
+	return &d, nil
+}
+
+func TestShredUser(t *testing.T) {
+	c, restore := withKeyCache(t)
+	defer restore()
+	c.Add("user1", testKey(1))
+	store := &fakeDeletionStore{deletions: make(map[string]*Deletion), tombstones: make(map[string]time.Time)}
+
+	d, err := shredUser(context.Background(), store, "user1", "admin")
+	assert.Nil(t, err)
+	assert.Equal(t, "user1", d.UserID)
+	assert.Equal(t, "admin", d.RequestedBy)
+	assert.False(t, d.Completed.Valid)
+	assert.Contains(t, store.tombstones, "user1")
+	// The local copy of the key is dropped straight away.
+	_, ok := c.Get("user1")
+	assert.False(t, ok)
+
+	// Deleting the account again keeps the record of the first deletion, including its completion.
+	store.deletions["user1"].Completed = spanner.NullTime{Time: time.Now(), Valid: true}
+	store.deletions["user1"].ObjectsDeleted = 3
+	store.deletions["user1"].Digest = "digest"
+	again, err := shredUser(context.Background(), store, "user1", "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, "admin", again.RequestedBy)
+	assert.True(t, d.Requested.Equal(again.Requested))
+	assert.True(t, again.Completed.Valid)
+	assert.Equal(t, int64(3), again.ObjectsDeleted)
+	assert.Equal(t, "digest", again.Digest)
+}
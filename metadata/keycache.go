@@ -0,0 +1,231 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/encryption"
+
+	lru "github.com/hashicorp/golang-lru"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"golang.org/x/sync/singleflight"
+)
+
+// KeyCache is an in-memory cache of userid -> data encryption key.
+//
+// Entries expire after a fixed TTL, and the plaintext key is overwritten with zeros as soon as it is evicted. Expired
+// keys are only noticed when they are read, unless SweepKeyCache is running. Callers always receive a copy of the cached
+// key, so eviction can never change a key that is in use.
+type KeyCache struct {
+	ttl   time.Duration
+	group singleflight.Group
+
+	// mu is held for every cache operation, including the eviction callback, so that a key can't be zeroed while it
+	// is being copied.
+	mu  sync.Mutex
+	lru *lru.Cache
+	// generation is incremented whenever keys are removed, so that a key loaded before then isn't added afterwards.
+	generation uint64
+}
+
+type cachedKey struct {
+	key     [32]byte
+	expires time.Time
+}
+
+// NewKeyCache creates a cache holding at most size keys, each for at most ttl. A ttl of 0 means keys do not expire.
+func NewKeyCache(size int, ttl time.Duration) (*KeyCache, error) {
+	c, err := lru.NewWithEvict(size, func(_, value interface{}) {
+		zero(&value.(*cachedKey).key)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyCache{ttl: ttl, lru: c}, nil
+}
+
+// Get returns a copy of the cached key for a user.
+func (c *KeyCache) Get(userid string) (encryption.Key, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.lru.Get(userid)
+	if !ok {
+		return nil, false
+	}
+	ck := v.(*cachedKey)
+	if !ck.expires.IsZero() && time.Now().After(ck.expires) {
+		c.lru.Remove(userid)
+		return nil, false
+	}
+	key := ck.key
+	return &key, true
+}
+
+// Add stores a copy of a key in the cache.
+func (c *KeyCache) Add(userid string, key encryption.Key) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.add(userid, key)
+}
+
+// Generation returns a value that changes whenever keys are removed from the cache.
+func (c *KeyCache) Generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// AddIfCurrent stores a copy of a key that was loaded when the cache was at generation gen, unless any keys have been
+// removed since. A key that was read just before it was shredded is then never put back after it has been purged.
+func (c *KeyCache) AddIfCurrent(userid string, key encryption.Key, gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != gen {
+		return false
+	}
+	c.add(userid, key)
+	return true
+}
+
+func (c *KeyCache) add(userid string, key encryption.Key) {
+	ck := &cachedKey{key: *key}
+	if c.ttl > 0 {
+		ck.expires = time.Now().Add(c.ttl)
+	}
+	c.lru.Add(userid, ck)
+}
+
+// Remove evicts a single user's key.
+func (c *KeyCache) Remove(userid string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.lru.Remove(userid)
+}
+
+// Flush evicts every key in the cache and returns the number of keys that were removed.
+func (c *KeyCache) Flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	n := c.lru.Len()
+	c.lru.Purge()
+	return n
+}
+
+// Sweep evicts and zeroes every expired key, and returns the number of keys that were removed.
+func (c *KeyCache) Sweep() int {
+	if c.ttl == 0 {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	n := 0
+	for _, k := range c.lru.Keys() {
+		// Peek doesn't change the order of the cache.
+		if v, ok := c.lru.Peek(k); ok && now.After(v.(*cachedKey).expires) {
+			c.lru.Remove(k)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of keys in the cache.
+func (c *KeyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func zero(b *[32]byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// keyCache is the cache used by GetEncryptionKey. It can be replaced at startup using SetKeyCache.
+var (
+	keyCacheMu sync.RWMutex
+	keyCache   *KeyCache
+)
+
+func init() {
+	keyCache, _ = NewKeyCache(512, 0)
+}
+
+// SetKeyCache replaces the data encryption key cache. Keys in the old cache are zeroed.
+func SetKeyCache(c *KeyCache) {
+	keyCacheMu.Lock()
+	old := keyCache
+	keyCache = c
+	keyCacheMu.Unlock()
+	old.Flush()
+}
+
+// FlushKeyCache evicts every cached data encryption key and returns the number of keys that were removed.
+func FlushKeyCache() int {
+	return getKeyCache().Flush()
+}
+
+// SweepKeyCache sweeps the data encryption key cache every interval, so that expired keys don't stay in memory until
+// they are next read. This blocks until the context is cancelled.
+func SweepKeyCache(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			getKeyCache().Sweep()
+		}
+	}
+}
+
+func getKeyCache() *KeyCache {
+	keyCacheMu.RLock()
+	defer keyCacheMu.RUnlock()
+	return keyCache
+}
+
+var (
+	keyCacheHits   = stats.Int64("metadata/measure/key_cache_hits", "Number of data encryption key cache hits", "1")
+	keyCacheMisses = stats.Int64("metadata/measure/key_cache_misses", "Number of data encryption key cache misses", "1")
+	kmsLatency     = stats.Float64("metadata/measure/kms_latency", "Latency of KMS requests", "ms")
+
+	kmsOperationKey, _ = tag.NewKey("metadata/keys/kms_operation")
+)
+
+// KeyCacheViews contains the views for the data encryption key cache metrics. These must be registered to be exported.
+var KeyCacheViews = []*view.View{
+	{
+		Name:        "metadata/views/key_cache_hits",
+		Description: "data encryption key cache hits over time",
+		Measure:     keyCacheHits,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "metadata/views/key_cache_misses",
+		Description: "data encryption key cache misses over time",
+		Measure:     keyCacheMisses,
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "metadata/views/kms_latency",
+		Description: "KMS request latency distribution",
+		TagKeys:     []tag.Key{kmsOperationKey},
+		Measure:     kmsLatency,
+		Aggregation: view.Distribution(0, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000),
+	},
+}
+
+// recordKMSLatency records the time taken by a KMS operation that started at start.
+func recordKMSLatency(ctx context.Context, operation string, start time.Time) {
+	ctx, _ = tag.New(ctx, tag.Upsert(kmsOperationKey, operation))
+	stats.Record(ctx, kmsLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
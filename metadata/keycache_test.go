@@ -0,0 +1,91 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) *[32]byte {
+	var k [32]byte
+	for i := range k {
+		k[i] = b
+	}
+	return &k
+}
+
+func TestKeyCacheGet(t *testing.T) {
+	c, err := NewKeyCache(2, 0)
+	assert.Nil(t, err)
+	c.Add("user1", testKey(1))
+
+	key, ok := c.Get("user1")
+	assert.True(t, ok)
+	assert.Equal(t, *testKey(1), *key)
+
+	// Changing the returned key must not change the cached key.
+	key[0] = 99
+	key, _ = c.Get("user1")
+	assert.Equal(t, *testKey(1), *key)
+
+	_, ok = c.Get("user2")
+	assert.False(t, ok)
+}
+
+func TestKeyCacheExpiry(t *testing.T) {
+	c, _ := NewKeyCache(2, 10*time.Millisecond)
+	c.Add("user1", testKey(1))
+	_, ok := c.Get("user1")
+	assert.True(t, ok)
+
+	time.Sleep(20 * time.Millisecond)
+	_, ok = c.Get("user1")
+	assert.False(t, ok)
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestKeyCacheZeroOnEvict(t *testing.T) {
+	c, _ := NewKeyCache(1, 0)
+	c.Add("user1", testKey(1))
+	v, _ := c.lru.Peek("user1")
+	cached := v.(*cachedKey)
+
+	// Adding a second key evicts the first, which must be zeroed.
+	c.Add("user2", testKey(2))
+	assert.Equal(t, [32]byte{}, cached.key)
+
+	v, _ = c.lru.Peek("user2")
+	cached = v.(*cachedKey)
+	assert.Equal(t, 1, c.Flush())
+	assert.Equal(t, [32]byte{}, cached.key)
+}
+
+func TestKeyCacheSweep(t *testing.T) {
+	c, _ := NewKeyCache(4, 10*time.Millisecond)
+	c.Add("user1", testKey(1))
+	v, _ := c.lru.Peek("user1")
+	cached := v.(*cachedKey)
+	time.Sleep(20 * time.Millisecond)
+	c.Add("user2", testKey(2))
+
+	// Only the expired key is removed, and it is zeroed without being read.
+	assert.Equal(t, 1, c.Sweep())
+	assert.Equal(t, [32]byte{}, cached.key)
+	assert.Equal(t, 1, c.Len())
+	_, ok := c.Get("user2")
+	assert.True(t, ok)
+}
+
+func TestKeyCacheAddIfCurrent(t *testing.T) {
+	c, _ := NewKeyCache(4, 0)
+	gen := c.Generation()
+	assert.True(t, c.AddIfCurrent("user1", testKey(1), gen))
+
+	// A key loaded before another key was purged is not cached.
+	gen = c.Generation()
+	c.Remove("user2")
+	assert.False(t, c.AddIfCurrent("user2", testKey(2), gen))
+	_, ok := c.Get("user2")
+	assert.False(t, ok)
+}
@@ -4,14 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"sync/atomic"
 	"time"
 
 	"github.com/dparrish/build-web-application-demo/encryption"
+	"github.com/dparrish/build-web-application-demo/logger"
 
 	"cloud.google.com/go/spanner"
-	lru "github.com/hashicorp/golang-lru"
+	"github.com/gtank/cryptopasta"
+	"go.opencensus.io/stats"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
 )
 
 type Row struct {
@@ -21,6 +24,31 @@ type Row struct {
 	Uploaded time.Time `json:"uploaded,omitempty" spanner:"Uploaded"`
 	MimeType string    `json:"mime_type,omitempty" spanner:"MimeType"`
 	Size     int64     `json:"size,omitempty" spanner:"Size"`
+	// KeyFingerprint is the SHA-256 hash of a customer-supplied encryption key. It is empty when the document is
+	// encrypted with the user's data encryption key.
+	KeyFingerprint string `json:"key_sha256,omitempty" spanner:"KeyFingerprint"`
+	// ClientEncrypted is set when the client encrypted the document before upload, so it is stored without any
+	// server-side encryption. NameEncrypted is set when the client also encrypted the name.
+	ClientEncrypted bool `json:"client_encrypted,omitempty" spanner:"ClientEncrypted"`
+	NameEncrypted   bool `json:"name_encrypted,omitempty" spanner:"NameEncrypted"`
+}
+
+// rowColumns is the list of columns read by scanRow.
+const rowColumns = `Id, UserID, Name, Uploaded, MimeType, Size, KeyFingerprint, ClientEncrypted, NameEncrypted`
+
+// scanRow reads a Metadata row selected with rowColumns, allowing for the optional columns to be NULL.
+func scanRow(row *spanner.Row) (*Row, error) {
+	var mr Row
+	var fingerprint spanner.NullString
+	var clientEncrypted, nameEncrypted spanner.NullBool
+	if err := row.Columns(&mr.ID, &mr.UserID, &mr.Name, &mr.Uploaded, &mr.MimeType, &mr.Size, &fingerprint,
+		&clientEncrypted, &nameEncrypted); err != nil {
+		return nil, fmt.Errorf("error fetching metadata row: %v", err)
+	}
+	mr.KeyFingerprint = fingerprint.StringVal
+	mr.ClientEncrypted = clientEncrypted.Bool
+	mr.NameEncrypted = nameEncrypted.Bool
+	return &mr, nil
 }
 
 type User struct {
@@ -28,20 +56,160 @@ type User struct {
 	EncryptionKey string `spanner:"EncryptionKey"`
 }
 
-// keyCache contains an in-memory cache of userid -> encryption key.
-var keyCache, _ = lru.New(512)
+// queryTimeoutNs is applied to each Spanner query made by this package, and kmsTimeoutNs to each KMS request. They are
+// stored as nanoseconds so that they can be changed while requests are in flight.
+var (
+	queryTimeoutNs = int64(10 * time.Second)
+	kmsTimeoutNs   = int64(10 * time.Second)
+)
+
+// SetTimeouts changes the timeouts for Spanner queries and KMS requests.
+func SetTimeouts(query, kms time.Duration) {
+	atomic.StoreInt64(&queryTimeoutNs, int64(query))
+	atomic.StoreInt64(&kmsTimeoutNs, int64(kms))
+}
+
+// Timeout returns the timeout for Spanner queries.
+func Timeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&queryTimeoutNs))
+}
+
+func kmsTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&kmsTimeoutNs))
+}
+
+// ErrAccountDeleted is returned when an operation is attempted on an account that has been deleted.
+var ErrAccountDeleted = errors.New("account has been deleted")
+
+// errKeyExists is returned by setEncryptionKey when another request created a key for the user first.
+var errKeyExists = errors.New("encryption key already exists")
 
 func GetEncryptionKey(ctx context.Context, client *spanner.Client, envelope *encryption.Envelope, userid string) (encryption.Key, error) {
+	return getEncryptionKey(ctx, &spannerKeyStore{client, envelope}, userid)
+}
+
+func getEncryptionKey(ctx context.Context, store keyStore, userid string) (encryption.Key, error) {
 	// Check the cache first.
-	if key, ok := keyCache.Get(userid); ok {
-		return key.(encryption.Key), nil
+	cache := getKeyCache()
+	if key, ok := cache.Get(userid); ok {
+		stats.Record(ctx, keyCacheHits.M(1))
+		return key, nil
+	}
+	stats.Record(ctx, keyCacheMisses.M(1))
+
+	// Coalesce concurrent misses for the same user so that only one of them queries Spanner and KMS.
+	v, err, _ := cache.group.Do(userid, func() (interface{}, error) {
+		// The key may be shredded while it is being loaded. Taking the generation first means that the key isn't
+		// cached if it has been purged since.
+		gen := cache.Generation()
+		ek, err := loadEncryptionKey(ctx, store, userid)
+		if err != nil {
+			return nil, err
+		}
+		// Store the retrieved key in the in-memory cache.
+		cache.AddIfCurrent(userid, ek, gen)
+		return ek, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Every caller sharing the result gets its own copy of the key.
+	ek := *v.(encryption.Key)
+	return &ek, nil
+}
+
+// keyStore reads and creates the data encryption keys of users. It is an interface so that the caching and
+// coalescing in getEncryptionKey can be tested without Spanner and KMS.
+type keyStore interface {
+	// read returns the decrypted key of a user, or nil if the user has no key.
+	read(ctx context.Context, userid string) (encryption.Key, error)
+	// create stores a new key for a user, returning errKeyExists if another request created one first.
+	create(ctx context.Context, userid string, ek encryption.Key) error
+}
+
+// spannerKeyStore keeps the keys in the Users table, encrypted with KMS.
+type spannerKeyStore struct {
+	client   *spanner.Client
+	envelope *encryption.Envelope
+}
+
+func (s *spannerKeyStore) read(ctx context.Context, userid string) (encryption.Key, error) {
+	return readEncryptionKey(ctx, s.client, s.envelope, userid)
+}
+
+func (s *spannerKeyStore) create(ctx context.Context, userid string, ek encryption.Key) error {
+	start := time.Now()
+	encodedKey, err := s.envelope.EncryptKey(ctx, ek)
+	recordKMSLatency(ctx, "encrypt", start)
+	if err != nil {
+		return fmt.Errorf("error creating encryption key: %v", err)
+	}
+	return setEncryptionKey(ctx, s.client, userid, encodedKey)
+}
+
+// CheckAccount returns ErrAccountDeleted if the user's account has been deleted. It must be checked before storing or
+// returning a document that doesn't use the user's data encryption key, as GetEncryptionKey isn't called for those.
+func CheckAccount(ctx context.Context, client *spanner.Client, userid string) error {
+	stmt := spanner.NewStatement(`SELECT Deleted FROM Users WHERE Id = @userid`)
+	stmt.Params["userid"] = userid
+
+	// Set a timeout for the metadata query.
+	ctx, cancel := context.WithTimeout(ctx, Timeout())
+	defer cancel()
+
+	iter := client.Single().Query(ctx, stmt)
+	defer iter.Stop()
+	row, err := iter.Next()
+	if err == iterator.Done {
+		// Users without a row have never stored a document with their own key, and have not been deleted.
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error fetching users row: %v", err)
+	}
+	var deleted spanner.NullTime
+	if err := row.Columns(&deleted); err != nil {
+		return fmt.Errorf("error fetching users row: %v", err)
+	}
+	if deleted.Valid {
+		return ErrAccountDeleted
+	}
+	return nil
+}
+
+// loadEncryptionKey fetches and decrypts the data encryption key for a user, creating one if none exist.
+func loadEncryptionKey(ctx context.Context, store keyStore, userid string) (encryption.Key, error) {
+	ek, err := store.read(ctx, userid)
+	if err != nil || ek != nil {
+		return ek, err
 	}
 
-	stmt := spanner.NewStatement(`SELECT EncryptionKey FROM Users WHERE Id = @userid`)
+	// No data encryption key exists for this user, create a new one.
+	ek = cryptopasta.NewEncryptionKey()
+	err = store.create(ctx, userid, ek)
+	if err == errKeyExists {
+		// Another replica created a key first. Use that one, so that a user never ends up with documents encrypted
+		// with a key that was thrown away.
+		logger.Infof(ctx, "Encryption key for user %q was created concurrently, using the existing key", userid)
+		if ek, err = store.read(ctx, userid); err == nil && ek == nil {
+			err = fmt.Errorf("encryption key for user %q disappeared", userid)
+		}
+		return ek, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ek, nil
+}
+
+// readEncryptionKey fetches and decrypts the data encryption key for a user. A nil key is returned if the user has no
+// key.
+func readEncryptionKey(ctx context.Context, client *spanner.Client, envelope *encryption.Envelope, userid string) (encryption.Key, error) {
+	stmt := spanner.NewStatement(`SELECT EncryptionKey, Deleted FROM Users WHERE Id = @userid`)
 	stmt.Params["userid"] = userid
 
-	// Set a 10 second timeout for the metadata query.
-	rctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	// Set a timeout for the metadata query.
+	rctx, cancel := context.WithTimeout(ctx, Timeout())
 	defer cancel()
 
 	iter := client.Single().Query(rctx, stmt)
@@ -55,41 +223,33 @@ func GetEncryptionKey(ctx context.Context, client *spanner.Client, envelope *enc
 			return nil, fmt.Errorf("error fetching users row: %v", err)
 		}
 
-		var encodedKey string
-		if err := row.Columns(&encodedKey); err != nil {
+		var encodedKey spanner.NullString
+		var deleted spanner.NullTime
+		if err := row.Columns(&encodedKey, &deleted); err != nil {
 			return nil, fmt.Errorf("error fetching users row: %v", err)
 		}
+		if deleted.Valid || !encodedKey.Valid {
+			// The key has been shredded, never create a new one in its place.
+			return nil, ErrAccountDeleted
+		}
 
 		// Decrypt the Data Encryption Key using the Key Encryption Key.
-		log.Printf("Decrypting encryption key for user %q", userid)
-		rctx, cancel = context.WithTimeout(ctx, 10*time.Second)
+		logger.Debugf(ctx, "Decrypting encryption key for user %q", userid)
+		rctx, cancel = context.WithTimeout(ctx, kmsTimeout())
 		defer cancel()
-		ek, err := envelope.DecryptKey(rctx, encodedKey)
+		start := time.Now()
+		ek, err := envelope.DecryptKey(rctx, encodedKey.StringVal)
+		recordKMSLatency(ctx, "decrypt", start)
 		if err != nil {
 			return nil, fmt.Errorf("error decrypting encryption key: %v", err)
 		}
-
-		// Store the retrieved key in the in-memory cache.
-		keyCache.Add(userid, ek)
-
 		return ek, nil
 	}
-
-	// No data encryption key exists for this user, create a new one.
-	ek := envelope.NewKey()
-	encodedKey, err := envelope.EncryptKey(ctx, ek)
-	if err != nil {
-		return nil, fmt.Errorf("error creating encryption key: %v", err)
-	}
-	if err := setEncryptionKey(ctx, client, userid, encodedKey); err != nil {
-		return nil, err
-	}
-	// Store the retrieved key in the in-memory cache.
-	keyCache.Add(userid, ek)
-
-	return ek, nil
+	return nil, nil
 }
 
+// setEncryptionKey stores a new encrypted data encryption key for a user. Because the row is inserted rather than
+// updated, only one key can ever be created; errKeyExists is returned to any other writer.
 func setEncryptionKey(ctx context.Context, client *spanner.Client, userid string, key string) error {
 	row := &User{
 		ID:            userid,
@@ -100,6 +260,9 @@ func setEncryptionKey(ctx context.Context, client *spanner.Client, userid string
 		return fmt.Errorf("error creating insert mutation: %v", err)
 	}
 	if _, err := client.Apply(ctx, []*spanner.Mutation{mut}); err != nil {
+		if spanner.ErrCode(err) == codes.AlreadyExists {
+			return errKeyExists
+		}
 		return fmt.Errorf("error inserting users row: %v", err)
 	}
 	return nil
@@ -108,11 +271,11 @@ func setEncryptionKey(ctx context.Context, client *spanner.Client, userid string
 func ListForUser(ctx context.Context, client *spanner.Client, userid string) ([]Row, error) {
 	response := []Row{}
 
-	stmt := spanner.NewStatement(`SELECT Id, UserID, Name, Uploaded, MimeType, Size FROM Metadata WHERE UserId = @userid`)
+	stmt := spanner.NewStatement(`SELECT ` + rowColumns + ` FROM Metadata WHERE UserId = @userid`)
 	stmt.Params["userid"] = userid
 
-	// Set a 10 second timeout for the metadata query.
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	// Set a timeout for the metadata query.
+	ctx, cancel := context.WithTimeout(ctx, Timeout())
 	defer cancel()
 
 	iter := client.Single().Query(ctx, stmt)
@@ -126,11 +289,11 @@ func ListForUser(ctx context.Context, client *spanner.Client, userid string) ([]
 			return nil, fmt.Errorf("error fetching metadata: %v", err)
 		}
 
-		var mr Row
-		if err := row.Columns(&mr.ID, &mr.UserID, &mr.Name, &mr.Uploaded, &mr.MimeType, &mr.Size); err != nil {
-			return nil, fmt.Errorf("error fetching metadata row: %v", err)
+		mr, err := scanRow(row)
+		if err != nil {
+			return nil, err
 		}
-		response = append(response, mr)
+		response = append(response, *mr)
 	}
 
 	return response, nil
@@ -148,12 +311,12 @@ func Add(ctx context.Context, client *spanner.Client, row *Row) error {
 }
 
 func Get(ctx context.Context, client *spanner.Client, userid string, objectID string) (*Row, error) {
-	stmt := spanner.NewStatement(`SELECT Id, UserID, Name, Uploaded, MimeType, Size FROM Metadata WHERE UserId = @userid AND Id = @id`)
+	stmt := spanner.NewStatement(`SELECT ` + rowColumns + ` FROM Metadata WHERE UserId = @userid AND Id = @id`)
 	stmt.Params["userid"] = userid
 	stmt.Params["id"] = objectID
 
-	// Set a 10 second timeout for the metadata query.
-	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	// Set a timeout for the metadata query.
+	ctx, cancel := context.WithTimeout(ctx, Timeout())
 	defer cancel()
 
 	iter := client.Single().Query(ctx, stmt)
@@ -167,11 +330,7 @@ func Get(ctx context.Context, client *spanner.Client, userid string, objectID st
 			return nil, fmt.Errorf("error fetching metadata: %v", err)
 		}
 
-		var mr Row
-		if err := row.Columns(&mr.ID, &mr.UserID, &mr.Name, &mr.Uploaded, &mr.MimeType, &mr.Size); err != nil {
-			return nil, fmt.Errorf("error fetching metadata row: %v", err)
-		}
-		return &mr, nil
+		return scanRow(row)
 	}
 
 	return nil, errors.New("no rows found")
@@ -0,0 +1,149 @@
+package metadata
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dparrish/build-web-application-demo/encryption"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeKeyStore keeps keys in memory. beforeCreate, if set, is called before a key is created.
+type fakeKeyStore struct {
+	mu           sync.Mutex
+	keys         map[string]encryption.Key
+	reads        int32
+	creates      int32
+	release      chan struct{} // If set, read waits for it to be closed.
+	beforeCreate func(userid string)
+}
+
+func (s *fakeKeyStore) read(ctx context.Context, userid string) (encryption.Key, error) {
+	atomic.AddInt32(&s.reads, 1)
+	if s.release != nil {
+		<-s.release
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.keys[userid]; ok {
+		k := *key
+		return &k, nil
+	}
+	return nil, nil
+}
+
+func (s *fakeKeyStore) create(ctx context.Context, userid string, ek encryption.Key) error {
+	atomic.AddInt32(&s.creates, 1)
+	if s.beforeCreate != nil {
+		s.beforeCreate(userid)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[userid]; ok {
+		return errKeyExists
+	}
+	k := *ek
+	s.keys[userid] = &k
+	return nil
+}
+
+// withKeyCache replaces the key cache, and returns a function that restores it.
+func withKeyCache(t *testing.T) (*KeyCache, func()) {
+	c, err := NewKeyCache(16, 0)
+	assert.Nil(t, err)
+	old := getKeyCache()
+	SetKeyCache(c)
+	return c, func() { SetKeyCache(old) }
+}
+
+func TestGetEncryptionKeyCoalesce(t *testing.T) {
+	_, restore := withKeyCache(t)
+	defer restore()
+	store := &fakeKeyStore{keys: map[string]encryption.Key{"user1": testKey(1)}, release: make(chan struct{})}
+
+	var wg sync.WaitGroup
+	keys := make([]encryption.Key, 10)
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, err := getEncryptionKey(context.Background(), store, "user1")
+			assert.Nil(t, err)
+			keys[i] = key
+		}(i)
+	}
+	// Wait until the first load is blocked, so that the others join it rather than hitting the cache.
+	for atomic.LoadInt32(&store.reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(store.release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.reads))
+	for _, key := range keys {
+		assert.Equal(t, *testKey(1), *key)
+	}
+	// Every caller has its own copy.
+	keys[0][0] = 99
+	assert.Equal(t, byte(1), keys[1][0])
+
+	// The key was cached.
+	_, err := getEncryptionKey(context.Background(), store, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.reads))
+}
+
+func TestGetEncryptionKeyCreatedConcurrently(t *testing.T) {
+	_, restore := withKeyCache(t)
+	defer restore()
+	store := &fakeKeyStore{keys: map[string]encryption.Key{}}
+	// Another replica creates a key between this one finding that there isn't one and creating its own.
+	store.beforeCreate = func(userid string) {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		store.keys[userid] = testKey(7)
+	}
+
+	key, err := getEncryptionKey(context.Background(), store, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, *testKey(7), *key, "the key created first must be used")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store.creates))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&store.reads))
+}
+
+func TestGetEncryptionKeyCreate(t *testing.T) {
+	_, restore := withKeyCache(t)
+	defer restore()
+	store := &fakeKeyStore{keys: map[string]encryption.Key{}}
+	key, err := getEncryptionKey(context.Background(), store, "user1")
+	assert.Nil(t, err)
+	assert.Equal(t, *store.keys["user1"], *key)
+}
+
+func TestGetEncryptionKeyPurgedWhileLoading(t *testing.T) {
+	c, restore := withKeyCache(t)
+	defer restore()
+	store := &fakeKeyStore{keys: map[string]encryption.Key{"user1": testKey(1)}, release: make(chan struct{})}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := getEncryptionKey(context.Background(), store, "user1")
+		assert.Nil(t, err)
+	}()
+	for atomic.LoadInt32(&store.reads) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// The key is shredded after it has been read, but before it is cached.
+	PurgeEncryptionKey("user1")
+	close(store.release)
+	<-done
+
+	_, ok := c.Get("user1")
+	assert.False(t, ok, "a purged key must not be cached")
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"github.com/google/uuid"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// RequestIDHeader contains the ID of a request, which may be set by the client or a load balancer.
+	RequestIDHeader = "X-Request-ID"
+	// TraceIDHeader and SpanIDHeader identify the span of a request in its response.
+	TraceIDHeader = "X-Trace-ID"
+	SpanIDHeader  = "X-Span-ID"
+)
+
+// validRequestID matches request IDs that are accepted from a client. Anything else is replaced.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// GetRequestID returns the ID of the request that ctx belongs to, or an empty string.
+func GetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestID gives every request an ID, taken from the X-Request-ID header if the client sent a valid one, and starts
+// a span for the request. The IDs of the request and span are returned in the response headers, and added to the
+// Logger in the request context so that they are included in every line logged while handling the request.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = uuid.New().String()
+		}
+		ctx, span := trace.StartSpan(r.Context(), "HTTP "+r.Method)
+		defer span.End()
+		span.AddAttributes(trace.StringAttribute("request_id", id))
+		ctx = context.WithValue(ctx, requestIDKey{}, id)
+		ctx = logger.With(ctx, "request_id", id)
+
+		sc := span.SpanContext()
+		w.Header().Set(RequestIDHeader, id)
+		w.Header().Set(TraceIDHeader, sc.TraceID.String())
+		w.Header().Set(SpanIDHeader, sc.SpanID.String())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/dparrish/build-web-application-demo/logger"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	l := logger.New(&buf)
+	var got string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = GetRequestID(r.Context())
+		logger.Infof(r.Context(), "handling")
+	}))
+
+	for _, test := range []struct {
+		header string
+		keep   bool
+	}{
+		{"", false},
+		{"req-1234", true},
+		{"bad id with spaces", false},
+	} {
+		buf.Reset()
+		r := httptest.NewRequest("GET", "/", nil)
+		r = r.WithContext(logger.NewContext(r.Context(), l))
+		if test.header != "" {
+			r.Header.Set(RequestIDHeader, test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if test.keep {
+			assert.Equal(t, test.header, got)
+		} else {
+			assert.NotEqual(t, test.header, got)
+			assert.Len(t, got, 36)
+		}
+		assert.Equal(t, got, w.Header().Get(RequestIDHeader))
+
+		var line map[string]interface{}
+		assert.Nil(t, json.Unmarshal(buf.Bytes(), &line))
+		assert.Equal(t, got, line["request_id"])
+		assert.Equal(t, w.Header().Get(TraceIDHeader), line["logging.googleapis.com/trace"])
+		assert.Equal(t, w.Header().Get(SpanIDHeader), line["logging.googleapis.com/spanId"])
+	}
+}
@@ -4,16 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+
+	"github.com/dparrish/build-web-application-demo/middleware"
 )
 
-// Errorf writes a swagger-compliant error response.
+// Errorf writes a swagger-compliant error response. The request, trace and span IDs are included if they have been
+// set in the response headers by middleware.RequestID, so that the error can be matched to the logs of the request.
 func Errorf(w http.ResponseWriter, code int, format string, a ...interface{}) {
 	out := struct {
-		Code    int    `json:"code"`
-		Message string `json:"message"`
+		Code      int    `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"request_id,omitempty"`
+		TraceID   string `json:"trace_id,omitempty"`
+		SpanID    string `json:"span_id,omitempty"`
 	}{
-		Code:    code,
-		Message: fmt.Sprintf(format, a...),
+		Code:      code,
+		Message:   fmt.Sprintf(format, a...),
+		RequestID: w.Header().Get(middleware.RequestIDHeader),
+		TraceID:   w.Header().Get(middleware.TraceIDHeader),
+		SpanID:    w.Header().Get(middleware.SpanIDHeader),
 	}
 
 	b, err := json.Marshal(out)
@@ -26,3 +26,13 @@ func TestErrorfFailure(t *testing.T) {
 	b, _ := ioutil.ReadAll(res.Body)
 	assert.Equal(t, strings.TrimSpace(string(b)), `{"code":404,"message":"not found"}`)
 }
+
+func TestErrorfRequestID(t *testing.T) {
+	w := httptest.NewRecorder()
+	w.Header().Set("X-Request-ID", "req-1")
+	w.Header().Set("X-Trace-ID", "trace-1")
+	w.Header().Set("X-Span-ID", "span-1")
+	Errorf(w, 500, "failed")
+	b, _ := ioutil.ReadAll(w.Result().Body)
+	assert.Equal(t, `{"code":500,"message":"failed","request_id":"req-1","trace_id":"trace-1","span_id":"span-1"}`, strings.TrimSpace(string(b)))
+}